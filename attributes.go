@@ -0,0 +1,246 @@
+package cakedb
+
+import (
+	"encoding/json"
+	"github.com/peterbourgon/diskv/v3"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const AttributePath = "/data/cake-db/data/attributes"
+
+// AttributeChange holds the attributes of a device that changed at Time
+type AttributeChange struct {
+	Time   int64             `json:"time"` // ns
+	Values map[string]string `json:"values"`
+}
+
+// attributeStore keeps the timeline of the attributes of every device, one diskv value per device.
+// The timelines are loaded on first use and the current values are indexed by attribute.
+type attributeStore struct {
+	mu        sync.Mutex
+	diskv     *diskv.Diskv
+	loaded    bool
+	timelines map[DeviceId][]AttributeChange
+	index     map[string]map[string]map[DeviceId]bool
+}
+
+func newAttributeStore() *attributeStore {
+	return &attributeStore{
+		diskv: diskv.New(diskv.Options{
+			BasePath: AttributePath,
+			Transform: func(s string) []string {
+				if len(s) > 2 {
+					return []string{s[:2]}
+				}
+				return []string{"0" + s[:1]}
+			},
+		}),
+	}
+}
+
+// load reads every timeline, it needs the write lock
+func (s *attributeStore) load() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	s.timelines = map[DeviceId][]AttributeChange{}
+	s.index = map[string]map[string]map[DeviceId]bool{}
+	for key := range s.diskv.Keys(nil) {
+		did, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			continue
+		}
+		buf, err := s.diskv.Read(key)
+		if err != nil {
+			continue
+		}
+		var timeline []AttributeChange
+		if json.Unmarshal(buf, &timeline) != nil {
+			continue
+		}
+		s.timelines[DeviceId(did)] = timeline
+		s.reindex(DeviceId(did), nil)
+	}
+}
+
+// valuesAt folds the changes of a timeline up to and including ts
+func valuesAt(timeline []AttributeChange, ts int64) map[string]string {
+	values := map[string]string{}
+	for _, change := range timeline {
+		if change.Time > ts {
+			break
+		}
+		for name, value := range change.Values {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// reindex replaces the current values old of did in the index by the ones of its timeline
+func (s *attributeStore) reindex(did DeviceId, old map[string]string) {
+	for name, value := range old {
+		delete(s.index[name][value], did)
+	}
+	timeline := s.timelines[did]
+	if len(timeline) == 0 {
+		return
+	}
+	for name, value := range valuesAt(timeline, timeline[len(timeline)-1].Time) {
+		if s.index[name] == nil {
+			s.index[name] = map[string]map[DeviceId]bool{}
+		}
+		if s.index[name][value] == nil {
+			s.index[name][value] = map[DeviceId]bool{}
+		}
+		s.index[name][value][did] = true
+	}
+}
+
+func (s *attributeStore) set(did DeviceId, ts int64, attrs map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+
+	timeline := s.timelines[did]
+	before := valuesAt(timeline, ts)
+	changed := map[string]string{}
+	for name, value := range attrs {
+		if old, ok := before[name]; !ok || old != value {
+			changed[name] = value
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	var current map[string]string
+	if len(timeline) > 0 {
+		current = valuesAt(timeline, timeline[len(timeline)-1].Time)
+	}
+	i := sort.Search(len(timeline), func(i int) bool {
+		return timeline[i].Time >= ts
+	})
+	next := append([]AttributeChange{}, timeline[:i]...)
+	if i < len(timeline) && timeline[i].Time == ts {
+		merged := map[string]string{}
+		for name, value := range timeline[i].Values {
+			merged[name] = value
+		}
+		for name, value := range changed {
+			merged[name] = value
+		}
+		next = append(next, AttributeChange{Time: ts, Values: merged})
+		i++
+	} else {
+		next = append(next, AttributeChange{Time: ts, Values: changed})
+	}
+	next = append(next, timeline[i:]...)
+
+	buf, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	err = s.diskv.Write(strconv.Itoa(int(did)), buf)
+	if err != nil {
+		return err
+	}
+	s.timelines[did] = next
+	s.reindex(did, current)
+	return nil
+}
+
+func (s *attributeStore) timeline(did DeviceId) []AttributeChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	return s.timelines[did]
+}
+
+func (s *attributeStore) devices(attrs map[string]string) []DeviceId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	var dids []DeviceId
+	first := true
+	for name, value := range attrs {
+		matched := s.index[name][value]
+		if first {
+			for did := range matched {
+				dids = append(dids, did)
+			}
+			first = false
+			continue
+		}
+		kept := dids[:0]
+		for _, did := range dids {
+			if matched[did] {
+				kept = append(kept, did)
+			}
+		}
+		dids = kept
+	}
+	sort.Slice(dids, func(i, j int) bool {
+		return dids[i] < dids[j]
+	})
+	return dids
+}
+
+// SetAttributes records the attributes of did at ts, only the ones that differ from the values
+// the device had at ts are added to its timeline
+func (e *Engine) SetAttributes(did DeviceId, ts int64, attrs map[string]string) error {
+	return e.attributes.set(did, ts, attrs)
+}
+
+// Attributes returns the current attributes of did
+func (e *Engine) Attributes(did DeviceId) map[string]string {
+	timeline := e.attributes.timeline(did)
+	if len(timeline) == 0 {
+		return map[string]string{}
+	}
+	return valuesAt(timeline, timeline[len(timeline)-1].Time)
+}
+
+// AttributesAt returns the attributes did had at ts
+func (e *Engine) AttributesAt(did DeviceId, ts int64) map[string]string {
+	return valuesAt(e.attributes.timeline(did), ts)
+}
+
+// HadAttributes tells whether did had every value of attrs at some time in [start, end]
+func (e *Engine) HadAttributes(did DeviceId, attrs map[string]string, start, end int64) bool {
+	timeline := e.attributes.timeline(did)
+	values := map[string]string{}
+	for i, change := range timeline {
+		if change.Time > end {
+			break
+		}
+		for name, value := range change.Values {
+			values[name] = value
+		}
+		// the values hold until the next change
+		if i+1 < len(timeline) && timeline[i+1].Time <= start {
+			continue
+		}
+		matched := true
+		for name, value := range attrs {
+			matched = matched && values[name] == value
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AttributeHistory returns the changes of the attributes of did sorted by time
+func (e *Engine) AttributeHistory(did DeviceId) []AttributeChange {
+	return append([]AttributeChange{}, e.attributes.timeline(did)...)
+}
+
+// DevicesWithAttributes returns the devices whose current attributes have every value of attrs
+func (e *Engine) DevicesWithAttributes(attrs map[string]string) []DeviceId {
+	return e.attributes.devices(attrs)
+}
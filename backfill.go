@@ -0,0 +1,198 @@
+package cakedb
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"sync"
+	"time"
+)
+
+// DefaultBackfillSize is the MaxSize of a Backfill, the size at which the memtable is dumped as well
+const DefaultBackfillSize = 100 * 1e6
+
+// Backfill writes points of old shards without going through the memtable and the acceptance window.
+// The points are kept per shard and written as one file per shard on Close, or for the largest shard
+// once MaxSize bytes are buffered, so a backfill adds a few large files to a shard instead of a small
+// file on every memtable dump. Compaction and downsampling skip the shards of an open Backfill.
+// The continuous queries and Last see a point once it is written to its file.
+type Backfill struct {
+	// MaxSize is the number of bytes buffered before the largest shard is written
+	MaxSize int
+
+	e      *Engine
+	mu     sync.Mutex
+	lists  map[int64]Skiplist[*Point, struct{}]
+	sizes  map[int64]int
+	size   int
+	closed bool
+}
+
+// Backfill starts a backfill, it has to be closed to write the buffered points and release its shards
+func (e *Engine) Backfill() *Backfill {
+	return &Backfill{
+		MaxSize: DefaultBackfillSize,
+		e:       e,
+		lists:   map[int64]Skiplist[*Point, struct{}]{},
+		sizes:   map[int64]int{},
+	}
+}
+
+func (e *Engine) beginBackfill(shardId int64) {
+	e.backfillMu.Lock()
+	defer e.backfillMu.Unlock()
+	e.backfilling[shardId]++
+}
+
+func (e *Engine) endBackfill(shardId int64) {
+	e.backfillMu.Lock()
+	defer e.backfillMu.Unlock()
+	e.backfilling[shardId]--
+	if e.backfilling[shardId] <= 0 {
+		delete(e.backfilling, shardId)
+	}
+}
+
+// isBackfilling tells if an open Backfill has points of the shard
+func (e *Engine) isBackfilling(shardId int64) bool {
+	e.backfillMu.Lock()
+	defer e.backfillMu.Unlock()
+	return e.backfilling[shardId] > 0
+}
+
+func (b *Backfill) Write(key Data, point *Point) error {
+	if point.Timestamp < 0 {
+		return errors.NotValidf("timestamp %d", point.Timestamp)
+	}
+	err := b.e.writeKey(point.DeviceId, key)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("backfill is closed")
+	}
+	shardId := point.Timestamp / ShardSize
+	list, ok := b.lists[shardId]
+	if !ok {
+		list = NewSkipListMap[*Point, struct{}](&DataCompare{})
+		b.lists[shardId] = list
+		b.e.beginBackfill(shardId)
+	}
+	list.Insert(point, struct{}{})
+	size := len(point.Data)*8 + 16
+	b.sizes[shardId] += size
+	b.size += size
+	if b.size > b.MaxSize {
+		largest := shardId
+		for id, size := range b.sizes {
+			if size > b.sizes[largest] {
+				largest = id
+			}
+		}
+		return b.flush(largest)
+	}
+	return nil
+}
+
+// flush writes the buffered points of a shard into a file, the shard stays marked until Close.
+// If that fails the points stay buffered. Once they are readable from the file the rollups and
+// the last points take them, a rollup recomputed before would not find them.
+func (b *Backfill) flush(shardId int64) error {
+	list := b.lists[shardId]
+	if list == nil || list.Size() == 0 {
+		return nil
+	}
+	b.e.startDump(list)
+	err := b.e.dumpList(list)
+	b.e.dumped(list)
+	if err != nil {
+		return err
+	}
+	iterator, err := list.Iterator()
+	if err != nil {
+		return err
+	}
+	for {
+		point, _, err := iterator.Next()
+		if err != nil {
+			break
+		}
+		b.e.last.update(point)
+		for _, r := range b.e.rollups {
+			r.touch(point)
+		}
+	}
+	// the points are in the file already, a mark that is not saved now is saved with the next batch
+	if err := b.e.saveRollups(); err != nil {
+		fmt.Println(time.Now(), "backfill", shardId, err)
+	}
+	b.lists[shardId] = NewSkipListMap[*Point, struct{}](&DataCompare{})
+	b.size -= b.sizes[shardId]
+	b.sizes[shardId] = 0
+	return nil
+}
+
+// Flush writes the buffered points, one file per shard, and returns the first error.
+// Unlike Close the backfill stays open and its shards stay marked, so a caller that persists
+// regularly does not release the shards to compaction between two writes.
+// The points of a shard whose write failed stay buffered.
+func (b *Backfill) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	return b.flushAll()
+}
+
+func (b *Backfill) flushAll() error {
+	var err error
+	for shardId := range b.lists {
+		if flushErr := b.flush(shardId); flushErr != nil && err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Size returns the number of bytes buffered
+func (b *Backfill) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Close writes the buffered points, one file per shard, and releases the shards.
+// If a write fails the backfill stays open with the points that were not written,
+// Close can be called again, or Discard drops them.
+func (b *Backfill) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	err := b.flushAll()
+	if err != nil {
+		return err
+	}
+	b.release()
+	return nil
+}
+
+// Discard drops the buffered points and releases the shards, for a caller that keeps the points elsewhere
+func (b *Backfill) Discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.release()
+	}
+}
+
+func (b *Backfill) release() {
+	b.closed = true
+	for shardId := range b.lists {
+		b.e.endBackfill(shardId)
+	}
+	b.lists, b.sizes, b.size = nil, nil, 0
+}
@@ -0,0 +1,217 @@
+package cakedb
+
+import (
+	"encoding/json"
+	"github.com/juju/errors"
+	"math"
+	"os"
+)
+
+// data types of a register, the raw value holds the bits of the type
+const (
+	RegisterInt16   = "int16"
+	RegisterInt32   = "int32"
+	RegisterInt64   = "int64"
+	RegisterFloat32 = "float32"
+)
+
+// ModelAttribute is the device attribute selecting the registers of a model in a Catalog
+const ModelAttribute = "type"
+
+// RegisterDef describes the engineering value of a register
+type RegisterDef struct {
+	Address int64  `json:"address"`
+	Name    string `json:"name"`
+	Unit    string `json:"unit"`
+	// Scale multiplies the value, 0 means 1
+	Scale  float64 `json:"scale"`
+	Signed bool    `json:"signed"`
+	// Type is int16, int32, int64 or float32, empty means int64
+	Type string `json:"type"`
+}
+
+// Value converts a raw value into the engineering value
+func (d RegisterDef) Value(raw int64) float64 {
+	var v float64
+	switch d.Type {
+	case RegisterInt16:
+		if d.Signed {
+			v = float64(int16(raw))
+		} else {
+			v = float64(uint16(raw))
+		}
+	case RegisterInt32:
+		if d.Signed {
+			v = float64(int32(raw))
+		} else {
+			v = float64(uint32(raw))
+		}
+	case RegisterFloat32:
+		v = float64(math.Float32frombits(uint32(raw)))
+	default:
+		if d.Signed {
+			v = float64(raw)
+		} else {
+			v = float64(uint64(raw))
+		}
+	}
+	return v * d.scale()
+}
+
+// Linear tells whether Value only scales the raw value, so that the min, max and mean of raw values
+// convert into the ones of the engineering values. A signed int16 or int32 and a float32 take
+// the bits of the raw value instead.
+func (d RegisterDef) Linear() bool {
+	switch d.Type {
+	case RegisterInt16, RegisterInt32:
+		return !d.Signed
+	case RegisterFloat32:
+		return false
+	}
+	return true
+}
+
+func (d RegisterDef) scale() float64 {
+	if d.Scale == 0 {
+		return 1
+	}
+	return d.Scale
+}
+
+// Catalog maps register addresses to their definitions. Registers applies to every device,
+// Models adds or replaces definitions for the devices whose ModelAttribute is the model.
+type Catalog struct {
+	Registers []RegisterDef            `json:"registers"`
+	Models    map[string][]RegisterDef `json:"models"`
+
+	byAddress map[string]map[int64]RegisterDef
+	byName    map[string]map[string]RegisterDef
+}
+
+// NewCatalog validates the definitions and indexes them by address and name
+func NewCatalog(registers []RegisterDef, models map[string][]RegisterDef) (*Catalog, error) {
+	c := &Catalog{Registers: registers, Models: models}
+	return c, c.build()
+}
+
+func LoadCatalog(path string) (*Catalog, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Catalog{}
+	err = json.Unmarshal(buf, c)
+	if err != nil {
+		return nil, errors.Annotatef(err, "register catalog %s", path)
+	}
+	err = c.build()
+	if err != nil {
+		return nil, errors.Annotatef(err, "register catalog %s", path)
+	}
+	return c, nil
+}
+
+func checkRegisters(defs []RegisterDef) error {
+	names := map[string]int64{}
+	for _, d := range defs {
+		switch d.Type {
+		case "", RegisterInt16, RegisterInt32, RegisterInt64, RegisterFloat32:
+		default:
+			return errors.NotValidf("type %q of register %d", d.Type, d.Address)
+		}
+		if address, ok := names[d.Name]; ok && d.Name != "" {
+			return errors.AlreadyExistsf("name %q of register %d and %d", d.Name, address, d.Address)
+		}
+		names[d.Name] = d.Address
+	}
+	return nil
+}
+
+// merge adds defs to model, a definition replaces the ones with its address or name
+func (c *Catalog) merge(model string, defs []RegisterDef) {
+	if c.byAddress[model] == nil {
+		c.byAddress[model] = map[int64]RegisterDef{}
+		c.byName[model] = map[string]RegisterDef{}
+	}
+	byAddress, byName := c.byAddress[model], c.byName[model]
+	for _, d := range defs {
+		if old, ok := byAddress[d.Address]; ok {
+			delete(byName, old.Name)
+		}
+		if old, ok := byName[d.Name]; ok && d.Name != "" {
+			delete(byAddress, old.Address)
+		}
+		byAddress[d.Address] = d
+		if d.Name != "" {
+			byName[d.Name] = d
+		}
+	}
+}
+
+func (c *Catalog) build() error {
+	c.byAddress = map[string]map[int64]RegisterDef{}
+	c.byName = map[string]map[string]RegisterDef{}
+	err := checkRegisters(c.Registers)
+	if err != nil {
+		return err
+	}
+	c.merge("", c.Registers)
+	for model, defs := range c.Models {
+		if model == "" {
+			continue
+		}
+		err := checkRegisters(defs)
+		if err != nil {
+			return errors.Annotatef(err, "model %q", model)
+		}
+		// a model starts from the definitions of every device
+		c.merge(model, c.Registers)
+		c.merge(model, defs)
+	}
+	return nil
+}
+
+func (c *Catalog) model(model string) string {
+	if _, ok := c.byAddress[model]; ok {
+		return model
+	}
+	return ""
+}
+
+// Register returns the definition of address for model, an unknown model takes Registers
+func (c *Catalog) Register(model string, address int64) (RegisterDef, bool) {
+	if c == nil {
+		return RegisterDef{}, false
+	}
+	d, ok := c.byAddress[c.model(model)][address]
+	return d, ok
+}
+
+// RegisterByName returns the definition named name for model
+func (c *Catalog) RegisterByName(model string, name string) (RegisterDef, bool) {
+	if c == nil {
+		return RegisterDef{}, false
+	}
+	d, ok := c.byName[c.model(model)][name]
+	return d, ok
+}
+
+// WithCatalog lets queries address registers by name and return engineering values
+func WithCatalog(c *Catalog) Option {
+	return func(e *Engine) {
+		e.catalog = c
+	}
+}
+
+// Catalog returns the register catalog of the engine, nil without one
+func (e *Engine) Catalog() *Catalog {
+	return e.catalog
+}
+
+// deviceModel returns the model of did in the catalog
+func (e *Engine) deviceModel(did DeviceId) string {
+	if e.catalog == nil {
+		return ""
+	}
+	return e.Attributes(did)[ModelAttribute]
+}
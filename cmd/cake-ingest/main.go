@@ -0,0 +1,154 @@
+package main
+
+import (
+	cakedb "cake-db"
+	"cake-db/pkg/analyzer"
+	dumpservice "cake-db/pkg/dumperservice"
+	"cake-db/pkg/ingest"
+	"context"
+	"flag"
+	"github.com/araddon/dateparse"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	prefix     = flag.String("prefix", "/data/dumpdb/delta-solar", "root directory of the dump files")
+	topic      = flag.String("topic", "delta-solar", "topic of the dump files")
+	part       = flag.Int("part", 0, "partition of the topic")
+	path       = flag.Int("path", 0, "directory to start from without a checkpoint")
+	file       = flag.Int("file", 0, "file to start from without a checkpoint")
+	checkpoint = flag.String("checkpoint", "", "checkpoint file, defaults to <checkpoint-dir>/<topic>-<part>.json")
+	dir        = flag.String("checkpoint-dir", "/data/cake-db/ingest", "directory of the checkpoints")
+	interval   = flag.Duration("interval", ingest.DefaultCheckpointInterval, "time between checkpoints")
+	poll       = flag.Duration("poll", ingest.DefaultPollInterval, "time to wait for new messages at the end of the dump")
+	maxPending = flag.Int("max-pending", ingest.DefaultMaxPending, "points waiting for the engine above which fetching pauses, 0 disables it")
+	all        = flag.Bool("all-partitions", false, "consume every partition of the topic concurrently, each with its checkpoint in -checkpoint-dir")
+	since      = flag.String("since", "", "time to start from without a checkpoint instead of -path and -file, e.g. \"2023-05-01 00:00\"")
+	analyzers  = flag.String("analyzers", "", "json file assigning the status, alarm and config analyzers to message types")
+	events     = flag.String("events", "", "file the events of the analyzers are appended to, empty drops them")
+	replay     = flag.Bool("replay-dead-letters", false, "run the dead letters through the analyzers again and exit")
+	replayKind = flag.String("dead-letter-kind", "", "replay only the dead letters of this kind, timeout or invalid")
+	replayDid  = flag.Int("dead-letter-device", 0, "replay only the dead letters of this device")
+	discover   = flag.Duration("discover", dumpservice.DefaultDiscoverInterval, "time between two looks for new partitions with -all-partitions")
+	backfill   = flag.Bool("backfill", false, "write the points of old dumps as one file per shard and checkpoint, use a long -interval with it")
+	acceptPast = flag.Duration("accept-past", 0, "quarantine points older than this, 0 accepts any age, ignored with -backfill")
+	acceptNext = flag.Duration("accept-future", 0, "quarantine points newer than now plus this, 0 accepts any time, ignored with -backfill")
+)
+
+var eventLog *ingest.EventLog
+
+func configure(p *ingest.Pipeline) {
+	p.CheckpointInterval = *interval
+	p.PollInterval = *poll
+	p.MaxPending = *maxPending
+	p.Backfill = *backfill
+	if eventLog != nil {
+		p.Events = eventLog
+	}
+}
+
+func newEngine() *cakedb.Engine {
+	engine := cakedb.New(cakedb.WithAcceptWindow(*acceptPast, *acceptNext))
+	engine.Init()
+	return engine
+}
+
+func main() {
+	flag.Parse()
+	var sinceTime time.Time
+	if *since != "" {
+		t, err := dateparse.ParseLocal(*since)
+		if err != nil {
+			log.Fatalf("since: %v", err)
+		}
+		sinceTime = t
+	}
+	registry, err := analyzer.LoadRegistry(*analyzers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *events != "" {
+		eventLog, err = ingest.OpenEventLog(*events)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer eventLog.Close()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+
+	if *replay {
+		engine := newEngine()
+		pipeline := ingest.NewPipeline(engine, nil, registry.Topic(*topic), "")
+		configure(pipeline)
+		replayed, rejected, err := pipeline.Replay(cakedb.DeadLetterQuery{
+			DeviceId: cakedb.DeviceId(*replayDid),
+			Kind:     *replayKind,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("replayed %d dead letters, %d rejected again", replayed, rejected)
+		return
+	}
+
+	if *all {
+		engine := newEngine()
+		group := ingest.NewGroup(engine, *prefix, *topic, registry.Topic(*topic), *dir)
+		group.DiscoverInterval = *discover
+		group.Configure = configure
+		group.Since = sinceTime
+		err := group.Run(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("stopped after %s", time.Since(start))
+		return
+	}
+
+	if *checkpoint == "" {
+		*checkpoint = ingest.CheckpointPath(*dir, *topic, int32(*part))
+	}
+
+	position, ok, err := ingest.LoadCheckpoint(*checkpoint)
+	if err != nil {
+		log.Fatalf("checkpoint %s: %v", *checkpoint, err)
+	}
+	if ok {
+		log.Printf("resume from %+v", position)
+	} else {
+		position = dumpservice.SolarDumpService{
+			Prefix: *prefix,
+			Topic:  *topic,
+			Part:   int32(*part),
+			Path:   int32(*path),
+			File:   int32(*file),
+		}
+	}
+	service := dumpservice.NewService(position)
+	if !ok {
+		if !sinceTime.IsZero() {
+			position, err = service.SeekToTime(sinceTime)
+			if err != nil {
+				log.Fatalf("seek to %s: %v", sinceTime, err)
+			}
+		}
+		log.Printf("start from %+v", position)
+	}
+
+	engine := newEngine()
+
+	pipeline := ingest.NewPipeline(engine, service, registry.Topic(*topic), *checkpoint)
+	configure(pipeline)
+
+	err = pipeline.Run(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("stopped after %s", time.Since(start))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	dumpservice "cake-db/pkg/dumperservice"
+	"context"
+	"flag"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	prefix      = flag.String("prefix", "/data/dumpdb/delta-solar", "root directory of the captured dump files")
+	topic       = flag.String("topic", "delta-solar", "topic of the captured dump files")
+	part        = flag.Int("part", 0, "partition of the captured topic")
+	path        = flag.Int("path", 0, "directory to start reading from")
+	file        = flag.Int("file", 0, "file to start reading from")
+	from        = flag.Int64("from", 0, "first message time to replay in unix ms")
+	to          = flag.Int64("to", math.MaxInt64, "last message time to replay in unix ms")
+	speed       = flag.Float64("speed", 1, "replay speed relative to the captured times, 0 replays as fast as possible")
+	outPrefix   = flag.String("out-prefix", "/data/dumpdb/replay", "root directory of the replayed dump files")
+	outTopic    = flag.String("out-topic", "", "topic of the replayed dump files, defaults to -topic")
+	outPart     = flag.Int("out-part", -1, "partition of the replayed dump files, defaults to -part")
+	maxFileSize = flag.Int64("max-file-size", dumpservice.DefaultMaxFileSize, "size of a replayed file before the next one is started")
+	compress    = flag.Bool("gzip", false, "gzip the replayed files once they are closed")
+)
+
+// wait sleeps until the message captured at t is due, captured times are in ms
+func wait(ctx context.Context, start time.Time, first, t int64) {
+	if *speed <= 0 {
+		return
+	}
+	due := start.Add(time.Duration(float64(t-first) * float64(time.Millisecond) / *speed))
+	d := time.Until(due)
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *outTopic == "" {
+		*outTopic = *topic
+	}
+	if *outPart < 0 {
+		*outPart = *part
+	}
+
+	service := dumpservice.NewService(dumpservice.SolarDumpService{
+		Prefix: *prefix,
+		Topic:  *topic,
+		Part:   int32(*part),
+		Path:   int32(*path),
+		File:   int32(*file),
+	})
+	writer := dumpservice.NewWriter(dumpservice.SolarDumpService{
+		Prefix: *outPrefix,
+		Topic:  *outTopic,
+		Part:   int32(*outPart),
+	})
+	writer.MaxFileSize = *maxFileSize
+	writer.Compress = *compress
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var (
+		start    time.Time
+		first    int64
+		replayed int
+	)
+	done := false
+	for !done && ctx.Err() == nil {
+		position := service.LastCommit()
+		messages, err := service.FetchMessage()
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			log.Fatal(err)
+		}
+		// a capture is complete, it ends where the service stops moving
+		if len(messages) == 0 && service.LastCommit() == position {
+			break
+		}
+		for _, msg := range messages {
+			t := int64(msg.Time)
+			if t < *from {
+				continue
+			}
+			if t > *to {
+				done = true
+				break
+			}
+			if replayed == 0 {
+				start, first = time.Now(), t
+			}
+			wait(ctx, start, first, t)
+			if ctx.Err() != nil {
+				break
+			}
+			err := writer.Write(msg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			replayed++
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("replayed %d messages up to %+v", replayed, writer.Position())
+}
@@ -1,74 +1,197 @@
 package main
 
-func write() {
-	//engine := cake_db.New()
-	//engine.Init()
-	//
-	//service := dumpservice.NewService(dumpservice.SolarDumpService{
-	//	Prefix: "/data/dumpdb/delta-solar",
-	//	Topic:  "delta-solar",
-	//	Part:   0,
-	//	Path:   0,
-	//	File:   926,
-	//	Off:    0,
-	//	Cnt:    0,
-	//})
-	//
-	//solarAnalyzer := analyzer.SolarAnalyzer{}
-	//for {
-	//	message, err := service.FetchMessage()
-	//	if err != nil {
-	//		panic(err)
-	//	}
-	//	if len(message) == 0 {
-	//		continue
-	//	}
-	//	for _, msg := range message {
-	//		analyze, err := solarAnalyzer.Analyze(analyzer.Message{
-	//			Offset:    msg.Offset,
-	//			CreatedAt: time.UnixMilli(int64(msg.Time)),
-	//			DeviceId:  msg.DeviceId,
-	//			Bytes:     msg.Data,
-	//			Length:    msg.Len,
-	//		})
-	//		if err != nil {
-	//			continue
-	//		}
-	//		for _, i := range analyze {
-	//			if i.MsgType == 80 {
-	//				m := i.Data.(analyzer.SolarMessage)
-	//				if m.GetSolarData() == nil {
-	//					continue
-	//				}
-	//				if len(m.GetSolarData().Regs) > 0 {
-	//					regs := m.GetSolarData().Regs
-	//					var key []int64
-	//					var value []int64
-	//					for _, reg := range regs {
-	//						key = append(key, int64(reg[0]))
-	//						value = append(value, int64(reg[1]))
-	//					}
-	//					engine.Write(key, &cake_db.Point{
-	//						Data:      value,
-	//						DeviceId:  cake_db.DeviceId(i.DeviceId),
-	//						Timestamp: i.UpdatedAt.UnixNano(),
-	//					})
-	//				}
-	//
-	//			}
-	//		}
-	//	}
-	//
-	//	fmt.Println(time.Now(), service.LastCommit())
-	//}
-}
+import (
+	cakedb "cake-db"
+	"cake-db/pkg/api"
+	"cake-db/pkg/grafana"
+	"cake-db/pkg/grpcapi"
+	"cake-db/pkg/influx"
+	"cake-db/pkg/prometheus"
+	"cake-db/server"
+	"context"
+	"flag"
+	"github.com/juju/errors"
+	"google.golang.org/grpc"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
 
-type Server interface {
-	CreateDB(name string) error
-	Write(deviceId, timestamp int64, values []int64) error
-	ReadValue(deviceId, start, end int64) ([]int64, error)
-	ReadKey(deviceId, start, end int64) ([]int64, error)
-}
+var (
+	addr            = flag.String("addr", ":8086", "http listen address")
+	root            = flag.String("root", "/data/cake-db/server", "root directory of the databases")
+	createDB        = flag.String("create", "", "comma separated databases to create if they do not exist")
+	grpcAddr        = flag.String("grpc-addr", "", "grpc listen address of the engine service, empty disables it")
+	influxWrite     = flag.Bool("influx", false, "serve the InfluxDB line protocol endpoint /api/v2/write on the engine")
+	influxMapping   = flag.String("influx-mapping", "", "json file of the line protocol mapping rules")
+	promEnabled     = flag.Bool("prometheus", false, "serve the Prometheus remote_write and remote_read endpoints on the engine")
+	promIndex       = flag.String("prometheus-index", "/data/cake-db/prometheus.index", "file of the Prometheus series index")
+	promConfig      = flag.String("prometheus-config", "", "json file of the Prometheus register mapping")
+	grafanaEnabled  = flag.Bool("grafana", false, "serve the Grafana JSON datasource on the engine under /grafana")
+	queryEnabled    = flag.Bool("query", false, "serve the query language endpoint /query on the engine")
+	deadLetters     = flag.Bool("dead-letters", false, "serve the dead letters of the engine under /deadletters")
+	quarantine      = flag.Bool("quarantine", false, "serve the quarantined points of the engine under /quarantine")
+	acceptPast      = flag.Duration("accept-past", 0, "quarantine written points older than this, 0 accepts any age")
+	acceptFuture    = flag.Duration("accept-future", 0, "quarantine written points newer than now plus this, 0 accepts any time")
+	continuousQuery = flag.String("continuous-queries", "", "comma separated name=resolution rollups of the engine, e.g. rollup5m=5m,rollup1h=1h")
+	registerCatalog = flag.String("register-catalog", "", "json file of the register names, units and scale factors used by SCALED queries")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for in-flight requests on shutdown")
+)
 
 func main() {
+	flag.Parse()
+
+	cakeServer, err := server.NewServer(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range strings.Split(*createDB, ",") {
+		if name == "" {
+			continue
+		}
+		err := cakeServer.CreateDB(name)
+		if err != nil && !errors.Is(err, errors.AlreadyExists) {
+			log.Fatal(err)
+		}
+	}
+
+	handler := api.NewHandler(cakeServer)
+	httpServer := &http.Server{
+		Addr:    *addr,
+		Handler: handler,
+	}
+
+	var engine *cakedb.Engine
+	if *grpcAddr != "" || *influxWrite || *promEnabled || *grafanaEnabled || *queryEnabled || *deadLetters || *quarantine {
+		var cqs []cakedb.ContinuousQuery
+		for _, cq := range strings.Split(*continuousQuery, ",") {
+			if cq == "" {
+				continue
+			}
+			name, resolution, _ := strings.Cut(cq, "=")
+			d, err := time.ParseDuration(resolution)
+			if err != nil {
+				log.Fatal(errors.Annotatef(err, "continuous query %s", cq))
+			}
+			cqs = append(cqs, cakedb.ContinuousQuery{Name: name, Resolution: int64(d)})
+		}
+		opts := []cakedb.Option{cakedb.WithContinuousQuery(cqs...), cakedb.WithAcceptWindow(*acceptPast, *acceptFuture)}
+		if *registerCatalog != "" {
+			catalog, err := cakedb.LoadCatalog(*registerCatalog)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts = append(opts, cakedb.WithCatalog(catalog))
+		}
+		engine = cakedb.New(opts...)
+		engine.Init()
+	}
+
+	if *influxWrite {
+		mapping := influx.DefaultMapping()
+		if *influxMapping != "" {
+			mapping, err = influx.LoadMapping(*influxMapping)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		influxHandler := influx.NewHandler(engine, mapping)
+		handler.Handle("/api/v2/write", influxHandler)
+		handler.Handle("/write", influxHandler)
+	}
+
+	var promSeries *prometheus.Index
+	if *promEnabled {
+		config := prometheus.DefaultConfig()
+		if *promConfig != "" {
+			config, err = prometheus.LoadConfig(*promConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		promSeries, err = prometheus.OpenIndex(*promIndex)
+		if err != nil {
+			log.Fatal(err)
+		}
+		promHandler := prometheus.NewHandler(engine, promSeries, config)
+		handler.Handle("/api/v1/prom/write", http.HandlerFunc(promHandler.Write))
+		handler.Handle("/api/v1/prom/read", http.HandlerFunc(promHandler.Read))
+	}
+
+	if *grafanaEnabled {
+		handler.Handle("/grafana/", http.StripPrefix("/grafana", grafana.NewHandler(engine)))
+	}
+
+	if *queryEnabled {
+		handler.Handle("/query", api.NewQueryHandler(engine))
+	}
+
+	if *deadLetters {
+		handler.Handle("/deadletters", api.NewDeadLetterHandler(engine))
+	}
+
+	if *quarantine {
+		handler.Handle("/quarantine", api.NewQuarantineHandler(engine))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		grpcServer = grpc.NewServer()
+		grpcapi.RegisterCakeServer(grpcServer, grpcapi.NewService(engine))
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Println("grpc listen on", *grpcAddr)
+			err := grpcServer.Serve(listener)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go func() {
+		log.Println("listen on", *addr, "root", *root, "dbs", cakeServer.ListDB())
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err = httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Println("shutdown:", err)
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	if promSeries != nil {
+		promSeries.Close()
+	}
+	// the engine acknowledged the writes it buffered, they have to reach the files
+	if engine != nil {
+		err := engine.Flush()
+		if err != nil {
+			log.Println("flush:", err)
+		}
+	}
+	// flush every database after the last write returned
+	err = cakeServer.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("bye")
 }
@@ -0,0 +1,112 @@
+package cakedb
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	FnRate                  = "rate"
+	FnIncrease              = "increase"
+	FnDerivative            = "derivative"
+	FnNonNegativeDifference = "non_negative_difference"
+)
+
+// counter follows the values of one register.
+//
+// A decrease is a wrap-around when bits is set and the value fell by more than half
+// of the range, otherwise the counter was reset to zero and the increase is the new value.
+type counter struct {
+	bits   int
+	prev   int64
+	prevTs int64
+	ok     bool
+}
+
+// next returns the increase and the signed difference to the previous value and the time between them
+func (c *counter) next(timestamp, v int64) (increase, diff float64, dt int64, ok bool) {
+	prev, prevTs, had := c.prev, c.prevTs, c.ok
+	c.prev, c.prevTs, c.ok = v, timestamp, true
+	if !had {
+		return 0, 0, 0, false
+	}
+	diff = float64(v - prev)
+	increase = diff
+	if v < prev {
+		increase = float64(v)
+		if c.bits > 0 {
+			span := math.Ldexp(1, c.bits)
+			if float64(prev-v) > span/2 {
+				increase = float64(v) + span - float64(prev)
+			}
+		}
+	}
+	return increase, diff, timestamp - prevTs, true
+}
+
+// counterValue is the value of a counter function over increases, differences and time summed up
+func counterValue(fn string, increase, diff float64, dt int64) any {
+	switch fn {
+	case FnIncrease, FnNonNegativeDifference:
+		return increase
+	case FnRate, FnDerivative:
+		if dt <= 0 {
+			return nil
+		}
+		seconds := float64(dt) / float64(time.Second)
+		if fn == FnRate {
+			return increase / seconds
+		}
+		return diff / seconds
+	}
+	return nil
+}
+
+type CounterPoint struct {
+	Timestamp int64
+	Value     float64
+}
+
+// ReadCounter evaluates a counter function over the points of one register in [start, end],
+// there is a value for every point but the first.
+//
+// rate is the per second increase and derivative the per second signed difference,
+// increase and non_negative_difference are the increase to the previous point.
+func (e *Engine) ReadCounter(did DeviceId, register int64, start, end int64, fn string, bits int) (chan CounterPoint, error) {
+	if !counters[fn] {
+		return nil, fmt.Errorf("unknown counter function %q", fn)
+	}
+	key, points, err := e.ReadStream(did, start, end)
+	if err != nil {
+		return nil, err
+	}
+	column := -1
+	for i, r := range key {
+		if r == register {
+			column = i
+		}
+	}
+	if column < 0 {
+		for range points {
+		}
+		return nil, fmt.Errorf("register %d of device %d not found", register, did)
+	}
+	out := make(chan CounterPoint, 1000)
+	go func() {
+		defer close(out)
+		c := counter{bits: bits}
+		for p := range points {
+			increase, diff, dt, ok := c.next(p.Timestamp, p.Data[column])
+			if !ok {
+				continue
+			}
+			v, ok := counterValue(fn, increase, diff, dt).(float64)
+			if !ok {
+				continue
+			}
+			out <- CounterPoint{Timestamp: p.Timestamp, Value: v}
+		}
+	}()
+	return out, nil
+}
@@ -15,6 +15,16 @@ type Point struct {
 
 type DeviceId uint32
 
+// StatusSeriesBit marks the device id of the status series the analyzers derive from a device,
+// the ids of real devices are below it. The ids with the highest bit are other series,
+// e.g. the ones of the prometheus package.
+const StatusSeriesBit = 1 << 30
+
+// IsStatusSeries tells whether did is the status series of a device
+func (did DeviceId) IsStatusSeries() bool {
+	return did&(StatusSeriesBit|1<<31) == StatusSeriesBit
+}
+
 const IndexSize = 4 + 8 + 8 + 8 + 8 + 1
 
 type Index struct {
@@ -0,0 +1,183 @@
+package cakedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/peterbourgon/diskv/v3"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DeadLetterPath = "/data/cake-db/data/deadletter"
+
+// DeadLetter is a message the ingest could not turn into points
+type DeadLetter struct {
+	Id       string   `json:"id"`
+	Time     int64    `json:"time"` // ns when it was rejected
+	DeviceId DeviceId `json:"device_id"`
+	Kind     string   `json:"kind"`
+	Reason   string   `json:"reason"`
+	// Position is where the message was read, e.g. the dump file and offset
+	Position json.RawMessage `json:"position,omitempty"`
+	// Offset, CreatedAt and Data are the message as it was read
+	Offset    int64  `json:"offset"`
+	CreatedAt int64  `json:"created_at"` // ms
+	Data      []byte `json:"data"`
+	Attempts  int    `json:"attempts"`
+}
+
+// DeadLetterQuery selects dead letters, zero values select everything
+type DeadLetterQuery struct {
+	DeviceId   DeviceId
+	Kind       string
+	Reason     string // substring of the reason
+	Start, End int64  // rejection time in ns, inclusive, End 0 is no bound
+	Limit      int
+}
+
+func (q DeadLetterQuery) match(l *DeadLetter) bool {
+	return (q.DeviceId == 0 || l.DeviceId == q.DeviceId) &&
+		(q.Kind == "" || l.Kind == q.Kind) &&
+		(q.Reason == "" || strings.Contains(l.Reason, q.Reason)) &&
+		l.Time >= q.Start && (q.End == 0 || l.Time <= q.End)
+}
+
+// deadLetters stores one diskv value per letter, the ids sort by rejection time
+type deadLetters struct {
+	mu    sync.Mutex
+	diskv *diskv.Diskv
+	seq   int64
+}
+
+func newDeadLetters() *deadLetters {
+	return &deadLetters{
+		diskv: diskv.New(diskv.Options{
+			BasePath: DeadLetterPath,
+			// a directory per 1e13 ns, about three hours of rejections
+			Transform: func(s string) []string {
+				if len(s) > 6 {
+					return []string{s[:6]}
+				}
+				return []string{}
+			},
+		}),
+	}
+}
+
+// AddDeadLetter stores l and returns its id, Time is set if it is 0
+func (e *Engine) AddDeadLetter(l DeadLetter) (string, error) {
+	d := e.deadLetters
+	d.mu.Lock()
+	d.seq++
+	seq := d.seq
+	d.mu.Unlock()
+	if l.Time == 0 {
+		l.Time = time.Now().UnixNano()
+	}
+	if l.Id == "" {
+		l.Id = fmt.Sprintf("%019d_%06d", l.Time, seq%1e6)
+	}
+	return l.Id, d.write(&l)
+}
+
+func (d *deadLetters) write(l *DeadLetter) error {
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	// synced, the ingest commits its checkpoint past the message once the letter is written
+	return d.diskv.WriteStream(l.Id, bytes.NewReader(buf), true)
+}
+
+// UpdateDeadLetter replaces the stored letter with the id of l
+func (e *Engine) UpdateDeadLetter(l DeadLetter) error {
+	if !e.deadLetters.diskv.Has(l.Id) {
+		return errors.NotFoundf("dead letter %s", l.Id)
+	}
+	return e.deadLetters.write(&l)
+}
+
+func (e *Engine) DeleteDeadLetter(id string) error {
+	if !e.deadLetters.diskv.Has(id) {
+		return errors.NotFoundf("dead letter %s", id)
+	}
+	return e.deadLetters.diskv.Erase(id)
+}
+
+// DeadLetters returns the letters matching q sorted by rejection time
+func (e *Engine) DeadLetters(q DeadLetterQuery) ([]DeadLetter, error) {
+	var ids []string
+	for id := range e.deadLetters.diskv.Keys(nil) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var letters []DeadLetter
+	for _, id := range ids {
+		buf, err := e.deadLetters.diskv.Read(id)
+		if err != nil {
+			continue
+		}
+		var l DeadLetter
+		err = json.Unmarshal(buf, &l)
+		if err != nil {
+			return nil, errors.Annotatef(err, "dead letter %s", id)
+		}
+		if !q.match(&l) {
+			continue
+		}
+		letters = append(letters, l)
+		if q.Limit > 0 && len(letters) >= q.Limit {
+			break
+		}
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters hands the letters matching q to replay, which returns the reason of a letter it
+// rejects as rejected and the error of writing the points of an accepted one as err.
+// The reason of a rejected letter is updated. The accepted letters are deleted once commit returned,
+// it makes their points durable, e.g. Flush. An err of replay or commit stops the replay and keeps
+// the letters that were not rejected as they are, replayed is 0 then.
+func (e *Engine) ReplayDeadLetters(q DeadLetterQuery, replay func(DeadLetter) (rejected error, err error), commit func() error) (replayed, rejected int, err error) {
+	letters, err := e.DeadLetters(q)
+	if err != nil {
+		return 0, 0, err
+	}
+	var accepted []string
+	for _, l := range letters {
+		reason, err := replay(l)
+		if err != nil {
+			return 0, rejected, errors.Annotatef(err, "replay dead letter %s", l.Id)
+		}
+		if reason == nil {
+			accepted = append(accepted, l.Id)
+			continue
+		}
+		l.Attempts++
+		l.Reason = reason.Error()
+		err = e.UpdateDeadLetter(l)
+		if err != nil {
+			return 0, rejected, err
+		}
+		rejected++
+	}
+	if len(accepted) == 0 {
+		return 0, rejected, nil
+	}
+	err = commit()
+	if err != nil {
+		return 0, rejected, err
+	}
+	for _, id := range accepted {
+		err := e.DeleteDeadLetter(id)
+		if err != nil {
+			return replayed, rejected, err
+		}
+		replayed++
+	}
+	return replayed, rejected, nil
+}
@@ -0,0 +1,379 @@
+package cakedb
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownsampleOptional rewrites shards older than Age into windows of every
+// resolution in Resolutions. The windows are stored as `ShardSize_shardId_created_resolution`
+// files next to the raw files of the shard.
+type DownsampleOptional struct {
+	Age         int64   // nanoseconds since the end of the shard
+	Resolutions []int64 // window sizes in nanoseconds
+	KeepRaw     bool    // keep the raw files after the shard has been downsampled
+}
+
+func WithDownsample(op DownsampleOptional) Option {
+	return func(e *Engine) {
+		e.downsample = &op
+	}
+}
+
+// WindowPoint is the aggregate of all points of a device in [Timestamp, Timestamp+resolution)
+//
+// on disk it is stored as a Point with Data = [min]...[max]...[mean]...[last]...[count]
+type WindowPoint struct {
+	DeviceId
+	Timestamp int64
+	Min       Data
+	Max       Data
+	Mean      Data
+	Last      Data
+	Count     int64
+}
+
+func windowValueCount(valueCount int) int {
+	return valueCount*4 + 1
+}
+
+func windowStart(timestamp, resolution int64) int64 {
+	start := timestamp - timestamp%resolution
+	if timestamp%resolution < 0 {
+		start -= resolution
+	}
+	return start
+}
+
+// getResolution returns the window size of a downsampled file, 0 for raw files
+func getResolution(key string) int64 {
+	split := strings.Split(key, "_")
+	if len(split) < 4 {
+		return 0
+	}
+	resolution, err := strconv.ParseInt(split[3], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return resolution
+}
+
+func getCreated(key string) int64 {
+	split := strings.Split(key, "_")
+	created, err := strconv.ParseInt(split[2], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return created
+}
+
+func newWindowPoint(p *Point, resolution int64) *WindowPoint {
+	return &WindowPoint{
+		DeviceId:  p.DeviceId,
+		Timestamp: windowStart(p.Timestamp, resolution),
+		Min:       append(Data{}, p.Data...),
+		Max:       append(Data{}, p.Data...),
+		Mean:      append(Data{}, p.Data...),
+		Last:      append(Data{}, p.Data...),
+		Count:     1,
+	}
+}
+
+func decodeWindowPoint(p *Point) *WindowPoint {
+	n := (len(p.Data) - 1) / 4
+	return &WindowPoint{
+		DeviceId:  p.DeviceId,
+		Timestamp: p.Timestamp,
+		Min:       p.Data[:n],
+		Max:       p.Data[n : 2*n],
+		Mean:      p.Data[2*n : 3*n],
+		Last:      p.Data[3*n : 4*n],
+		Count:     p.Data[4*n],
+	}
+}
+
+func (w *WindowPoint) encode() *Point {
+	data := make(Data, 0, windowValueCount(len(w.Min)))
+	data = append(data, w.Min...)
+	data = append(data, w.Max...)
+	data = append(data, w.Mean...)
+	data = append(data, w.Last...)
+	data = append(data, w.Count)
+	return &Point{
+		Data:      data,
+		DeviceId:  w.DeviceId,
+		Timestamp: w.Timestamp,
+	}
+}
+
+// add merges o into w, o must not be older than w
+func (w *WindowPoint) add(o *WindowPoint) {
+	for i := 0; i < len(w.Min) && i < len(o.Min); i++ {
+		if o.Min[i] < w.Min[i] {
+			w.Min[i] = o.Min[i]
+		}
+		if o.Max[i] > w.Max[i] {
+			w.Max[i] = o.Max[i]
+		}
+		sum := float64(w.Mean[i])*float64(w.Count) + float64(o.Mean[i])*float64(o.Count)
+		w.Mean[i] = int64(math.Round(sum / float64(w.Count+o.Count)))
+		w.Last[i] = o.Last[i]
+	}
+	w.Count += o.Count
+}
+
+// downsample aggregates points sorted by device and timestamp into windows of resolution
+func downsample(points chan *Point, resolution int64) chan *Point {
+	out := make(chan *Point, 1000)
+	go func() {
+		defer close(out)
+		var w *WindowPoint
+		for p := range points {
+			if w != nil && w.DeviceId == p.DeviceId && w.Timestamp == windowStart(p.Timestamp, resolution) {
+				w.add(newWindowPoint(p, resolution))
+				continue
+			}
+			if w != nil {
+				out <- w.encode()
+			}
+			w = newWindowPoint(p, resolution)
+		}
+		if w != nil {
+			out <- w.encode()
+		}
+	}()
+	return out
+}
+
+type shardFiles struct {
+	raw        []CompactFiles
+	downsample map[int64][]CompactFiles
+}
+
+func newestCreated(files []CompactFiles) int64 {
+	created := int64(math.MinInt64)
+	for _, i := range files {
+		if c := getCreated(i.Key); c > created {
+			created = c
+		}
+	}
+	return created
+}
+
+func (e *Engine) listShards(startId, endId int64) map[int64]*shardFiles {
+	shards := map[int64]*shardFiles{}
+	for key := range e.dataDiskv.Keys(nil) {
+		split := strings.Split(key, "_")
+		shardId, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil || shardId < startId || shardId > endId {
+			continue
+		}
+		path := GetValuePath(key)
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		s, ok := shards[shardId]
+		if !ok {
+			s = &shardFiles{downsample: map[int64][]CompactFiles{}}
+			shards[shardId] = s
+		}
+		file := CompactFiles{
+			Key:  key,
+			Path: path,
+			Size: stat.Size(),
+		}
+		if resolution := getResolution(key); resolution > 0 {
+			s.downsample[resolution] = append(s.downsample[resolution], file)
+		} else {
+			s.raw = append(s.raw, file)
+		}
+	}
+	return shards
+}
+
+// downsampleShards writes the windows of every shard older than Age.
+//
+// With KeepRaw the windows are rebuilt from all raw files whenever a raw file is newer than them,
+// otherwise the raw files are erased and late data is downsampled into additional window files.
+func (e *Engine) downsampleShards() {
+	op := e.downsample
+	if op == nil || len(op.Resolutions) == 0 {
+		return
+	}
+	endId := (time.Now().UnixNano() - op.Age) / ShardSize
+	for shardId, shard := range e.listShards(math.MinInt64, endId-1) {
+		if len(shard.raw) == 0 || e.isBackfilling(shardId) {
+			continue
+		}
+		newest := newestCreated(shard.raw)
+		for i, resolution := range op.Resolutions {
+			old := shard.downsample[resolution]
+			if op.KeepRaw && len(old) > 0 && newestCreated(old) >= newest {
+				continue
+			}
+			fmt.Println(time.Now(), "start downsample", shardId, resolution)
+			err := e.merge(shardId, shard.raw, &DumpOptional{
+				Zip:        true,
+				Resolution: resolution,
+				KeepRaw:    op.KeepRaw || i != len(op.Resolutions)-1,
+				Created:    newest,
+			})
+			if err != nil {
+				// the raw files are kept, the coarser resolutions are downsampled next time
+				fmt.Println(time.Now(), "downsample", shardId, resolution, err)
+				break
+			}
+			fmt.Println(time.Now(), "end downsample", shardId, resolution)
+			if op.KeepRaw {
+				for _, f := range old {
+					e.dataDiskv.Erase(f.Key)
+				}
+			}
+		}
+	}
+}
+
+// resolutionFor returns the largest configured resolution that evenly divides step
+func (e *Engine) resolutionFor(step int64) int64 {
+	var resolution int64
+	if e.downsample == nil {
+		return 0
+	}
+	for _, r := range e.downsample.Resolutions {
+		if r <= step && step%r == 0 && r > resolution {
+			resolution = r
+		}
+	}
+	return resolution
+}
+
+// shardResolution returns the resolution a shard is read with for step. Without a resolution that
+// divides step, a shard whose raw files are gone is read with the coarsest resolution it has that
+// is not larger than step, or its finest one; such windows are put into the step they start in.
+func (e *Engine) shardResolution(shard *shardFiles, step int64) int64 {
+	resolution := e.resolutionFor(step)
+	if resolution > 0 || len(shard.raw) > 0 || len(shard.downsample) == 0 {
+		return resolution
+	}
+	var coarsest, finest int64
+	for r := range shard.downsample {
+		if r <= step && r > coarsest {
+			coarsest = r
+		}
+		if finest == 0 || r < finest {
+			finest = r
+		}
+	}
+	if coarsest > 0 {
+		return coarsest
+	}
+	return finest
+}
+
+// ReadWindow returns the points of did in [start, end] aggregated into windows of step,
+// reading downsampled files instead of the raw data whenever their resolution fits the step,
+// see shardResolution for the steps no resolution fits.
+func (e *Engine) ReadWindow(did DeviceId, start, end, step int64) (RetKey Data, value []WindowPoint, err error) {
+	if step <= 0 {
+		return nil, nil, fmt.Errorf("invalid step %d", step)
+	}
+	RetKey, err = e.ReadKey(did)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// points not dumped yet are newer than every file
+	memory := map[int64]*Point{}
+	for _, p := range e.memoryPoints(did, start, end) {
+		memory[p.Timestamp] = p
+	}
+
+	var windows []*WindowPoint
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, shard := range e.listShards(start/ShardSize, end/ShardSize) {
+		resolution := e.shardResolution(shard, step)
+		raw := shard.raw
+		downsampled := shard.downsample[resolution]
+		if resolution > 0 && len(downsampled) > 0 {
+			// a window file is named after the newest raw file it covers, the raw files up to it
+			// are in the windows even while downsampleShards has not erased them yet
+			covered := newestCreated(downsampled)
+			raw = nil
+			for _, file := range shard.raw {
+				if getCreated(file.Key) > covered {
+					raw = append(raw, file)
+				}
+			}
+			// windows kept next to the raw files are rebuilt from all of them once they are stale
+			if e.downsample != nil && e.downsample.KeepRaw && len(raw) > 0 {
+				raw, downsampled = shard.raw, nil
+			}
+		}
+
+		wg.Add(1)
+		go func(raw []CompactFiles) {
+			defer wg.Done()
+			v := map[int64]*MergePoint{}
+			for _, file := range raw {
+				for msg := range e.read(file, len(RetKey), did, start, end) {
+					if v[msg.Timestamp] == nil || v[msg.Timestamp].Created < msg.Created {
+						v[msg.Timestamp] = msg
+					}
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, msg := range v {
+				if _, ok := memory[msg.Timestamp]; ok {
+					continue
+				}
+				if msg.Timestamp >= start && msg.Timestamp <= end {
+					windows = append(windows, newWindowPoint(msg.Point, 1))
+				}
+			}
+		}(raw)
+
+		for _, file := range downsampled {
+			wg.Add(1)
+			go func(file CompactFiles) {
+				defer wg.Done()
+				for msg := range e.read(file, windowValueCount(len(RetKey)), did, start, end) {
+					w := decodeWindowPoint(msg.Point)
+					resolution := getResolution(file.Key)
+					if w.Timestamp+resolution <= start || w.Timestamp > end {
+						continue
+					}
+					mu.Lock()
+					windows = append(windows, w)
+					mu.Unlock()
+				}
+			}(file)
+		}
+	}
+	wg.Wait()
+	for _, p := range memory {
+		windows = append(windows, newWindowPoint(p, 1))
+	}
+
+	sort.SliceStable(windows, func(i, j int) bool {
+		return windows[i].Timestamp < windows[j].Timestamp
+	})
+	for _, w := range windows {
+		timestamp := windowStart(w.Timestamp, step)
+		if len(value) > 0 && value[len(value)-1].Timestamp == timestamp {
+			value[len(value)-1].add(w)
+			continue
+		}
+		w.Timestamp = timestamp
+		value = append(value, *w)
+	}
+	return RetKey, value, nil
+}
@@ -2,6 +2,7 @@ package cakedb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/go-mmap/mmap"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,9 +26,30 @@ type Engine struct {
 	shardGroup          sync.Map
 	mu                  sync.RWMutex
 	list                Skiplist[*Point, struct{}]
+	dumping             []Skiplist[*Point, struct{}] // swapped memtables until their files are imported
+	failed              []Skiplist[*Point, struct{}] // swapped memtables whose dump failed, retried by Flush
 	keyDiskv, dataDiskv *diskv.Diskv
+	downsample          *DownsampleOptional
+	filters             []CompactionFilter
+	rollups             []*rollup
+	last                *lastCache
+	attributes          *attributeStore
+	catalog             *Catalog
+	deadLetters         *deadLetters
+	flushes             chan chan error
+	dumpWg              sync.WaitGroup
+	createdMu           sync.Mutex
+	created             int64
+	importMu            sync.Mutex
+	// acceptance window of Write in ns, see WithAcceptWindow
+	acceptPast, acceptFuture int64
+	quarantine               *quarantine
+	backfillMu               sync.Mutex
+	backfilling              map[int64]int
 }
 
+type Option func(e *Engine)
+
 //const KeyPath = "/home/wyatt/code/tmp/data/Key"
 //const ValuePath = "/home/wyatt/code/tmp/data/value"
 //const TmpPath = "/home/wyatt/code/tmp/data/tmp"
@@ -45,7 +68,7 @@ func GetValuePath(s string) string {
 	return str
 }
 
-func New() *Engine {
+func New(opts ...Option) *Engine {
 	flatTransform := func(s string) []string {
 		if len(s) > 2 {
 			return []string{s[:2], s}
@@ -70,83 +93,277 @@ func New() *Engine {
 	os.MkdirAll(KeyPath, 0777)
 	os.MkdirAll(ValuePath, 0777)
 	os.MkdirAll(TmpPath, 0777)
-	return &Engine{
-		points:    make(chan *Point, 1e6),
-		list:      NewSkipListMap[*Point, struct{}](&DataCompare{}),
-		keyDiskv:  keyDiskv,
-		dataDiskv: dataDiskv,
+	e := &Engine{
+		points:      make(chan *Point, 1e6),
+		list:        NewSkipListMap[*Point, struct{}](&DataCompare{}),
+		keyDiskv:    keyDiskv,
+		dataDiskv:   dataDiskv,
+		last:        newLastCache(),
+		attributes:  newAttributeStore(),
+		deadLetters: newDeadLetters(),
+		flushes:     make(chan chan error),
+		quarantine:  newQuarantine(),
+		backfilling: map[int64]int{},
+	}
+	for _, opt := range opts {
+		opt(e)
 	}
+	return e
 }
 
 var once = sync.Once{}
 
 func (e *Engine) Init() {
 	once.Do(func() {
+		e.rebuildLast()
 		go e.handleShardGroup()
 		go e.compact()
+		for _, r := range e.rollups {
+			go e.maintainRollup(r)
+		}
 	})
 }
 
+// Write adds a point to the memtable. A point outside the acceptance window is stored in the
+// quarantine instead and Write returns nil once it is stored, see Quarantined and ReleaseQuarantine.
 func (e *Engine) Write(key Data, point *Point) error {
-	// write Key
-	did := strconv.Itoa(int(point.DeviceId))
+	if reason := e.checkWindow(point.Timestamp); reason != "" {
+		return e.quarantine.add(key, point, reason)
+	}
+	err := e.writeKey(point.DeviceId, key)
+	if err != nil {
+		return err
+	}
+
+	// write data
+	e.last.update(point)
+	e.points <- point
+	return nil
+}
+
+// writeKey stores the registers of a device the first time it is written
+func (e *Engine) writeKey(deviceId DeviceId, key Data) error {
+	did := strconv.Itoa(int(deviceId))
 	if !e.keyDiskv.Has(did) {
 		buffer := bytes.NewBuffer([]byte{})
 		binary.Write(buffer, binary.BigEndian, key)
-		err := e.keyDiskv.Write(did, buffer.Bytes())
+		return e.keyDiskv.Write(did, buffer.Bytes())
+	}
+	return nil
+}
+
+func (e *Engine) insert(point *Point) {
+	e.mu.Lock()
+	e.list.Insert(point, struct{}{})
+	e.mu.Unlock()
+	for _, r := range e.rollups {
+		r.touch(point)
+	}
+}
+
+// swapList replaces the memtable with an empty one and returns the old one,
+// it stays readable until dumped is called with it
+func (e *Engine) swapList() Skiplist[*Point, struct{}] {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := e.list
+	e.list = NewSkipListMap[*Point, struct{}](&DataCompare{})
+	e.dumping = append(e.dumping, list)
+	return list
+}
+
+// startDump makes a memtable readable until dumped is called with it
+func (e *Engine) startDump(list Skiplist[*Point, struct{}]) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dumping = append(e.dumping, list)
+}
+
+// dumped removes a memtable whose files are imported from the readable ones
+func (e *Engine) dumped(list Skiplist[*Point, struct{}]) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, l := range e.dumping {
+		if l == list {
+			e.dumping = append(e.dumping[:i:i], e.dumping[i+1:]...)
+			return
+		}
+	}
+}
+
+// inMemory tells if a memtable has a point of did in [start, end]
+func (e *Engine) inMemory(did DeviceId, start, end int64) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, list := range append(append([]Skiplist[*Point, struct{}]{}, e.dumping...), e.list) {
+		iterator, err := list.IteratorBetween(&Point{DeviceId: did, Timestamp: start}, &Point{DeviceId: did, Timestamp: end})
 		if err != nil {
-			panic(err)
+			continue
+		}
+		k, _, err := iterator.Next()
+		if err == nil && k.DeviceId == did && k.Timestamp >= start && k.Timestamp <= end {
+			return true
 		}
 	}
+	return false
+}
 
-	// write data
-	e.points <- point
-	return nil
+// memoryPoints returns the points of did in [start, end] that may not be in the files yet sorted
+// by timestamp, a memtable wins over the ones swapped before it
+func (e *Engine) memoryPoints(did DeviceId, start, end int64) []*Point {
+	v := map[int64]*Point{}
+	e.mu.RLock()
+	for _, list := range append(append([]Skiplist[*Point, struct{}]{}, e.dumping...), e.list) {
+		iterator, err := list.IteratorBetween(&Point{DeviceId: did, Timestamp: start}, &Point{DeviceId: did, Timestamp: end})
+		for err == nil {
+			var k *Point
+			k, _, err = iterator.Next()
+			if err == nil && k.DeviceId == did && k.Timestamp >= start && k.Timestamp <= end {
+				v[k.Timestamp] = k
+			}
+		}
+	}
+	e.mu.RUnlock()
+	points := make([]*Point, 0, len(v))
+	for _, p := range v {
+		points = append(points, p)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+	return points
 }
 
 func (e *Engine) handleShardGroup() {
 	size := 0
-	for point := range e.points {
+	for {
+		select {
+		case point, ok := <-e.points:
+			if !ok {
+				return
+			}
+			e.insert(point)
+			size += len(point.Data)*8 + 16
+			if size > 100*1e6 {
+				size = 0
+				e.dumpWg.Add(1)
+				go func(list Skiplist[*Point, struct{}]) {
+					defer e.dumpWg.Done()
+					err := e.dumpSwapped(list)
+					if err != nil {
+						fmt.Println(time.Now(), "dump", err)
+					}
+				}(e.swapList())
+			}
+		case done := <-e.flushes:
+			// the points written before Flush are already buffered
+			for len(e.points) > 0 {
+				point := <-e.points
+				e.insert(point)
+			}
+			size = 0
+			list := e.swapList()
+			e.dumpWg.Wait()
+			e.mu.Lock()
+			lists := append(e.failed, list)
+			e.failed = nil
+			e.mu.Unlock()
+			var err error
+			for _, list := range lists {
+				if dumpErr := e.dumpSwapped(list); dumpErr != nil && err == nil {
+					err = dumpErr
+				}
+			}
+			done <- err
+		}
+	}
+}
+
+// dumpSwapped dumps a swapped memtable, if that fails it stays readable and the next Flush retries it
+func (e *Engine) dumpSwapped(list Skiplist[*Point, struct{}]) error {
+	err := e.saveRollups()
+	if err == nil {
+		err = e.dumpList(list)
+	}
+	if err != nil {
 		e.mu.Lock()
-		e.list.Insert(point, struct{}{})
+		e.failed = append(e.failed, list)
 		e.mu.Unlock()
-		size += len(point.Data)*8 + 16
-		if size > 100*1e6 {
-			size = 0
-			go func(list Skiplist[*Point, struct{}]) {
-				c := map[int64]chan *Point{}
-				iterator, err := list.Iterator()
+		return err
+	}
+	e.dumped(list)
+	return nil
+}
+
+// saveRollups stores the windows the points of the memtables touched, see rollup.save
+func (e *Engine) saveRollups() error {
+	for _, r := range e.rollups {
+		err := r.save()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns the number of written points that are not in the memtable yet,
+// Write blocks once the buffer of 1e6 points is full
+func (e *Engine) Pending() int {
+	return len(e.points)
+}
+
+// Flush writes every point accepted by Write before it to files, it needs the goroutines of Init.
+// On an error the points stay readable in memory and the next Flush writes them again.
+func (e *Engine) Flush() error {
+	done := make(chan error)
+	e.flushes <- done
+	return <-done
+}
+
+// dumpList writes a memtable into one file per shard, it returns the first error of the shards
+func (e *Engine) dumpList(list Skiplist[*Point, struct{}]) error {
+	if list.Size() == 0 {
+		return nil
+	}
+	iterator, err := list.Iterator()
+	if err != nil {
+		return err
+	}
+	c := map[int64]chan *Point{}
+	errs := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	for {
+		k, _, err := iterator.Next()
+		if err != nil {
+			break
+		}
+		shardId := k.Timestamp / ShardSize
+		_, ok := c[shardId]
+		if !ok {
+			c[shardId] = make(chan *Point, 1e6)
+			wg.Add(1)
+			go func(shardId int64, points chan *Point) {
+				defer wg.Done()
+				err := e.dump(shardId, points, nil)
 				if err != nil {
-					panic(err)
-				}
-				wg := sync.WaitGroup{}
-				for {
-					k, _, err := iterator.Next()
-					if err != nil {
-						break
+					select {
+					case errs <- err:
+					default:
 					}
-					shardId := k.Timestamp / ShardSize
-					_, ok := c[shardId]
-					if !ok {
-						c[shardId] = make(chan *Point, 1e6)
-						wg.Add(1)
-						go func() {
-							e.dump(shardId, c[shardId], nil)
-							wg.Done()
-						}()
-					}
-					c[shardId] <- k
-				}
-				for _, c := range c {
-					close(c)
 				}
-				wg.Wait()
-			}(e.list)
-			// clear
-			e.mu.Lock()
-			e.list = NewSkipListMap[*Point, struct{}](&DataCompare{})
-			e.mu.Unlock()
+			}(shardId, c[shardId])
 		}
+		c[shardId] <- k
+	}
+	for _, c := range c {
+		close(c)
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
 	}
 }
 
@@ -189,90 +406,103 @@ func getWriter(op *DumpOptional) (io.Writer, *bytes.Buffer) {
 	return writer, buffer
 }
 
-func (e *Engine) dump(shardId int64, points chan *Point, op *DumpOptional) {
+// nextCreated returns a unique, increasing creation time for file names
+func (e *Engine) nextCreated() int64 {
+	e.createdMu.Lock()
+	defer e.createdMu.Unlock()
+	created := time.Now().UnixMilli()
+	if created <= e.created {
+		created = e.created + 1
+	}
+	e.created = created
+	return created
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err1 := dir.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// dump writes points into a file and imports it, on an error the rest of points is drained
+// and no file is imported
+func (e *Engine) dump(shardId int64, points chan *Point, op *DumpOptional) (err error) {
+	defer func() {
+		for range points {
+		}
+	}()
 	file, err := os.CreateTemp(TmpPath, fmt.Sprintf("%d-%d-", shardId, time.Now().Unix()))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer func() {
-		if err := recover(); err != nil {
+		if err != nil {
 			file.Close()
 			os.Remove(file.Name())
-			return
-		}
-		file.Close()
-		name := fmt.Sprintf("%d_%d_%d", ShardSize, shardId, time.Now().UnixMilli())
-
-		err := e.dataDiskv.Import(file.Name(), name, true)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Println("import ok...", name)
-		if op != nil && op.Zip {
-			fmt.Println("zip ok ...", name)
 		}
-
 	}()
 	lastDid := -1
 	start := int64(math.MaxInt64)
 	end := int64(math.MinInt64)
 	indexBuf := bytes.NewBuffer([]byte{})
 	var offset uint64
-	var writer io.Writer
-	var reader *bytes.Buffer
-	var n int64
 	var flag byte
 	if op != nil && op.Zip {
 		flag = 1
 	}
+	writer, reader := getWriter(op)
 	realSize := 0
-	for k := range points {
 
-		if int(k.DeviceId) != lastDid {
-			if lastDid != -1 {
-				closer, ok := writer.(io.Closer)
-				if ok {
-					closer.Close()
-				}
-				n, err = io.Copy(file, reader)
-				//if op != nil && op.Zip {
-				//	fmt.Println("unzip", realSize, "zip:", n)
-				//}
-				if err != nil {
-					panic(err)
-				}
-				var index = Index{
-					DeviceId:  DeviceId(lastDid),
-					StartTime: start,
-					EndTime:   end,
-					Offset:    int64(offset),
-					Length:    int64(realSize),
-					Flag:      flag,
-				}
-				//fmt.Println("offset", int64(offset))
-				index.Write(indexBuf)
-				start = math.MaxInt64
-				end = math.MinInt64
-				offset += uint64(n)
+	writeIndex := func() error {
+		closer, ok := writer.(io.Closer)
+		if ok {
+			err := closer.Close()
+			if err != nil {
+				return err
 			}
-			realSize = 0
-			writer, reader = getWriter(op)
 		}
+		n, err := io.Copy(file, reader)
+		if err != nil {
+			return err
+		}
+		var index = Index{
+			DeviceId:  DeviceId(lastDid),
+			StartTime: start,
+			EndTime:   end,
+			Offset:    int64(offset),
+			Length:    int64(realSize),
+			Flag:      flag,
+		}
+		index.Write(indexBuf)
+		start = math.MaxInt64
+		end = math.MinInt64
+		offset += uint64(n)
+		realSize = 0
+		writer, reader = getWriter(op)
+		return nil
+	}
 
+	writeData := func(k *Point) error {
 		p := bytes.NewBuffer([]byte{})
-		err = binary.Write(p, binary.BigEndian, k.Timestamp)
+		err := binary.Write(p, binary.BigEndian, k.Timestamp)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		err = binary.Write(p, binary.BigEndian, k.Data)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		realSize += p.Len()
-		_, err := writer.Write(p.Bytes())
+		_, err = writer.Write(p.Bytes())
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		if start > k.Timestamp {
@@ -281,48 +511,95 @@ func (e *Engine) dump(shardId int64, points chan *Point, op *DumpOptional) {
 		if end < k.Timestamp {
 			end = k.Timestamp
 		}
-
-		lastDid = int(k.DeviceId)
+		return nil
 	}
 
-	if lastDid != -1 {
-		closer, ok := writer.(io.Closer)
-		if ok {
-			closer.Close()
+	for k := range points {
+		if int(k.DeviceId) != lastDid && lastDid != -1 {
+			err = writeIndex()
+			if err != nil {
+				return err
+			}
 		}
-		n, err = io.Copy(file, reader)
+		err = writeData(k)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		var index = Index{
-			DeviceId:  DeviceId(lastDid),
-			StartTime: start,
-			EndTime:   end,
-			Offset:    int64(offset),
-			Length:    int64(realSize),
-			Flag:      flag,
+		lastDid = int(k.DeviceId)
+	}
+	if lastDid != -1 {
+		err = writeIndex()
+		if err != nil {
+			return err
 		}
-		index.Write(indexBuf)
 	}
 	_, err = file.Write(indexBuf.Bytes())
 	if err != nil {
-		panic(err)
+		return err
 	}
 	err = binary.Write(file, binary.BigEndian, int64(len(indexBuf.Bytes())))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	fmt.Println("write ok...")
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	created := int64(0)
+	if op != nil && op.Created != 0 {
+		created = op.Created
+	} else {
+		created = e.nextCreated()
+	}
+	suffix := ""
+	if op != nil && op.Resolution > 0 {
+		suffix = fmt.Sprintf("_%d", op.Resolution)
+	}
+	// a file of the same shard created in the same ms, before a restart or by a merge, is not replaced
+	e.importMu.Lock()
+	name := fmt.Sprintf("%d_%d_%d%s", ShardSize, shardId, created, suffix)
+	for e.dataDiskv.Has(name) {
+		created++
+		name = fmt.Sprintf("%d_%d_%d%s", ShardSize, shardId, created, suffix)
+	}
+	err = e.dataDiskv.Import(file.Name(), name, true)
+	e.importMu.Unlock()
+	if err != nil {
+		return err
+	}
+	fmt.Println("import ok...", name)
+	if op != nil && op.Zip {
+		fmt.Println("zip ok ...", name)
+	}
+	// the directories of the shard may have been created by the import
+	shardDir := filepath.Dir(GetValuePath(name))
+	for _, dir := range []string{shardDir, filepath.Dir(shardDir), ValuePath} {
+		err := syncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (e *Engine) Dump(shardId int64, list Skiplist[*Point, struct{}]) {
+func (e *Engine) Dump(shardId int64, list Skiplist[*Point, struct{}]) error {
 	fmt.Println("dump...", shardId, list.Size())
 	iterator, err := list.Iterator()
 	if err != nil {
-		return
+		return err
 	}
 	points := make(chan *Point, 1024)
-	go e.dump(shardId, points, nil)
+	dumped := make(chan error, 1)
+	go func() {
+		dumped <- e.dump(shardId, points, nil)
+	}()
 	for {
 		k, _, err := iterator.Next()
 		if err != nil {
@@ -332,6 +609,7 @@ func (e *Engine) Dump(shardId int64, list Skiplist[*Point, struct{}]) {
 	}
 	close(points)
 	fmt.Println("close", shardId)
+	return <-dumped
 }
 
 // data format
@@ -340,15 +618,39 @@ func (e *Engine) Dump(shardId int64, list Skiplist[*Point, struct{}]) {
 
 // [Index] = [device][start][end][offset][flag]
 
-func (e *Engine) Read(did DeviceId, start, end int64) (RetKey Data, value []Point, err error) {
-
+// ReadKey returns the registers of a device
+func (e *Engine) ReadKey(did DeviceId) (Data, error) {
 	keyBuf, err := e.keyDiskv.Read(strconv.Itoa(int(did)))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	key := make(Data, len(keyBuf)/8)
+	err = binary.Read(bytes.NewReader(keyBuf), binary.BigEndian, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Devices returns every device that has a key, sorted by id
+func (e *Engine) Devices() []DeviceId {
+	var ids []DeviceId
+	for key := range e.keyDiskv.Keys(nil) {
+		id, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, DeviceId(id))
 	}
-	keyReader := bytes.NewReader(keyBuf)
-	RetKey = make(Data, len(keyBuf)/8)
-	err = binary.Read(keyReader, binary.BigEndian, RetKey)
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func (e *Engine) Read(did DeviceId, start, end int64) (RetKey Data, value []Point, err error) {
+
+	RetKey, err = e.ReadKey(did)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -360,6 +662,9 @@ func (e *Engine) Read(did DeviceId, start, end int64) (RetKey Data, value []Poin
 	wp := sync.WaitGroup{}
 	for key := range keys {
 		fmt.Println("RetKey:", key)
+		if getResolution(key) > 0 {
+			continue
+		}
 		path := GetValuePath(key)
 		split := strings.Split(key, "_")
 		atoi, err := strconv.Atoi(split[1])
@@ -372,7 +677,7 @@ func (e *Engine) Read(did DeviceId, start, end int64) (RetKey Data, value []Poin
 		}
 		fmt.Println("read:", key, "path:", path)
 		wp.Add(1)
-		go func() {
+		go func(key string) {
 			defer wp.Done()
 			stream, err := e.dataDiskv.ReadStream(key, true)
 			if err != nil {
@@ -388,7 +693,7 @@ func (e *Engine) Read(did DeviceId, start, end int64) (RetKey Data, value []Poin
 				Key:  key,
 				Path: path,
 				Size: stat.Size(),
-			}, RetKey, did, start, end)
+			}, len(RetKey), did, start, end)
 
 			for msg := range points {
 				mu.Lock()
@@ -397,7 +702,7 @@ func (e *Engine) Read(did DeviceId, start, end int64) (RetKey Data, value []Poin
 				}
 				mu.Unlock()
 			}
-		}()
+		}(key)
 	}
 	wp.Wait()
 
@@ -411,7 +716,93 @@ func (e *Engine) Read(did DeviceId, start, end int64) (RetKey Data, value []Poin
 	return RetKey, value, nil
 }
 
-func (e *Engine) read(files CompactFiles, key Data, did DeviceId, start, end int64) chan *MergePoint {
+// ReadStream returns the points of did in [start, end] in time order without buffering the whole range.
+// Shards are read one after another, the newest version of a timestamp wins like in Read.
+func (e *Engine) ReadStream(did DeviceId, start, end int64) (RetKey Data, value chan *Point, err error) {
+	return e.ReadStreamContext(context.Background(), did, start, end)
+}
+
+// ReadStreamContext is ReadStream that stops reading the files once ctx is done,
+// value is closed soon after without the rest of the points
+func (e *Engine) ReadStreamContext(ctx context.Context, did DeviceId, start, end int64) (RetKey Data, value chan *Point, err error) {
+	RetKey, err = e.ReadKey(did)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// memory is read before the files, a memtable imported in the meantime is read twice
+	// instead of not at all
+	points := e.memoryPoints(did, start, end)
+
+	shards := e.listShards(start/ShardSize, end/ShardSize)
+	shardIds := make([]int64, 0, len(shards))
+	for shardId, shard := range shards {
+		if len(shard.raw) > 0 {
+			shardIds = append(shardIds, shardId)
+		}
+	}
+	sort.Slice(shardIds, func(i, j int) bool {
+		return shardIds[i] < shardIds[j]
+	})
+
+	files := make(chan *MergePoint, 1000)
+	go func() {
+		defer close(files)
+		for _, shardId := range shardIds {
+			var inputs []chan *MergePoint
+			for _, file := range shards[shardId].raw {
+				if c := e.readContext(ctx, file, len(RetKey), did, start, end); c != nil {
+					inputs = append(inputs, c)
+				}
+			}
+			if len(inputs) == 0 {
+				continue
+			}
+			for p := range MergeN(inputs...) {
+				files <- p
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	// points not dumped yet are newer than every file
+	memory := make(chan *MergePoint, 1000)
+	go func() {
+		defer close(memory)
+		for _, p := range points {
+			memory <- &MergePoint{Point: p, Created: math.MaxInt64}
+		}
+	}()
+
+	value = make(chan *Point, 1000)
+	go func() {
+		defer close(value)
+		var last *MergePoint
+		for p := range MergeN(files, memory) {
+			// the inputs are drained so that their goroutines end
+			if ctx.Err() != nil || p.DeviceId != did || p.Timestamp < start || p.Timestamp > end {
+				continue
+			}
+			if last != nil && last.Timestamp != p.Timestamp {
+				value <- last.Point
+			}
+			last = p
+		}
+		if last != nil && ctx.Err() == nil {
+			value <- last.Point
+		}
+	}()
+	return RetKey, value, nil
+}
+
+func (e *Engine) read(files CompactFiles, valueCount int, did DeviceId, start, end int64) chan *MergePoint {
+	return e.readContext(context.Background(), files, valueCount, did, start, end)
+}
+
+// readContext reads the points of did in a file, it stops once ctx is done
+func (e *Engine) readContext(ctx context.Context, files CompactFiles, valueCount int, did DeviceId, start, end int64) chan *MergePoint {
 	indexChan := make(chan *MergePoint, 1000)
 
 	meta := strings.Split(files.Key, "_")
@@ -427,6 +818,7 @@ func (e *Engine) read(files CompactFiles, key Data, did DeviceId, start, end int
 		if err != nil {
 			panic(err)
 		}
+		defer file.Close()
 
 		// read Index length
 		indexLengthBuf := make([]byte, 8)
@@ -452,6 +844,14 @@ func (e *Engine) read(files CompactFiles, key Data, did DeviceId, start, end int
 			return index.DeviceId >= did
 		})
 
+		if search >= int(n) {
+			return
+		}
+		_, err = file.ReadAt(indexBuf, int64(file.Len())-8-indexLength+int64(search*IndexSize))
+		if err != nil {
+			panic(err)
+		}
+		index.Read(bytes.NewReader(indexBuf))
 		if index.DeviceId != did {
 			return
 		}
@@ -471,7 +871,6 @@ func (e *Engine) read(files CompactFiles, key Data, did DeviceId, start, end int
 			r = nextIndex.Offset
 		}
 
-		valueCount := len(key)
 		pointSize := int64(8 + valueCount*8)
 
 		buf := make([]byte, r-l)
@@ -505,7 +904,11 @@ func (e *Engine) read(files CompactFiles, key Data, did DeviceId, start, end int
 				Created: int64(created),
 			}
 			//fmt.Println(v.DeviceId, v.Timestamp, v.Data)
-			indexChan <- v
+			select {
+			case indexChan <- v:
+			case <-ctx.Done():
+				return
+			}
 		}
 
 	}()
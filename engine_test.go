@@ -3,13 +3,17 @@ package cakedb
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/araddon/dateparse"
 	"github.com/dlclark/regexp2"
+	"github.com/juju/errors"
 	"github.com/spf13/afero"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -245,3 +249,1191 @@ func TestExist(t *testing.T) {
 		t.Errorf("file \"%s\" does not exist.\n", name)
 	}
 }
+
+func TestDownsample(t *testing.T) {
+	points := make(chan *Point, 100)
+	for i := 0; i < 10; i++ {
+		points <- &Point{
+			Data:      []int64{int64(i), int64(-i)},
+			DeviceId:  1,
+			Timestamp: int64(i),
+		}
+	}
+	close(points)
+
+	var windows []*WindowPoint
+	for p := range downsample(points, 5) {
+		windows = append(windows, decodeWindowPoint(p))
+	}
+	if len(windows) != 2 {
+		t.Fatalf("windows: %d", len(windows))
+	}
+	w := windows[1]
+	if w.Timestamp != 5 || w.Count != 5 || w.Min[0] != 5 || w.Max[0] != 9 || w.Mean[0] != 7 || w.Last[0] != 9 || w.Min[1] != -9 {
+		t.Fatalf("window: %#v", w)
+	}
+
+	windows[0].add(windows[1])
+	if windows[0].Count != 10 || windows[0].Mean[0] != 5 || windows[0].Last[1] != -9 {
+		t.Fatalf("merged window: %#v", windows[0])
+	}
+}
+
+func TestEngine_ReadWindow(t *testing.T) {
+	engine := New(WithDownsample(DownsampleOptional{Resolutions: []int64{5}}))
+	did := DeviceId(900030)
+	shardId := int64(5000)
+	base := shardId * ShardSize
+	engine.writeKey(did, Data{0})
+	list := NewSkipListMap[*Point, struct{}](&DataCompare{})
+	for i := int64(0); i < 10; i++ {
+		list.Insert(&Point{Data: Data{i}, DeviceId: did, Timestamp: base + i}, struct{}{})
+	}
+	engine.dumpList(list)
+	raw := engine.listShards(shardId, shardId)[shardId].raw
+	defer func() {
+		for _, shard := range engine.listShards(shardId, shardId) {
+			for _, file := range shard.raw {
+				engine.dataDiskv.Erase(file.Key)
+			}
+			for _, files := range shard.downsample {
+				for _, file := range files {
+					engine.dataDiskv.Erase(file.Key)
+				}
+			}
+		}
+	}()
+
+	// the windows are written but the raw files are not erased yet
+	engine.merge(shardId, raw, &DumpOptional{Resolution: 5, KeepRaw: true, Created: newestCreated(raw)})
+	_, windows, err := engine.ReadWindow(did, base, base+9, 10)
+	if err != nil || len(windows) != 1 || windows[0].Count != 10 {
+		t.Fatalf("step 10: %v %v", windows, err)
+	}
+
+	for _, file := range raw {
+		engine.dataDiskv.Erase(file.Key)
+	}
+	for step, counts := range map[int64][]int64{7: {10}, 3: {5, 5}} {
+		_, windows, err := engine.ReadWindow(did, base, base+9, step)
+		if err != nil || len(windows) != len(counts) {
+			t.Fatalf("step %d: %v %v", step, windows, err)
+		}
+		for i, w := range windows {
+			if w.Count != counts[i] {
+				t.Fatalf("step %d: %v", step, windows)
+			}
+		}
+	}
+
+	// without the raw files the last point comes from the newest window
+	if p := engine.lastFromFiles(did); p == nil || p.Data[0] != 9 || p.Timestamp != base+5 {
+		t.Fatalf("last: %v", p)
+	}
+}
+
+func TestEngine_DownsampleNewest(t *testing.T) {
+	engine := New(WithDownsample(DownsampleOptional{Resolutions: []int64{5}}))
+	did := DeviceId(900026)
+	shardId := int64(5026)
+	base := shardId * ShardSize
+	engine.writeKey(did, Data{0})
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	defer os.RemoveAll(filepath.Join(ValuePath, strconv.FormatInt(ShardSize, 10), strconv.FormatInt(shardId, 10)))
+	// the second file overwrites the point at base
+	for created, values := range map[int64][]int64{1000: {1, 1}, 2000: {9}} {
+		points := make(chan *Point, 2)
+		for i, v := range values {
+			points <- &Point{Data: Data{v}, DeviceId: did, Timestamp: base + int64(i)}
+		}
+		close(points)
+		err := engine.dump(shardId, points, &DumpOptional{Created: created})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the raw files are erased, the windows are all that is left of the overwritten point
+	raw := engine.listShards(shardId, shardId)[shardId].raw
+	err := engine.merge(shardId, raw, &DumpOptional{Resolution: 5, Created: newestCreated(raw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, windows, err := engine.ReadWindow(did, base, base+4, 5)
+	if err != nil || len(windows) != 1 {
+		t.Fatalf("windows: %v %v", windows, err)
+	}
+	if w := windows[0]; w.Count != 2 || w.Min[0] != 1 || w.Max[0] != 9 || w.Mean[0] != 5 || w.Last[0] != 1 {
+		t.Fatalf("window: %#v", w)
+	}
+}
+
+func TestCompactionFilter(t *testing.T) {
+	engine := &Engine{}
+	WithCompactionFilter(CompactionFilterFunc(func(shardId int64, key Data, point *MergePoint) FilterDecision {
+		if point.Data[0] < 0 {
+			return FilterDrop
+		}
+		return FilterKeep
+	}), CompactionFilterFunc(func(shardId int64, key Data, point *MergePoint) FilterDecision {
+		for i, reg := range key {
+			if reg == 30775 {
+				point.Data[i] *= 10
+			}
+		}
+		return FilterKeep
+	}))(engine)
+
+	keys := map[DeviceId]Data{1: {30775, 30813}}
+	drop := &MergePoint{Point: &Point{Data: Data{-1, 2}, DeviceId: 1}}
+	if engine.filter(0, drop, keys) {
+		t.Fatal("point should be dropped")
+	}
+	keep := &MergePoint{Point: &Point{Data: Data{1, 2}, DeviceId: 1}}
+	if !engine.filter(0, keep, keys) || keep.Data[0] != 10 || keep.Data[1] != 2 {
+		t.Fatalf("point: %v", keep.Data)
+	}
+}
+
+func TestEngine_MergeFilter(t *testing.T) {
+	engine := New(WithCompactionFilter(CompactionFilterFunc(func(shardId int64, key Data, point *MergePoint) FilterDecision {
+		switch point.Timestamp % 10 {
+		case 1:
+			return FilterDrop
+		case 2:
+			point.Data = append(point.Data, 0)
+		case 3:
+			point.Data[0] *= 10
+		}
+		return FilterKeep
+	})))
+	did := DeviceId(900031)
+	shardId := int64(5001)
+	base := shardId * ShardSize
+	engine.writeKey(did, Data{30775})
+	list := NewSkipListMap[*Point, struct{}](&DataCompare{})
+	for i := int64(0); i < 4; i++ {
+		list.Insert(&Point{Data: Data{i}, DeviceId: did, Timestamp: base + i}, struct{}{})
+	}
+	engine.dumpList(list)
+	defer func() {
+		for _, file := range engine.listShards(shardId, shardId)[shardId].raw {
+			engine.dataDiskv.Erase(file.Key)
+		}
+	}()
+
+	engine.merge(shardId, engine.listShards(shardId, shardId)[shardId].raw, &DumpOptional{})
+	_, values, err := engine.Read(did, base, base+9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Timestamp < values[j].Timestamp
+	})
+	if fmt.Sprint(values) != fmt.Sprint([]Point{{Data{0}, did, base}, {Data{30}, did, base + 3}}) {
+		t.Fatalf("merged: %v", values)
+	}
+}
+
+func TestEngine_ReadStream(t *testing.T) {
+	engine := New()
+	did := DeviceId(900001)
+	engine.Write(Data{1}, &Point{Data: Data{0}, DeviceId: did})
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+
+	// two overlapping files, the newer one wins
+	for _, v := range []int64{1, 2} {
+		points := make(chan *Point, 100)
+		for i := int64(0); i < 10; i += v {
+			points <- &Point{Data: Data{i * v}, DeviceId: did, Timestamp: i}
+		}
+		close(points)
+		engine.dump(0, points, nil)
+		time.Sleep(time.Millisecond * 2)
+	}
+	// memory is newer than every file
+	engine.list.Insert(&Point{Data: Data{100}, DeviceId: did, Timestamp: 4}, struct{}{})
+	engine.list.Insert(&Point{Data: Data{100}, DeviceId: did, Timestamp: ShardSize}, struct{}{})
+
+	_, points, err := engine.ReadStream(did, 1, ShardSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for p := range points {
+		got = append(got, p.Timestamp, p.Data[0])
+	}
+	want := []int64{1, 1, 2, 4, 3, 3, 4, 100, 5, 5, 6, 12, 7, 7, 8, 16, 9, 9, ShardSize, 100}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("points: %v", got)
+	}
+
+	for k := range engine.dataDiskv.Keys(nil) {
+		if !files[k] {
+			engine.dataDiskv.Erase(k)
+		}
+	}
+	engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+}
+
+func TestParseQuery(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s, err := ParseQuery("SELECT mean(r30775), max(r30813) AS peak FROM devices WHERE device IN (1,2) AND time > now()-1d GROUP BY time(5m), device FILL(previous)", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(s.Devices) != "[1 2]" || s.Start != now.Add(-24*time.Hour).UnixNano()+1 || s.End != now.UnixNano() ||
+		s.Interval != int64(5*time.Minute) || !s.GroupByDevice || s.Fill != FillPrevious {
+		t.Fatalf("statement: %+v", s)
+	}
+	if s.Fields[0].Name() != "mean(r30775)" || s.Fields[1].Name() != "peak" {
+		t.Fatalf("fields: %+v", s.Fields)
+	}
+
+	for _, q := range []string{
+		"SELECT r1, mean(r2) FROM devices",
+		"SELECT median(r1) FROM devices",
+		"SELECT r1 FROM devices GROUP BY time(1m)",
+		"SELECT mean(r1) FROM devices WHERE time > 'yesterday'",
+		"SELECT mean(r1) FROM devices FILL(linearly)",
+		"SELECT r1 FROM devices WHERE time >= 0 RESAMPLE(0s)",
+		"SELECT r1 FROM devices RESAMPLE(1m)",
+		"SELECT mean(r1) FROM devices WHERE time >= 0 RESAMPLE(1m)",
+		"SELECT r1 FROM devices WHERE time >= 0 RESAMPLE(1ns)",
+		"SELECT r1 FROM devices LIMIT",
+	} {
+		if _, err := ParseQuery(q, now); err == nil {
+			t.Fatalf("%s: expected an error", q)
+		}
+	}
+}
+
+func TestEngine_Query(t *testing.T) {
+	engine := New()
+	did := DeviceId(900002)
+	engine.Write(Data{10, 20}, &Point{Data: Data{0, 0}, DeviceId: did})
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+
+	minute := int64(time.Minute)
+	points := make(chan *Point, 100)
+	for i := int64(0); i < 6; i++ {
+		if i == 3 {
+			continue
+		}
+		points <- &Point{Data: Data{i, 2 * i}, DeviceId: did, Timestamp: i * minute}
+	}
+	close(points)
+	engine.dump(0, points, nil)
+
+	q := "SELECT mean(r10), max(r20) FROM devices WHERE device = 900002 AND time >= 0 AND time < 360000000000 GROUP BY time(2m), device"
+	result, err := engine.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Series) != 1 || fmt.Sprint(result.Series[0].Values) != fmt.Sprint([][]any{
+		{int64(0), 0.5, 2.0}, {2 * minute, 2.0, 4.0}, {4 * minute, 4.5, 10.0},
+	}) {
+		t.Fatalf("result: %+v", result.Series)
+	}
+
+	result, err = engine.Query("SELECT last(r10) FROM devices WHERE device = 900002 AND time >= 0 AND time < 360000000000 GROUP BY time(1m) FILL(previous)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result.Series[0].Values) != fmt.Sprint([][]any{
+		{int64(0), 0.0}, {minute, 1.0}, {2 * minute, 2.0}, {3 * minute, 2.0}, {4 * minute, 4.0}, {5 * minute, 5.0},
+	}) {
+		t.Fatalf("result: %+v", result.Series)
+	}
+
+	// minute 3 has no point
+	for fill, want := range map[string]string{
+		"":                "[[120000000000 2 4] [150000000000 <nil> <nil>] [180000000000 <nil> <nil>] [210000000000 <nil> <nil>] [240000000000 4 8]]",
+		"FILL(none)":      "[[120000000000 2 4] [240000000000 4 8]]",
+		"FILL(previous)":  "[[120000000000 2 4] [150000000000 2 4] [180000000000 2 4] [210000000000 2 4] [240000000000 4 8]]",
+		"FILL(linear)":    "[[120000000000 2 4] [150000000000 2.5 5] [180000000000 3 6] [210000000000 3.5 7] [240000000000 4 8]]",
+		"FILL(0) LIMIT 2": "[[120000000000 2 4] [150000000000 0 0]]",
+	} {
+		result, err := engine.Query("SELECT * FROM devices WHERE device = 900002 AND time >= 120000000000 AND time <= 240000000000 RESAMPLE(30s) " + fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(result.Series[0].Values) != want {
+			t.Fatalf("resample %s: %v", fill, result.Series[0].Values)
+		}
+	}
+
+	result, err = engine.Query("SELECT * FROM devices WHERE device = 900002 AND time >= 240000000000 LIMIT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result.Series[0].Columns, result.Series[0].Values) != fmt.Sprint([]string{"time", "r10", "r20"}, [][]any{{4 * minute, int64(4), int64(8)}}) {
+		t.Fatalf("result: %+v", result.Series)
+	}
+
+	for k := range engine.dataDiskv.Keys(nil) {
+		if !files[k] {
+			engine.dataDiskv.Erase(k)
+		}
+	}
+	engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+}
+
+func TestContinuousQuery(t *testing.T) {
+	engine := New(WithContinuousQuery(ContinuousQuery{Name: "test5m", Resolution: int64(5 * time.Minute)}))
+	defer os.RemoveAll(RollupPath + "/test5m")
+	did := DeviceId(900003)
+	engine.Write(Data{10}, &Point{Data: Data{0}, DeviceId: did})
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	r := engine.rollup("test5m")
+
+	// what handleShardGroup does with every point
+	write := func(minute, v int64) {
+		p := &Point{Data: Data{v}, DeviceId: did, Timestamp: minute * int64(time.Minute)}
+		engine.list.Insert(p, struct{}{})
+		r.touch(p)
+	}
+	for i := int64(0); i < 10; i++ {
+		write(i, i)
+	}
+	engine.flushRollup(r)
+
+	query := func() string {
+		result, err := engine.Query("SELECT mean(r10), count(r10), max(r10) FROM test5m WHERE device = 900003 AND time >= 0 AND time < 600000000000 GROUP BY time(5m)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(result.Series[0].Values)
+	}
+	if got := query(); got != fmt.Sprint([][]any{{int64(0), 2.0, int64(5), 4.0}, {int64(5 * time.Minute), 7.0, int64(5), 9.0}}) {
+		t.Fatalf("rollup: %v", got)
+	}
+
+	// a late point overwrites minute 1 of the first window
+	write(1, 21)
+	engine.flushRollup(r)
+	if got := query(); got != fmt.Sprint([][]any{{int64(0), 6.0, int64(5), 21.0}, {int64(5 * time.Minute), 7.0, int64(5), 9.0}}) {
+		t.Fatalf("late rollup: %v", got)
+	}
+
+	if _, err := engine.Query("SELECT first(r10) FROM test5m"); err == nil {
+		t.Fatal("first() on a rollup should fail")
+	}
+
+	// a memtable that is still being dumped is read
+	write(2, 50)
+	list := engine.swapList()
+	engine.flushRollup(r)
+	engine.dumped(list)
+	if got := query(); got != fmt.Sprint([][]any{{int64(0), 16.0, int64(5), 50.0}, {int64(5 * time.Minute), 7.0, int64(5), 9.0}}) {
+		t.Fatalf("rollup of a dumping memtable: %v", got)
+	}
+
+	// touched windows are saved in a batch and recomputed after a restart
+	write(7, 70)
+	write(8, 80)
+	if len(r.saved) != 0 {
+		t.Fatalf("saved before a dump: %v", r.saved)
+	}
+	if err := r.save(); err != nil || len(r.saved) != 1 {
+		t.Fatalf("save: %v %v", r.saved, err)
+	}
+	restarted := New(WithContinuousQuery(ContinuousQuery{Name: "test5m", Resolution: int64(5 * time.Minute)})).rollup("test5m")
+	if fmt.Sprint(restarted.dirty) != fmt.Sprintf("map[%d:map[%d:{}]]", did, 5*time.Minute) {
+		t.Fatalf("dirty after a restart: %v", restarted.dirty)
+	}
+	engine.flushRollup(r)
+	for key := range r.diskv.KeysPrefix("dirty_", nil) {
+		t.Fatalf("recomputed window is still marked: %s", key)
+	}
+	// the memtable with minutes 5 to 9 is gone since dumped above
+	if got := query(); got != fmt.Sprint([][]any{{int64(0), 16.0, int64(5), 50.0}, {int64(5 * time.Minute), 75.0, int64(2), 80.0}}) {
+		t.Fatalf("rollup after a restart: %v", got)
+	}
+
+	// a device whose windows cannot be read fails the query instead of missing from the result
+	err := r.diskv.Write(rollupKey(did, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"SELECT * FROM test5m WHERE device = 900003 AND time >= 0",
+		"SELECT mean(r10) FROM test5m WHERE device = 900003 AND time >= 0 AND time < 600000000000 GROUP BY time(5m)",
+	} {
+		if _, err := engine.Query(q); err == nil {
+			t.Fatalf("unreadable rollup: %s", q)
+		}
+	}
+}
+
+func TestEngine_Last(t *testing.T) {
+	engine := New(WithCompactionFilter(CompactionFilterFunc(func(shardId int64, key Data, point *MergePoint) FilterDecision {
+		return FilterDrop
+	})))
+	did := DeviceId(900004)
+	engine.Write(Data{10}, &Point{Data: Data{1}, DeviceId: did, Timestamp: 1})
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+	defer func() {
+		for k := range engine.dataDiskv.Keys(nil) {
+			if !files[k] {
+				engine.dataDiskv.Erase(k)
+			}
+		}
+	}()
+
+	engine.Write(Data{10}, &Point{Data: Data{5}, DeviceId: did, Timestamp: 5})
+	engine.Write(Data{10}, &Point{Data: Data{3}, DeviceId: did, Timestamp: 3})
+	_, p, err := engine.Last(did)
+	if err != nil || p.Timestamp != 5 || p.Data[0] != 5 {
+		t.Fatalf("last: %v %v", p, err)
+	}
+	last := engine.LastMany([]DeviceId{did, 900005})
+	if len(last) != 1 || last[did].Timestamp != 5 || last[did].Key[0] != 10 {
+		t.Fatalf("last many: %v", last)
+	}
+
+	points := make(chan *Point, 10)
+	points <- &Point{Data: Data{3}, DeviceId: did, Timestamp: 3}
+	points <- &Point{Data: Data{5}, DeviceId: did, Timestamp: 5}
+	close(points)
+	engine.dump(0, points, nil)
+
+	// a restarted engine finds the last point in the newest shard
+	restarted := New()
+	restarted.rebuildLast()
+	if p, ok := restarted.last.get(did); !ok || p.Timestamp != 5 {
+		t.Fatalf("rebuilt last: %v", p)
+	}
+
+	// compaction drops the cached point once the merged file replaced the old one
+	var dumped []CompactFiles
+	for _, file := range engine.listShards(0, 0)[0].raw {
+		if !files[file.Key] {
+			dumped = append(dumped, file)
+		}
+	}
+	engine.merge(0, dumped, nil)
+	if _, ok := engine.last.get(did); ok {
+		t.Fatal("last point should be invalidated")
+	}
+	if _, p, err = engine.Last(did); err == nil {
+		t.Fatalf("last of dropped points: %v", p)
+	}
+}
+
+func TestFill(t *testing.T) {
+	fields := []QueryField{{Func: FnMean, Register: 1}, {Func: FnCount, Register: 1}}
+	windows := map[int64][]*aggregateState{
+		0:  {{count: 1, sum: 0}, {count: 1}},
+		30: {{count: 1, sum: 30}, {count: 1}},
+	}
+	for fill, want := range map[FillMode]string{
+		FillNone:     "[[0 0 1] [30 30 1]]",
+		FillNull:     "[[0 0 1] [10 <nil> <nil>] [20 <nil> <nil>] [30 30 1] [40 <nil> <nil>]]",
+		FillPrevious: "[[0 0 1] [10 0 <nil>] [20 0 <nil>] [30 30 1] [40 30 <nil>]]",
+		FillValue:    "[[0 0 1] [10 -1 <nil>] [20 -1 <nil>] [30 30 1] [40 -1 <nil>]]",
+		FillLinear:   "[[0 0 1] [10 10 <nil>] [20 20 <nil>] [30 30 1] [40 <nil> <nil>]]",
+	} {
+		s := &Statement{Interval: 10, Start: 0, End: 49, HasStart: true, Fill: fill, FillValue: -1}
+		rows, err := s.rows(windows, fields)
+		if err != nil || fmt.Sprint(rows) != want {
+			t.Fatalf("fill %d: %v %v", fill, rows, err)
+		}
+	}
+	s := &Statement{Interval: 10, Start: 0, End: 49, HasStart: true, Fill: FillLinear, Limit: 2}
+	rows, err := s.rows(windows, fields)
+	if err != nil || fmt.Sprint(rows) != "[[0 0 1] [10 10 <nil>]]" {
+		t.Fatalf("linear with a limit: %v %v", rows, err)
+	}
+
+	// resampling onto a step of 10 from raw points at 3, 12 and 42
+	points := make(chan *WindowPoint, 3)
+	for _, ts := range []int64{3, 12, 42} {
+		points <- &WindowPoint{Mean: Data{ts}, Timestamp: ts, Count: 1}
+	}
+	close(points)
+	var got []any
+	for w := range resample(context.Background(), points, 0, 0, 40, 10) {
+		got = append(got, w.Timestamp, w.Mean)
+	}
+	if fmt.Sprint(got) != "[0 [] 10 [3] 20 [12] 30 [] 40 []]" {
+		t.Fatalf("resample: %v", got)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	engine := New()
+	did := DeviceId(900006)
+	engine.Write(Data{10}, &Point{Data: Data{0}, DeviceId: did})
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+	defer func() {
+		for k := range engine.dataDiskv.Keys(nil) {
+			if !files[k] {
+				engine.dataDiskv.Erase(k)
+			}
+		}
+	}()
+
+	// a 16 bit counter wraps after 65530, then the inverter reboots at 50s
+	second := int64(time.Second)
+	points := make(chan *Point, 10)
+	for i, v := range []int64{65500, 65530, 10, 40, 50, 5, 15} {
+		points <- &Point{Data: Data{v}, DeviceId: did, Timestamp: int64(i) * 10 * second}
+	}
+	close(points)
+	engine.dump(0, points, nil)
+
+	result, err := engine.Query("SELECT increase(r10, 16), rate(r10, 16), derivative(r10) FROM devices WHERE device = 900006 AND time >= 0 AND time < 60000000001 GROUP BY time(30s)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// increases: 30, 16 | 30, 10, 5 | 10
+	want := [][]any{{int64(0), 46.0, 46.0 / 20, -65490.0 / 20}, {30 * second, 45.0, 45.0 / 30, -5.0 / 30}, {60 * second, 10.0, 1.0, 1.0}}
+	if fmt.Sprint(result.Series[0].Values) != fmt.Sprint(want) {
+		t.Fatalf("windows: %v", result.Series[0].Values)
+	}
+
+	result, err = engine.Query("SELECT r10, non_negative_difference(r10) FROM devices WHERE device = 900006 AND time >= 0 LIMIT 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result.Series[0].Values) != "[[0 65500 <nil>] [10000000000 65530 30] [20000000000 10 10]]" {
+		t.Fatalf("rows: %v", result.Series[0].Values)
+	}
+
+	rates, err := engine.ReadCounter(did, 10, 0, 60*second, FnRate, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for p := range rates {
+		got = append(got, p.Value)
+	}
+	if fmt.Sprint(got) != "[3 1.6 3 1 0.5 1]" {
+		t.Fatalf("rate: %v", got)
+	}
+}
+
+func TestEngine_Flush(t *testing.T) {
+	engine := New()
+	go engine.handleShardGroup()
+	defer close(engine.points)
+	did := DeviceId(900006)
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+	defer func() {
+		for k := range engine.dataDiskv.Keys(nil) {
+			if !files[k] {
+				engine.dataDiskv.Erase(k)
+			}
+		}
+	}()
+
+	for i := int64(1); i <= 10; i++ {
+		engine.Write(Data{10}, &Point{Data: Data{i}, DeviceId: did, Timestamp: i})
+	}
+	if err := engine.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	engine.mu.RLock()
+	iterator, err := engine.list.Iterator()
+	if err == nil {
+		_, _, err = iterator.Next()
+	}
+	engine.mu.RUnlock()
+	if err == nil {
+		t.Fatal("memtable should be empty after flush")
+	}
+	created := 0
+	for k := range engine.dataDiskv.Keys(nil) {
+		if !files[k] {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Fatalf("flush created %d files", created)
+	}
+	_, points, err := engine.ReadStream(did, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for range points {
+		count++
+	}
+	if count != 10 {
+		t.Fatalf("read %d points", count)
+	}
+
+	// a failed flush keeps the points readable and the next one writes them
+	shardId := int64(5041)
+	blocker := filepath.Join(ValuePath, strconv.FormatInt(ShardSize, 10), strconv.FormatInt(shardId, 10))
+	os.MkdirAll(filepath.Dir(blocker), 0777)
+	os.WriteFile(blocker, nil, 0666)
+	defer os.RemoveAll(blocker)
+	ts := shardId*ShardSize + 1
+	engine.Write(Data{10}, &Point{Data: Data{7}, DeviceId: did, Timestamp: ts})
+	if err := engine.Flush(); err == nil {
+		t.Fatal("flush into a blocked shard")
+	}
+	tmp, _ := os.ReadDir(TmpPath)
+	if len(tmp) != 0 {
+		t.Fatalf("tmp files of a failed dump: %v", tmp)
+	}
+	if !engine.inMemory(did, ts, ts) {
+		t.Fatal("points of a failed flush are not readable")
+	}
+	os.Remove(blocker)
+	if err := engine.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if engine.inMemory(did, ts, ts) || len(engine.listShards(shardId, shardId)[shardId].raw) != 1 {
+		t.Fatal("retried flush")
+	}
+}
+
+func TestEngine_DumpCreated(t *testing.T) {
+	engine := New()
+	shardId := int64(5042)
+	defer os.RemoveAll(filepath.Join(ValuePath, strconv.FormatInt(ShardSize, 10), strconv.FormatInt(shardId, 10)))
+	// files of the same shard and created time, like two merges of the same files, do not replace each other
+	for i := int64(0); i < 3; i++ {
+		points := make(chan *Point, 1)
+		points <- &Point{Data: Data{i}, DeviceId: 900041, Timestamp: shardId * ShardSize}
+		close(points)
+		err := engine.dump(shardId, points, &DumpOptional{Created: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	for _, file := range engine.listShards(shardId, shardId)[shardId].raw {
+		keys = append(keys, file.Key)
+	}
+	sort.Strings(keys)
+	prefix := fmt.Sprintf("%d_%d_", ShardSize, shardId)
+	if fmt.Sprint(keys) != fmt.Sprintf("[%s1000 %s1001 %s1002]", prefix, prefix, prefix) {
+		t.Fatalf("files: %v", keys)
+	}
+	if a, b := engine.nextCreated(), engine.nextCreated(); b <= a {
+		t.Fatalf("created %d after %d", b, a)
+	}
+}
+
+func TestEngine_MergeNewest(t *testing.T) {
+	engine := New()
+	shardId := int64(5027)
+	did := DeviceId(900027)
+	defer os.RemoveAll(filepath.Join(ValuePath, strconv.FormatInt(ShardSize, 10), strconv.FormatInt(shardId, 10)))
+	engine.writeKey(did, Data{1})
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	ts := shardId * ShardSize
+	// the second file overwrites the point at ts
+	for created, values := range map[int64][]int64{1000: {1, 5}, 2000: {2}} {
+		points := make(chan *Point, 2)
+		for i, v := range values {
+			points <- &Point{Data: Data{v}, DeviceId: did, Timestamp: ts + int64(i)}
+		}
+		close(points)
+		err := engine.dump(shardId, points, &DumpOptional{Created: created})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() string {
+		_, values, err := engine.Read(did, ts, ts+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(values, func(i, j int) bool {
+			return values[i].Timestamp < values[j].Timestamp
+		})
+		return fmt.Sprint(values)
+	}
+	want := fmt.Sprint([]Point{{Data: Data{2}, DeviceId: did, Timestamp: ts}, {Data: Data{5}, DeviceId: did, Timestamp: ts + 1}})
+	if got := read(); got != want {
+		t.Fatalf("before merge: %s", got)
+	}
+	err := engine.merge(shardId, engine.listShards(shardId, shardId)[shardId].raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := engine.listShards(shardId, shardId)[shardId].raw; len(files) != 1 {
+		t.Fatalf("files: %v", files)
+	}
+	if got := read(); got != want {
+		t.Fatalf("after merge: %s", got)
+	}
+}
+
+func TestEngine_PlanStatusSeries(t *testing.T) {
+	engine := New()
+	did := DeviceId(900046)
+	status := did | StatusSeriesBit
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+	start := int64(ShardSize * 5046)
+	for _, id := range []DeviceId{did, status, 1<<31 | status} {
+		engine.writeKey(id, Data{1})
+	}
+	points := make(chan *Point, 10)
+	points <- &Point{Data: Data{1}, DeviceId: did, Timestamp: start}
+	points <- &Point{Data: Data{2}, DeviceId: status, Timestamp: start}
+	points <- &Point{Data: Data{3}, DeviceId: 1<<31 | status, Timestamp: start}
+	close(points)
+	engine.dump(5046, points, nil)
+
+	// a status series is not a device, it is queried by its id
+	for where, want := range map[string][]DeviceId{
+		"":                         {did, 1<<31 | status},
+		"device = 1074641870 AND ": {status},
+	} {
+		s, err := ParseQuery(fmt.Sprintf("SELECT * FROM devices WHERE %stime >= %d AND time < %d", where, start, start+ShardSize), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := engine.Plan(s)
+		if err != nil || fmt.Sprint(plan.Devices) != fmt.Sprint(want) {
+			t.Fatalf("%q: %v %v", where, plan, err)
+		}
+	}
+
+	for k := range engine.dataDiskv.Keys(nil) {
+		if !files[k] {
+			engine.dataDiskv.Erase(k)
+		}
+	}
+	for _, id := range []DeviceId{did, status, 1<<31 | status} {
+		engine.keyDiskv.Erase(strconv.Itoa(int(id)))
+	}
+}
+
+func TestEngine_Attributes(t *testing.T) {
+	engine := New()
+	a, b := DeviceId(900007), DeviceId(900008)
+	defer engine.attributes.diskv.Erase(strconv.Itoa(int(a)))
+	defer engine.attributes.diskv.Erase(strconv.Itoa(int(b)))
+
+	engine.SetAttributes(a, 10, map[string]string{"sn": "A1", "version": "1.0"})
+	engine.SetAttributes(a, 20, map[string]string{"sn": "A1", "version": "1.0"})
+	engine.SetAttributes(a, 30, map[string]string{"sn": "A1", "version": "2.0"})
+	engine.SetAttributes(b, 10, map[string]string{"sn": "B1", "version": "1.0"})
+
+	history := engine.AttributeHistory(a)
+	if fmt.Sprint(history) != fmt.Sprint([]AttributeChange{
+		{Time: 10, Values: map[string]string{"sn": "A1", "version": "1.0"}},
+		{Time: 30, Values: map[string]string{"version": "2.0"}},
+	}) {
+		t.Fatalf("history: %v", history)
+	}
+	if v := engine.AttributesAt(a, 25)["version"]; v != "1.0" {
+		t.Fatalf("version at 25: %s", v)
+	}
+	if dids := engine.DevicesWithAttributes(map[string]string{"version": "1.0"}); fmt.Sprint(dids) != fmt.Sprint([]DeviceId{b}) {
+		t.Fatalf("devices: %v", dids)
+	}
+
+	// a restarted engine reads the timelines back
+	restarted := New()
+	if dids := restarted.DevicesWithAttributes(map[string]string{"version": "2.0", "sn": "A1"}); fmt.Sprint(dids) != fmt.Sprint([]DeviceId{a}) {
+		t.Fatalf("devices after restart: %v", dids)
+	}
+
+	// a device is kept if it had the attributes at some time of the range
+	for q, want := range map[string]string{
+		"attr(version) = '2.0'":                                   fmt.Sprint([]DeviceId{a}),
+		"attr(version) = '2.0' AND time <= 29":                    "[]",
+		"attr(version) = '1.0'":                                   fmt.Sprint([]DeviceId{a, b}),
+		"attr(version) = '1.0' AND time >= 30":                    fmt.Sprint([]DeviceId{b}),
+		"attr(version) = '1.0' AND time >= 29 AND time <= 35":     fmt.Sprint([]DeviceId{a, b}),
+		"attr(version) = '1.0' AND attr(sn) = 'A1' AND time < 10": "[]",
+		"attr(sn) = 'B1' AND time >= 0 AND time <= 9":             "[]",
+	} {
+		s, err := ParseQuery("SELECT * FROM devices WHERE "+q, time.Unix(0, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates := map[DeviceId]bool{a: true, b: true}
+		restarted.filterAttributes(s, candidates)
+		var got []DeviceId
+		for _, did := range []DeviceId{a, b} {
+			if candidates[did] {
+				got = append(got, did)
+			}
+		}
+		if fmt.Sprint(got) != want {
+			t.Fatalf("%s: %v", q, got)
+		}
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	catalog, err := NewCatalog([]RegisterDef{
+		{Address: 10, Name: "power", Unit: "W", Scale: 0.1, Signed: true, Type: RegisterInt16},
+		{Address: 20, Name: "energy", Unit: "kWh", Scale: 0.01, Type: RegisterInt32},
+	}, map[string][]RegisterDef{
+		"inverter": {{Address: 20, Name: "power", Unit: "kW", Scale: 0.001}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := catalog.Register("", 10); d.Value(65526) != -1 {
+		t.Fatalf("power: %v", d.Value(65526))
+	}
+	if d, ok := catalog.RegisterByName("inverter", "power"); !ok || d.Address != 20 {
+		t.Fatalf("inverter power: %v", d)
+	}
+	if _, ok := catalog.Register("inverter", 10); ok {
+		t.Fatal("the model replaces register 10 by name")
+	}
+	if _, err := NewCatalog([]RegisterDef{{Address: 1, Type: "int8"}}, nil); err == nil {
+		t.Fatal("int8 should be invalid")
+	}
+
+	engine := New(WithCatalog(catalog))
+	did := DeviceId(900009)
+	engine.Write(Data{10, 20}, &Point{Data: Data{0, 0}, DeviceId: did})
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	defer engine.attributes.diskv.Erase(strconv.Itoa(int(did)))
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+	defer func() {
+		for k := range engine.dataDiskv.Keys(nil) {
+			if !files[k] {
+				engine.dataDiskv.Erase(k)
+			}
+		}
+	}()
+	points := make(chan *Point, 10)
+	points <- &Point{Data: Data{65526, 1000}, DeviceId: did, Timestamp: 1}
+	points <- &Point{Data: Data{30, 3000}, DeviceId: did, Timestamp: 2}
+	close(points)
+	engine.dump(0, points, nil)
+
+	result, err := engine.Query("SELECT * FROM devices WHERE device = 900009 AND time >= 0 AND time <= 2 SCALED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := result.Series[0]
+	if fmt.Sprint(series.Columns, series.Units, series.Values) != fmt.Sprint([]string{"time", "power", "energy"}, []string{"", "W", "kWh"}, [][]any{{int64(1), -1.0, 10.0}, {int64(2), 3.0, 30.0}}) {
+		t.Fatalf("scaled: %v %v %v", series.Columns, series.Units, series.Values)
+	}
+
+	// an inverter finds power at register 20
+	engine.SetAttributes(did, 0, map[string]string{ModelAttribute: "inverter"})
+	result, err = engine.Query("SELECT mean(power) FROM devices WHERE device = 900009 AND time >= 0 AND time <= 2 SCALED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series = result.Series[0]
+	if fmt.Sprint(series.Columns, series.Units, series.Values) != fmt.Sprint([]string{"time", "mean(power)"}, []string{"", "kW"}, [][]any{{int64(0), 2.0}}) {
+		t.Fatalf("inverter: %v %v %v", series.Columns, series.Units, series.Values)
+	}
+}
+
+func TestCatalog_ContinuousQuery(t *testing.T) {
+	catalog, err := NewCatalog([]RegisterDef{
+		{Address: 10, Name: "power", Unit: "W", Scale: 0.1, Signed: true, Type: RegisterInt16},
+		{Address: 20, Name: "energy", Unit: "kWh", Scale: 0.01, Type: RegisterInt32},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := New(WithCatalog(catalog), WithContinuousQuery(ContinuousQuery{Name: "test048", Resolution: int64(5 * time.Minute)}))
+	defer os.RemoveAll(RollupPath + "/test048")
+	did := DeviceId(900048)
+	engine.Write(Data{10, 20}, &Point{Data: Data{0, 0}, DeviceId: did})
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	r := engine.rollup("test048")
+	// -1 W and 3 W, the raw mean 32778 is no power at all
+	for i, p := range []Data{{65526, 1000}, {30, 3000}} {
+		point := &Point{Data: p, DeviceId: did, Timestamp: int64(i) * int64(time.Minute)}
+		engine.list.Insert(point, struct{}{})
+		r.touch(point)
+	}
+	engine.flushRollup(r)
+
+	for q, want := range map[string]string{
+		"last(power), mean(energy), max(energy), count(power)": "[[0 3 20 30 2]]",
+		"mean(power)":      "error",
+		"max(power)":       "error",
+		"power":            "error",
+		"energy":           "[[0 20]]",
+		"mean(power) AS p": "error",
+	} {
+		result, err := engine.Query("SELECT " + q + " FROM test048 WHERE device = 900048 AND time >= 0 AND time < 300000000000 SCALED")
+		got := "error"
+		if err == nil {
+			got = fmt.Sprint(result.Series[0].Values)
+		} else if !errors.IsNotSupported(err) {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if got != want {
+			t.Fatalf("%s: %s", q, got)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	engine := New()
+	var ids []string
+	for i, kind := range []string{"timeout", "invalid", "invalid"} {
+		id, err := engine.AddDeadLetter(DeadLetter{DeviceId: DeviceId(900010 + i%2), Kind: kind, Reason: "bad " + kind, Data: []byte{byte(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			engine.DeleteDeadLetter(id)
+		}
+	}()
+
+	letters, err := engine.DeadLetters(DeadLetterQuery{Kind: "invalid"})
+	if err != nil || len(letters) != 2 || letters[0].Id != ids[1] || letters[1].Id != ids[2] {
+		t.Fatalf("invalid letters: %v %v", letters, err)
+	}
+	letters, _ = engine.DeadLetters(DeadLetterQuery{DeviceId: 900010})
+	if len(letters) != 2 || letters[0].Id != ids[0] {
+		t.Fatalf("letters of 900010: %v", letters)
+	}
+
+	replay := func(l DeadLetter) (error, error) {
+		if l.Data[0] == 0 {
+			return fmt.Errorf("still bad"), nil
+		}
+		return nil, nil
+	}
+	// the accepted letters are kept until their points are committed
+	replayed, rejected, err := engine.ReplayDeadLetters(DeadLetterQuery{DeviceId: 900010}, replay, func() error {
+		return fmt.Errorf("disk full")
+	})
+	if err == nil || replayed != 0 || rejected != 1 {
+		t.Fatalf("failed commit: %d %d %v", replayed, rejected, err)
+	}
+	letters, _ = engine.DeadLetters(DeadLetterQuery{DeviceId: 900010})
+	if len(letters) != 2 {
+		t.Fatalf("after a failed commit: %v", letters)
+	}
+
+	// a failed write stops the replay, the letters after it are unchanged
+	writes := 0
+	replayed, rejected, err = engine.ReplayDeadLetters(DeadLetterQuery{}, func(l DeadLetter) (error, error) {
+		writes++
+		return nil, fmt.Errorf("write")
+	}, func() error {
+		t.Fatal("commit after a failed write")
+		return nil
+	})
+	if err == nil || replayed != 0 || rejected != 0 || writes != 1 {
+		t.Fatalf("failed write: %d %d %d %v", replayed, rejected, writes, err)
+	}
+	letters, _ = engine.DeadLetters(DeadLetterQuery{DeviceId: 900011})
+	if len(letters) != 1 || letters[0].Reason != "bad invalid" || letters[0].Attempts != 0 {
+		t.Fatalf("after a failed write: %v", letters)
+	}
+
+	committed := false
+	replayed, rejected, err = engine.ReplayDeadLetters(DeadLetterQuery{DeviceId: 900010}, replay, func() error {
+		if letters, _ := engine.DeadLetters(DeadLetterQuery{DeviceId: 900010}); len(letters) != 2 {
+			t.Fatalf("deleted before the commit: %v", letters)
+		}
+		committed = true
+		return nil
+	})
+	if err != nil || replayed != 1 || rejected != 1 || !committed {
+		t.Fatalf("replay: %d %d %v", replayed, rejected, err)
+	}
+	letters, _ = engine.DeadLetters(DeadLetterQuery{DeviceId: 900010})
+	if len(letters) != 1 || letters[0].Reason != "still bad" || letters[0].Attempts != 2 {
+		t.Fatalf("after replay: %v", letters)
+	}
+}
+
+func TestEngine_Quarantine(t *testing.T) {
+	engine := New(WithAcceptWindow(time.Hour, time.Minute))
+	now := time.Now().UnixNano()
+	did := DeviceId(900020)
+	for _, ts := range []int64{-1, now - 2*int64(time.Hour), now + int64(time.Hour)} {
+		err := engine.Write(Data{1}, &Point{Data: Data{ts}, DeviceId: did, Timestamp: ts})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if engine.Pending() != 0 {
+		t.Fatalf("pending %d", engine.Pending())
+	}
+	points, err := engine.Quarantined(QuarantineQuery{DeviceId: did})
+	if err != nil || len(points) != 3 {
+		t.Fatalf("quarantined: %v %v", points, err)
+	}
+	defer func() {
+		for _, p := range points {
+			engine.DeleteQuarantined(p.Id)
+		}
+	}()
+	reasons := []string{points[0].Reason, points[1].Reason, points[2].Reason}
+	if fmt.Sprint(reasons) != fmt.Sprint([]string{QuarantineNegative, QuarantineLate, QuarantineFuture}) {
+		t.Fatalf("reasons: %v", reasons)
+	}
+
+	released, err := engine.ReleaseQuarantine(QuarantineQuery{DeviceId: did, Reason: QuarantineLate})
+	if err != nil || released != 1 {
+		t.Fatalf("release: %d %v", released, err)
+	}
+	if engine.isBackfilling(points[1].Point.Timestamp / ShardSize) {
+		t.Fatal("shard still backfilling")
+	}
+	_, values, err := engine.Read(did, 0, now)
+	if err != nil || len(values) != 1 || values[0].Timestamp != points[1].Point.Timestamp {
+		t.Fatalf("read: %v %v", values, err)
+	}
+	left, _ := engine.Quarantined(QuarantineQuery{DeviceId: did})
+	if len(left) != 2 {
+		t.Fatalf("left: %v", left)
+	}
+}
+
+func TestEngine_Backfill(t *testing.T) {
+	engine := New(WithContinuousQuery(ContinuousQuery{Name: "test050", Resolution: int64(5 * time.Minute)}))
+	defer os.RemoveAll(RollupPath + "/test050")
+	did := DeviceId(900050)
+	defer engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+	r := engine.rollup("test050")
+	shardId := int64(5050)
+	start := shardId * ShardSize
+	files := map[string]bool{}
+	for k := range engine.dataDiskv.Keys(nil) {
+		files[k] = true
+	}
+	defer func() {
+		for k := range engine.dataDiskv.Keys(nil) {
+			if !files[k] {
+				engine.dataDiskv.Erase(k)
+			}
+		}
+	}()
+
+	// the points of a failed write are not in the rollups and the last points
+	blocker := filepath.Join(ValuePath, strconv.FormatInt(ShardSize, 10), strconv.FormatInt(shardId, 10))
+	os.MkdirAll(filepath.Dir(blocker), 0777)
+	os.WriteFile(blocker, nil, 0666)
+	b := engine.Backfill()
+	for i := int64(0); i < 3; i++ {
+		err := b.Write(Data{10}, &Point{Data: Data{i}, DeviceId: did, Timestamp: start + i*int64(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := engine.last.get(did); ok || len(r.dirty) != 0 {
+		t.Fatalf("before the write: %v", r.dirty)
+	}
+	if err := b.Close(); err == nil {
+		t.Fatal("backfill into a blocked shard")
+	}
+	if _, ok := engine.last.get(did); ok || len(r.dirty) != 0 {
+		t.Fatalf("after a failed write: %v", r.dirty)
+	}
+	// the points are kept and the shard stays marked for the next try
+	if b.Size() == 0 || !engine.isBackfilling(shardId) {
+		t.Fatalf("after a failed write: %d", b.Size())
+	}
+	os.RemoveAll(blocker)
+
+	// a rollup recomputed before the write would miss the points
+	engine.flushRollup(r)
+	err := b.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Size() != 0 || !engine.isBackfilling(shardId) {
+		t.Fatalf("after a flush: %d", b.Size())
+	}
+	err = b.Close()
+	if err != nil || engine.isBackfilling(shardId) {
+		t.Fatal(err)
+	}
+	if p, ok := engine.last.get(did); !ok || p.Timestamp != start+2*int64(time.Minute) {
+		t.Fatalf("last: %v", p)
+	}
+	engine.flushRollup(r)
+	result, err := engine.Query(fmt.Sprintf("SELECT mean(r10), count(r10) FROM test050 WHERE device = 900050 AND time >= %d AND time < %d", start, start+int64(5*time.Minute)))
+	if err != nil || len(result.Series) != 1 || fmt.Sprint(result.Series[0].Values) != fmt.Sprint([][]any{{start, 1.0, int64(3)}}) {
+		t.Fatalf("rollup: %+v %v", result, err)
+	}
+}
+
+func TestEngine_ReadStreamDumping(t *testing.T) {
+	engine := New()
+	did := DeviceId(900032)
+	engine.Write(Data{1}, &Point{Data: Data{0}, DeviceId: did})
+
+	// a swapped memtable is readable until its files are imported
+	engine.list.Insert(&Point{Data: Data{1}, DeviceId: did, Timestamp: 1}, struct{}{})
+	engine.list.Insert(&Point{Data: Data{2}, DeviceId: did, Timestamp: 2}, struct{}{})
+	list := engine.swapList()
+	engine.list.Insert(&Point{Data: Data{20}, DeviceId: did, Timestamp: 2}, struct{}{})
+	_, points, err := engine.ReadStream(did, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for p := range points {
+		got = append(got, p.Timestamp, p.Data[0])
+	}
+	if fmt.Sprint(got) != "[1 1 2 20]" || !engine.inMemory(did, 1, 1) {
+		t.Fatalf("points: %v", got)
+	}
+	engine.dumped(list)
+	if engine.inMemory(did, 1, 1) {
+		t.Fatal("dumped memtable is still read")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, points, err = engine.ReadStreamContext(ctx, did, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := range points {
+		t.Fatalf("point after cancel: %v", p)
+	}
+	engine.keyDiskv.Erase(strconv.Itoa(int(did)))
+}
+
+func TestSkipList_InsertReplaces(t *testing.T) {
+	list := NewSkipListMap[*Point, struct{}](&DataCompare{})
+	list.Insert(&Point{Data: Data{1}, DeviceId: 1, Timestamp: 5}, struct{}{})
+	list.Insert(&Point{Data: Data{2}, DeviceId: 1, Timestamp: 5}, struct{}{})
+	iterator, err := list.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _, err := iterator.Next()
+	if err != nil || list.Size() != 1 || k.Data[0] != 2 {
+		t.Fatalf("point %v, size %d", k, list.Size())
+	}
+}
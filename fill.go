@@ -0,0 +1,109 @@
+package cakedb
+
+import "context"
+
+func interpolate(t0 int64, v0 float64, t1 int64, v1 float64, t int64) float64 {
+	return v0 + (v1-v0)*float64(t-t0)/float64(t1-t0)
+}
+
+func gridStart(start, step int64) int64 {
+	first := windowStart(start, step)
+	if first < start {
+		first += step
+	}
+	return first
+}
+
+// number returns the value of a row cell, raw rows hold int64 and windows float64
+func number(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// fill fills the nil values of rows sorted by time with the FILL of the statement,
+// counts are not filled and FillLinear leaves the values before the first and after the last one nil
+func (s *Statement) fill(rows [][]any, fields []QueryField) {
+	switch s.Fill {
+	case FillValue, FillPrevious:
+		for r, row := range rows {
+			for i, f := range fields {
+				if row[i+1] != nil || f.Func == FnCount {
+					continue
+				}
+				if s.Fill == FillValue {
+					row[i+1] = s.FillValue
+				} else if r > 0 {
+					row[i+1] = rows[r-1][i+1]
+				}
+			}
+		}
+	case FillLinear:
+		for i, f := range fields {
+			if f.Func != FnCount {
+				interpolateRows(rows, i+1)
+			}
+		}
+	}
+}
+
+// interpolateRows fills the nil values of a column between two values by their timestamps
+func interpolateRows(rows [][]any, column int) {
+	previous := -1
+	for i, row := range rows {
+		v, ok := number(row[column])
+		if !ok {
+			continue
+		}
+		if previous >= 0 && i-previous > 1 {
+			t0, v0 := rows[previous][0].(int64), rows[previous][column]
+			f0, _ := number(v0)
+			t1 := row[0].(int64)
+			for j := previous + 1; j < i; j++ {
+				rows[j][column] = interpolate(t0, f0, t1, v, rows[j][0].(int64))
+			}
+		}
+		previous = i
+	}
+}
+
+// resample puts the windows onto a grid of step in [start, end], a grid timestamp takes the
+// newest window in (t-step, t] and is an empty window without one. It stops once ctx is done.
+func resample(ctx context.Context, windows chan *WindowPoint, did DeviceId, start, end, step int64) chan *WindowPoint {
+	out := make(chan *WindowPoint, 1000)
+	go func() {
+		defer close(out)
+		// drain the windows a consumer does not need
+		defer func() {
+			for range windows {
+			}
+		}()
+		var prev *WindowPoint
+		next, ok := <-windows
+		if !ok {
+			next = nil
+		}
+		for t := gridStart(start, step); t <= end; t += step {
+			for next != nil && next.Timestamp <= t {
+				prev = next
+				if next, ok = <-windows; !ok {
+					next = nil
+				}
+			}
+			w := &WindowPoint{DeviceId: did, Timestamp: t}
+			if prev != nil && prev.Timestamp > t-step {
+				w.Min, w.Max, w.Mean, w.Last, w.Count = prev.Min, prev.Max, prev.Mean, prev.Last, prev.Count
+			}
+			select {
+			case out <- w:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,58 @@
+package cakedb
+
+import "fmt"
+
+type FilterDecision int
+
+const (
+	FilterKeep FilterDecision = iota
+	FilterDrop
+)
+
+// CompactionFilter is called by merge for every point before it is written to the new file.
+//
+// key is the register list of the device. The filter may modify point.Data in place
+// but must keep len(point.Data) == len(key), merge drops a point whose width changed.
+type CompactionFilter interface {
+	Filter(shardId int64, key Data, point *MergePoint) FilterDecision
+}
+
+type CompactionFilterFunc func(shardId int64, key Data, point *MergePoint) FilterDecision
+
+func (f CompactionFilterFunc) Filter(shardId int64, key Data, point *MergePoint) FilterDecision {
+	return f(shardId, key, point)
+}
+
+// WithCompactionFilter registers filters, they run in the order they were registered
+func WithCompactionFilter(filters ...CompactionFilter) Option {
+	return func(e *Engine) {
+		e.filters = append(e.filters, filters...)
+	}
+}
+
+// filter runs the compaction filters on point, keys caches the device keys of a merge
+func (e *Engine) filter(shardId int64, point *MergePoint, keys map[DeviceId]Data) bool {
+	if len(e.filters) == 0 {
+		return true
+	}
+	key, ok := keys[point.DeviceId]
+	if !ok {
+		key, _ = e.ReadKey(point.DeviceId)
+		keys[point.DeviceId] = key
+	}
+	width := len(point.Data)
+	if key != nil {
+		width = len(key)
+	}
+	for _, f := range e.filters {
+		if f.Filter(shardId, key, point) == FilterDrop {
+			return false
+		}
+	}
+	// the file layout of a device has one value per register
+	if len(point.Data) != width {
+		fmt.Println("compaction filter changed the width of", point.DeviceId, point.Timestamp, "to", len(point.Data), "drop it")
+		return false
+	}
+	return true
+}
@@ -5,18 +5,24 @@ go 1.19
 require (
 	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
 	github.com/dlclark/regexp2 v1.9.0
+	github.com/duke-git/lancet/v2 v2.2.0
 	github.com/go-mmap/mmap v0.7.0
+	github.com/golang/snappy v0.0.4
 	github.com/juju/errors v1.0.0
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/peterbourgon/diskv/v3 v3.0.1
 	github.com/pierrec/lz4 v2.6.1+incompatible
+	github.com/spf13/afero v1.9.5
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
 )
 
 require (
-	github.com/duke-git/lancet/v2 v2.2.0 // indirect
 	github.com/frankban/quicktest v1.14.5 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/btree v1.0.0 // indirect
-	github.com/spf13/afero v1.9.5 // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
 )
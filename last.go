@@ -0,0 +1,185 @@
+package cakedb
+
+import (
+	"github.com/juju/errors"
+	"math"
+	"sort"
+	"sync"
+)
+
+// lastCache holds the newest point of every device, a device missing from it is looked up in the files
+type lastCache struct {
+	mu     sync.RWMutex
+	points map[DeviceId]*Point
+}
+
+func newLastCache() *lastCache {
+	return &lastCache{points: map[DeviceId]*Point{}}
+}
+
+func (c *lastCache) get(did DeviceId) (*Point, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p, ok := c.points[did]
+	return p, ok
+}
+
+// update keeps p if it is not older than the cached point, a rewrite of the same timestamp wins
+func (c *lastCache) update(p *Point) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.points[p.DeviceId]; !ok || p.Timestamp >= old.Timestamp {
+		c.points[p.DeviceId] = p
+	}
+}
+
+// invalidate forgets the cached point of a device if it has the timestamp of p
+func (c *lastCache) invalidate(p *Point) {
+	c.mu.RLock()
+	old, ok := c.points[p.DeviceId]
+	c.mu.RUnlock()
+	if !ok || old.Timestamp != p.Timestamp {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.points[p.DeviceId]; ok && old.Timestamp == p.Timestamp {
+		delete(c.points, p.DeviceId)
+	}
+}
+
+// rebuildLast fills the cache with the devices of the newest shard
+func (e *Engine) rebuildLast() {
+	shards := e.listShards(math.MinInt64, math.MaxInt64)
+	newest := int64(math.MinInt64)
+	for shardId, shard := range shards {
+		if len(shard.raw) > 0 && shardId > newest {
+			newest = shardId
+		}
+	}
+	if newest == math.MinInt64 {
+		return
+	}
+	ends := map[DeviceId]int64{}
+	for _, file := range shards[newest].raw {
+		indexes, err := readIndexes(file.Path)
+		if err != nil {
+			continue
+		}
+		for _, index := range indexes {
+			if end, ok := ends[index.DeviceId]; !ok || index.EndTime > end {
+				ends[index.DeviceId] = index.EndTime
+			}
+		}
+	}
+	for did, end := range ends {
+		_, points, err := e.ReadStream(did, end, end)
+		if err != nil {
+			continue
+		}
+		for p := range points {
+			e.last.update(p)
+		}
+	}
+}
+
+// lastFromFiles searches the shards from the newest one down for the newest point of did.
+// A shard downsampled without KeepRaw has only windows, the newest window of the finest
+// resolution stands for the point then, with its last values at the start of the window.
+func (e *Engine) lastFromFiles(did DeviceId) *Point {
+	shards := e.listShards(math.MinInt64, math.MaxInt64)
+	shardIds := make([]int64, 0, len(shards))
+	for shardId, shard := range shards {
+		if len(shard.raw) > 0 || len(shard.downsample) > 0 {
+			shardIds = append(shardIds, shardId)
+		}
+	}
+	sort.Slice(shardIds, func(i, j int) bool {
+		return shardIds[i] > shardIds[j]
+	})
+
+	// points still in memory are newer than the files
+	var last *Point
+	if points := e.memoryPoints(did, math.MinInt64, math.MaxInt64); len(points) > 0 {
+		last = points[len(points)-1]
+	}
+
+	for _, shardId := range shardIds {
+		if last != nil && last.Timestamp >= (shardId+1)*ShardSize {
+			break
+		}
+		if len(shards[shardId].raw) == 0 {
+			if p := e.lastFromWindows(did, shardId, shards[shardId]); p != nil && (last == nil || p.Timestamp > last.Timestamp) {
+				last = p
+			}
+			if last != nil {
+				break
+			}
+			continue
+		}
+		_, points, err := e.ReadStream(did, shardId*ShardSize, (shardId+1)*ShardSize-1)
+		if err != nil {
+			return last
+		}
+		for p := range points {
+			if last == nil || p.Timestamp > last.Timestamp {
+				last = p
+			}
+		}
+		if last != nil {
+			break
+		}
+	}
+	return last
+}
+
+// lastFromWindows returns the last values of the newest window of did in a shard without raw files
+func (e *Engine) lastFromWindows(did DeviceId, shardId int64, shard *shardFiles) *Point {
+	var finest int64
+	for resolution := range shard.downsample {
+		if finest == 0 || resolution < finest {
+			finest = resolution
+		}
+	}
+	_, windows, err := e.ReadWindow(did, shardId*ShardSize, (shardId+1)*ShardSize-1, finest)
+	if err != nil || len(windows) == 0 {
+		return nil
+	}
+	w := windows[len(windows)-1]
+	return &Point{Data: w.Last, DeviceId: did, Timestamp: w.Timestamp}
+}
+
+// Last returns the newest point of did
+func (e *Engine) Last(did DeviceId) (RetKey Data, value *Point, err error) {
+	RetKey, err = e.ReadKey(did)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p, ok := e.last.get(did); ok {
+		return RetKey, p, nil
+	}
+	p := e.lastFromFiles(did)
+	if p == nil {
+		return nil, nil, errors.NotFoundf("points of device %d", did)
+	}
+	e.last.update(p)
+	return RetKey, p, nil
+}
+
+type LastPoint struct {
+	Key Data
+	*Point
+}
+
+// LastMany returns the newest point of every device that has one
+func (e *Engine) LastMany(dids []DeviceId) map[DeviceId]LastPoint {
+	points := make(map[DeviceId]LastPoint, len(dids))
+	for _, did := range dids {
+		key, p, err := e.Last(did)
+		if err != nil {
+			continue
+		}
+		points[did] = LastPoint{Key: key, Point: p}
+	}
+	return points
+}
@@ -54,7 +54,6 @@ func (e *Engine) OpenIndexPipeline(files CompactFiles) chan *MergePoint {
 				break
 			}
 			indexs = append(indexs, &index)
-			fmt.Println(index)
 		}
 
 		//fmt.Println("indexs:", len(indexs))
@@ -77,6 +76,9 @@ func (e *Engine) OpenIndexPipeline(files CompactFiles) chan *MergePoint {
 			//fmt.Println("l", l, "r", r)
 
 			valueCount := len(keyBuffer) / 8
+			if getResolution(files.Key) > 0 {
+				valueCount = windowValueCount(valueCount)
+			}
 			pointSize := int64(8 + valueCount*8)
 
 			buf := make([]byte, r-l)
@@ -173,6 +175,9 @@ func (e *Engine) compact() {
 			if err != nil {
 				continue
 			}
+			if getResolution(key) > 0 {
+				continue
+			}
 			split := strings.Split(key, "_")
 			if stat.Size() < 500*1e6 {
 				v[split[1]] = append(v[split[1]], CompactFiles{
@@ -200,6 +205,10 @@ func (e *Engine) compact() {
 			if err != nil {
 				panic(err)
 			}
+			// the files of a backfill are compacted once it is closed
+			if e.isBackfilling(int64(atoi)) {
+				continue
+			}
 
 			op := DumpOptional{}
 			if size > 100*1e6 {
@@ -207,42 +216,84 @@ func (e *Engine) compact() {
 			}
 
 			fmt.Println(time.Now(), "start compact", files)
-			e.merge(int64(atoi), files, &op)
+			err = e.merge(int64(atoi), files, &op)
+			if err != nil {
+				fmt.Println(time.Now(), "compact", shardId, err)
+				continue
+			}
 			fmt.Println(time.Now(), "end compact", files)
 
 		}
+		e.downsampleShards()
 		time.Sleep(time.Minute)
 	}
 }
 
 type DumpOptional struct {
-	Zip bool
+	Zip        bool
+	Resolution int64 // aggregate points into windows of Resolution, 0 keeps them raw
+	KeepRaw    bool  // do not erase the merged files
+	Created    int64 // created time in the file name in ms, 0 means now
 }
 
-func (e *Engine) merge(shardId int64, files []CompactFiles, op *DumpOptional) {
+// merge writes files into one file and erases them unless KeepRaw, they are kept if the dump fails
+func (e *Engine) merge(shardId int64, files []CompactFiles, op *DumpOptional) error {
 	var c []chan *MergePoint
 	for _, i := range files {
 		pipeline := e.OpenIndexPipeline(i)
 		c = append(c, pipeline)
 	}
 	points := MergeN(c...)
-	lastDid := -1
-	lastTimestamp := -1
 	target := make(chan *Point, 1000)
-	go e.dump(shardId, target, op)
-	for i := range points {
-		if int(i.DeviceId) != lastDid || lastTimestamp != int(i.Timestamp) {
+	// the merged files are erased only after the new file is imported
+	dumped := make(chan error, 1)
+	go func() {
+		if op != nil && op.Resolution > 0 {
+			dumped <- e.dump(shardId, downsample(target, op.Resolution), op)
+		} else {
+			dumped <- e.dump(shardId, target, op)
+		}
+	}()
+	keys := map[DeviceId]Data{}
+	// cached last points a filter may change, they are read from the files again once the new file replaced the old ones
+	stale := map[DeviceId]*Point{}
+	// the points of a (device, timestamp) come by ascending Created, the newest version is kept
+	var newest *MergePoint
+	keep := func(p *MergePoint) {
+		if e.filter(shardId, p, keys) {
 			target <- &Point{
-				Data:      i.Data,
-				DeviceId:  i.DeviceId,
-				Timestamp: i.Timestamp,
+				Data:      p.Data,
+				DeviceId:  p.DeviceId,
+				Timestamp: p.Timestamp,
 			}
 		}
-		lastTimestamp = int(i.Timestamp)
-		lastDid = int(i.DeviceId)
+	}
+	for i := range points {
+		if len(e.filters) > 0 && e.last != nil {
+			if p, ok := e.last.get(i.DeviceId); ok && p.Timestamp == i.Timestamp {
+				stale[i.DeviceId] = i.Point
+			}
+		}
+		if newest != nil && (newest.DeviceId != i.DeviceId || newest.Timestamp != i.Timestamp) {
+			keep(newest)
+		}
+		newest = i
+	}
+	if newest != nil {
+		keep(newest)
 	}
 	close(target)
-	for _, i := range files {
-		e.dataDiskv.Erase(i.Key)
+	err := <-dumped
+	if err != nil {
+		return err
+	}
+	if op == nil || !op.KeepRaw {
+		for _, i := range files {
+			e.dataDiskv.Erase(i.Key)
+		}
+	}
+	for _, p := range stale {
+		e.last.invalidate(p)
 	}
+	return nil
 }
@@ -49,11 +49,12 @@ type SolarData struct {
 type Regs [][]int
 
 func (s SolarMessage) GetSolarData() *SolarData {
-	if s.Data == nil {
+	data, ok := s.Data.(map[string]any)
+	if !ok {
 		return nil
 	}
 	v := &SolarData{}
-	mapstructure.Decode(s.Data.(map[string]any), v)
+	mapstructure.Decode(data, v)
 	return v
 }
 
@@ -72,7 +73,7 @@ func (s *SolarAnalyzer) Analyze(args Message) ([]Record, error) {
 	updatedAt := args.CreatedAt
 	if solarMessage.Timestamp != 0 {
 		updatedAt = time.UnixMilli(solarMessage.Timestamp)
-	} else if solarMessage.MsgType == 80 {
+	} else if solarMessage.MsgType == MsgTypeSolarData {
 		data := solarMessage.GetSolarData()
 		if data != nil {
 			updatedAt = time.UnixMilli(data.Timestamp)
@@ -0,0 +1,137 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"github.com/juju/errors"
+	"os"
+	"sync"
+)
+
+// MsgTypeSolarData is the message type carrying the registers of a device
+const MsgTypeSolarData = 80
+
+// TypeAnalyzer turns a parsed message of one MsgType into records.
+// record is the record SolarAnalyzer makes of the message, its Data is the SolarMessage.
+type TypeAnalyzer interface {
+	AnalyzeType(record Record) ([]Record, error)
+}
+
+type registryKey struct {
+	topic   string
+	msgType int
+}
+
+// Registry dispatches the messages of a topic by MsgType. A message without an analyzer
+// for its topic and type falls back to the one for its type on any topic and is kept
+// as SolarAnalyzer parsed it without either.
+type Registry struct {
+	mu        sync.RWMutex
+	analyzers map[registryKey]TypeAnalyzer
+	solar     SolarAnalyzer
+}
+
+func NewRegistry() *Registry {
+	return &Registry{analyzers: map[registryKey]TypeAnalyzer{}}
+}
+
+// Register sets the analyzer of msgType on topic, an empty topic is every topic
+func (r *Registry) Register(topic string, msgType int, a TypeAnalyzer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.analyzers[registryKey{topic: topic, msgType: msgType}] = a
+}
+
+func (r *Registry) Lookup(topic string, msgType int) (TypeAnalyzer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if a, ok := r.analyzers[registryKey{topic: topic, msgType: msgType}]; ok {
+		return a, true
+	}
+	a, ok := r.analyzers[registryKey{msgType: msgType}]
+	return a, ok
+}
+
+// Analyze parses args like SolarAnalyzer and hands every record to the analyzer of its type
+func (r *Registry) Analyze(topic string, args Message) ([]Record, error) {
+	records, err := r.solar.Analyze(args)
+	if err != nil {
+		return nil, err
+	}
+	var out []Record
+	for _, record := range records {
+		a, ok := r.Lookup(topic, record.MsgType)
+		if !ok {
+			out = append(out, record)
+			continue
+		}
+		analyzed, err := a.AnalyzeType(record)
+		if err != nil {
+			return nil, errors.Annotatef(err, "msg_type %d", record.MsgType)
+		}
+		out = append(out, analyzed...)
+	}
+	return out, nil
+}
+
+type topicAnalyzer struct {
+	registry *Registry
+	topic    string
+}
+
+func (t topicAnalyzer) Analyze(args Message) ([]Record, error) {
+	return t.registry.Analyze(t.topic, args)
+}
+
+// Topic returns the Analyzer of the messages of topic
+func (r *Registry) Topic(topic string) Analyzer {
+	return topicAnalyzer{registry: r, topic: topic}
+}
+
+const (
+	KindStatus = "status"
+	KindAlarm  = "alarm"
+	KindConfig = "config"
+)
+
+// RegistryConfig assigns the analyzers of this package to message types
+type RegistryConfig struct {
+	Types []struct {
+		// Topic is empty for every topic
+		Topic   string `json:"topic"`
+		MsgType int    `json:"msg_type"`
+		// Kind is one of status, alarm and config
+		Kind string `json:"kind"`
+	} `json:"types"`
+}
+
+// LoadRegistry reads a RegistryConfig, an empty path is a Registry without analyzers
+func LoadRegistry(path string) (*Registry, error) {
+	r := NewRegistry()
+	if path == "" {
+		return r, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c RegistryConfig
+	err = json.Unmarshal(buf, &c)
+	if err != nil {
+		return nil, errors.Annotatef(err, "analyzer config %s", path)
+	}
+	for _, t := range c.Types {
+		var a TypeAnalyzer
+		switch t.Kind {
+		case KindStatus:
+			a = StatusAnalyzer{}
+		case KindAlarm:
+			a = AlarmAnalyzer{}
+		case KindConfig:
+			a = NewConfigAnalyzer()
+		default:
+			return nil, errors.NotValidf("analyzer kind %q of msg_type %d", t.Kind, t.MsgType)
+		}
+		r.Register(t.Topic, t.MsgType, a)
+	}
+	return r, nil
+}
@@ -0,0 +1,109 @@
+package analyzer
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func message(deviceId int, msgType int) Message {
+	return Message{
+		DeviceId:  deviceId,
+		CreatedAt: time.UnixMilli(1684168368974),
+		Bytes:     []byte(fmt.Sprintf(`{"msg_type":%d,"status":1,"timestamp":1684168368974,"data":{"sn":"A1"}}`, msgType)),
+	}
+}
+
+func TestRegistry_Lookup(t *testing.T) {
+	r := NewRegistry()
+	r.Register("", 1, AlarmAnalyzer{})
+	r.Register("solar", 1, StatusAnalyzer{})
+	for _, c := range []struct {
+		topic   string
+		msgType int
+		want    string
+	}{
+		{"solar", 1, "analyzer.StatusAnalyzer"},
+		{"other", 1, "analyzer.AlarmAnalyzer"},
+		{"solar", 2, "<nil>"},
+	} {
+		a, ok := r.Lookup(c.topic, c.msgType)
+		if fmt.Sprintf("%T", a) != c.want || ok != (a != nil) {
+			t.Fatalf("%s %d: %T %v", c.topic, c.msgType, a, ok)
+		}
+	}
+}
+
+func TestRegistry_Analyze(t *testing.T) {
+	r := NewRegistry()
+	r.Register("solar", 1, AlarmAnalyzer{})
+	r.Register("", 2, StatusAnalyzer{})
+
+	// without an analyzer the parsed message is kept
+	records, err := r.Topic("other").Analyze(message(7, 1))
+	if err != nil || len(records) != 1 || records[0].Data.(SolarMessage).MsgType != 1 {
+		t.Fatalf("unregistered: %v %v", records, err)
+	}
+	records, err = r.Topic("solar").Analyze(message(7, 1))
+	if err != nil || len(records) != 1 || records[0].Data.(Event).Kind != KindAlarm || records[0].DeviceId != 7 {
+		t.Fatalf("alarm: %v %v", records, err)
+	}
+	records, err = r.Topic("solar").Analyze(message(7, 2))
+	if err != nil || len(records) != 2 || records[1].Data.(Series).DeviceId != 7|StatusSeriesBit {
+		t.Fatalf("status: %v %v", records, err)
+	}
+
+	_, err = r.Topic("solar").Analyze(message(StatusSeriesBit, 2))
+	if !errors.IsNotValid(err) || !strings.Contains(err.Error(), "msg_type 2") {
+		t.Fatalf("status of a large id: %v", err)
+	}
+	_, err = r.Topic("solar").Analyze(Message{Bytes: []byte("{")})
+	if err == nil {
+		t.Fatal("invalid json")
+	}
+}
+
+func TestLoadRegistry(t *testing.T) {
+	r, err := LoadRegistry("")
+	if err != nil || len(r.analyzers) != 0 {
+		t.Fatalf("empty path: %v %v", r, err)
+	}
+
+	dir := t.TempDir()
+	for _, c := range []struct {
+		config string
+		ok     bool
+	}{
+		{`{"types":[{"topic":"solar","msg_type":1,"kind":"alarm"},{"msg_type":2,"kind":"status"},{"msg_type":3,"kind":"config"}]}`, true},
+		{`{"types":[{"msg_type":1,"kind":"unknown"}]}`, false},
+		{`{"types":`, false},
+	} {
+		path := filepath.Join(dir, "analyzers.json")
+		err := os.WriteFile(path, []byte(c.config), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := LoadRegistry(path)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: %v", c.config, err)
+		}
+		if !c.ok {
+			continue
+		}
+		got := ""
+		for _, key := range []registryKey{{"solar", 1}, {"", 2}, {"", 3}} {
+			a, _ := r.Lookup(key.topic, key.msgType)
+			got += fmt.Sprintf("%T ", a)
+		}
+		if got != "analyzer.AlarmAnalyzer analyzer.StatusAnalyzer *analyzer.ConfigAnalyzer " {
+			t.Fatalf("analyzers: %s", got)
+		}
+	}
+	if _, err := LoadRegistry(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package analyzer
+
+import (
+	cakedb "cake-db"
+	"fmt"
+	"github.com/juju/errors"
+	"reflect"
+	"sync"
+)
+
+// Series is a set of register values that is written as a point of its own device
+type Series struct {
+	DeviceId  int
+	Registers []int64
+	Values    []int64
+}
+
+// Event is something that happened on a device at the UpdatedAt of its record
+type Event struct {
+	Kind   string         `json:"kind"`
+	Code   int            `json:"code"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+// StatusSeriesBit marks the device id of the status series of a device.
+// Queries without a device list leave the status series out.
+const StatusSeriesBit = cakedb.StatusSeriesBit
+
+// Registers of the status series
+const (
+	StatusRegister    = 0
+	DevStatRegister   = 1
+	SlaveStatRegister = 2
+)
+
+func dataMap(record Record) (SolarMessage, map[string]any, bool) {
+	msg, ok := record.Data.(SolarMessage)
+	if !ok {
+		return msg, nil, false
+	}
+	data, ok := msg.Data.(map[string]any)
+	return msg, data, ok
+}
+
+func intField(data map[string]any, name string) int64 {
+	v, _ := data[name].(float64)
+	return int64(v)
+}
+
+// StatusAnalyzer adds the status codes of a message as the status series of its device,
+// the message itself is kept so it can be registered for MsgTypeSolarData as well.
+// A device id from StatusSeriesBit on has no status series and its messages are rejected.
+type StatusAnalyzer struct{}
+
+func (StatusAnalyzer) AnalyzeType(record Record) ([]Record, error) {
+	if record.DeviceId < 0 || record.DeviceId >= StatusSeriesBit {
+		return nil, errors.NotValidf("device id %d for a status series", record.DeviceId)
+	}
+	msg, data, _ := dataMap(record)
+	status := record
+	status.Data = Series{
+		DeviceId:  record.DeviceId | StatusSeriesBit,
+		Registers: []int64{StatusRegister, DevStatRegister, SlaveStatRegister},
+		Values:    []int64{int64(msg.Status), intField(data, "dev_stat"), intField(data, "slave_stat")},
+	}
+	return []Record{record, status}, nil
+}
+
+// AlarmAnalyzer turns a message into an alarm event with the status as code and the data as fields
+type AlarmAnalyzer struct{}
+
+func (AlarmAnalyzer) AnalyzeType(record Record) ([]Record, error) {
+	msg, data, _ := dataMap(record)
+	record.Data = Event{Kind: KindAlarm, Code: msg.Status, Fields: data}
+	return []Record{record}, nil
+}
+
+// ConfigFields are the fields of SolarData describing the setup of a device
+var ConfigFields = []string{
+	"sn", "version", "sub_version", "reg_cfg", "preferred", "type",
+	"ip", "gw", "mask", "dns1", "dns2", "ICID", "IMEI", "oper", "lac", "ci",
+}
+
+// ConfigAnalyzer emits a config event with the fields that changed since the last
+// message of a device, the first message of a device has all of them.
+// The last fields are kept in memory only, so after a restart the first message of
+// every device emits all of its fields again.
+type ConfigAnalyzer struct {
+	mu   sync.Mutex
+	last map[int]map[string]any
+}
+
+func NewConfigAnalyzer() *ConfigAnalyzer {
+	return &ConfigAnalyzer{last: map[int]map[string]any{}}
+}
+
+func (c *ConfigAnalyzer) AnalyzeType(record Record) ([]Record, error) {
+	msg, data, ok := dataMap(record)
+	if !ok {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[record.DeviceId]
+	if !ok {
+		last = map[string]any{}
+		c.last[record.DeviceId] = last
+	}
+	changed := map[string]any{}
+	for _, name := range ConfigFields {
+		v, ok := data[name]
+		if !ok {
+			continue
+		}
+		if old, ok := last[name]; ok && reflect.DeepEqual(old, v) {
+			continue
+		}
+		last[name] = v
+		changed[name] = v
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	record.Data = Event{Kind: KindConfig, Code: msg.Status, Fields: changed}
+	return []Record{record}, nil
+}
+
+// Attributes returns the config fields of a message as strings, empty values are left out
+func Attributes(record Record) map[string]string {
+	var fields map[string]any
+	switch data := record.Data.(type) {
+	case SolarMessage:
+		fields, _ = data.Data.(map[string]any)
+	case Event:
+		if data.Kind != KindConfig {
+			return nil
+		}
+		fields = data.Fields
+	}
+	attrs := map[string]string{}
+	for _, name := range ConfigFields {
+		v, ok := fields[name]
+		if !ok || v == nil {
+			continue
+		}
+		value := fmt.Sprint(v)
+		if value != "" {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
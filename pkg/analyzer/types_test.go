@@ -0,0 +1,103 @@
+package analyzer
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"testing"
+	"time"
+)
+
+func record(deviceId int, data map[string]any) Record {
+	return Record{
+		DeviceId:  deviceId,
+		Data:      SolarMessage{MsgType: MsgTypeSolarData, Status: 5, Data: data},
+		UpdatedAt: time.UnixMilli(1684168368974),
+		MsgType:   MsgTypeSolarData,
+	}
+}
+
+func TestStatusAnalyzer(t *testing.T) {
+	in := record(7, map[string]any{"dev_stat": float64(2), "slave_stat": float64(3)})
+	records, err := StatusAnalyzer{}.AnalyzeType(in)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("%v %v", records, err)
+	}
+	if fmt.Sprint(records[0]) != fmt.Sprint(in) {
+		t.Fatalf("message: %v", records[0])
+	}
+	want := Series{DeviceId: 7 | StatusSeriesBit, Registers: []int64{StatusRegister, DevStatRegister, SlaveStatRegister}, Values: []int64{5, 2, 3}}
+	if fmt.Sprint(records[1].Data) != fmt.Sprint(want) || records[1].UpdatedAt != in.UpdatedAt {
+		t.Fatalf("series: %+v", records[1])
+	}
+
+	// the status series of a device id that has the bit would be another device
+	for _, did := range []int{StatusSeriesBit, StatusSeriesBit + 7, -1} {
+		records, err := StatusAnalyzer{}.AnalyzeType(record(did, nil))
+		if !errors.IsNotValid(err) || records != nil {
+			t.Fatalf("%d: %v %v", did, records, err)
+		}
+	}
+}
+
+func TestAlarmAnalyzer(t *testing.T) {
+	records, err := AlarmAnalyzer{}.AnalyzeType(record(7, map[string]any{"code": "E1"}))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("%v %v", records, err)
+	}
+	if fmt.Sprint(records[0].Data) != fmt.Sprint(Event{Kind: KindAlarm, Code: 5, Fields: map[string]any{"code": "E1"}}) {
+		t.Fatalf("event: %+v", records[0].Data)
+	}
+}
+
+func TestConfigAnalyzer(t *testing.T) {
+	c := NewConfigAnalyzer()
+	for i, step := range []struct {
+		did  int
+		data map[string]any
+		want string // the fields of the event, empty without one
+	}{
+		{7, map[string]any{"sn": "A1", "version": "1.0", "regs": []any{}}, "map[sn:A1 version:1.0]"},
+		{7, map[string]any{"sn": "A1", "version": "1.0"}, ""},
+		{7, map[string]any{"sn": "A1", "version": "1.1", "ip": "10.0.0.1"}, "map[ip:10.0.0.1 version:1.1]"},
+		// a missing field is not a change
+		{7, map[string]any{"version": "1.1"}, ""},
+		{8, map[string]any{"sn": "A1"}, "map[sn:A1]"},
+		{8, nil, ""},
+	} {
+		in := record(step.did, step.data)
+		if step.data == nil {
+			in.Data = SolarMessage{Data: []any{}}
+		}
+		records, err := c.AnalyzeType(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if len(records) > 0 {
+			event := records[0].Data.(Event)
+			if event.Kind != KindConfig || event.Code != 5 {
+				t.Fatalf("%d: %+v", i, event)
+			}
+			got = fmt.Sprint(event.Fields)
+		}
+		if got != step.want {
+			t.Fatalf("%d: %q != %q", i, got, step.want)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	for _, c := range []struct {
+		record Record
+		want   string
+	}{
+		{record(7, map[string]any{"sn": "A1", "sub_version": float64(3), "ip": "", "gw": nil, "regs": "x"}), "map[sn:A1 sub_version:3]"},
+		{Record{Data: Event{Kind: KindConfig, Fields: map[string]any{"version": "1.1"}}}, "map[version:1.1]"},
+		{Record{Data: Event{Kind: KindAlarm, Fields: map[string]any{"version": "1.1"}}}, "map[]"},
+		{Record{Data: Series{}}, "map[]"},
+	} {
+		if got := fmt.Sprint(Attributes(c.record)); got != c.want {
+			t.Fatalf("%+v: %s != %s", c.record.Data, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package api
+
+import (
+	"cake-db/server"
+	"encoding/json"
+	"github.com/juju/errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaxWriteBytes limits the body of a write request
+const MaxWriteBytes = 32 << 20
+
+// Handler serves the HTTP/JSON API of a server.CakeServer
+//
+//	GET    /dbs                          list databases
+//	POST   /dbs                          create a database {"name": "...", "config": {...}}
+//	GET    /dbs/{db}                     database config and commit id
+//	DELETE /dbs/{db}                     drop a database
+//	POST   /dbs/{db}/write               batch write keys and points
+//	GET    /dbs/{db}/query?device=&start=&end=
+//	GET    /dbs/{db}/aggregate?device=&start=&end=&step=&fn=
+//	GET    /dbs/{db}/key?device=
+type Handler struct {
+	server *server.CakeServer
+	mux    *http.ServeMux
+}
+
+func NewHandler(s *server.CakeServer) *Handler {
+	h := &Handler{
+		server: s,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/dbs", h.handleDBs)
+	h.mux.HandleFunc("/dbs/", h.handleDB)
+	return h
+}
+
+// Handle registers an additional route, e.g. for other ingestion protocols
+func (h *Handler) Handle(pattern string, handler http.Handler) {
+	h.mux.Handle(pattern, handler)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type CreateDBRequest struct {
+	Name   string         `json:"name"`
+	Config *server.Config `json:"config,omitempty"`
+}
+
+type DBInfo struct {
+	Name   string        `json:"name"`
+	Config server.Config `json:"config"`
+	Id     uint64        `json:"id"`
+}
+
+type Key struct {
+	DeviceId int64   `json:"device_id"`
+	Key      []int64 `json:"key"`
+}
+
+type Point struct {
+	DeviceId  int64   `json:"device_id,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+	Values    []int64 `json:"values"`
+	Id        uint64  `json:"id,omitempty"` // 0 lets the database assign the next id
+}
+
+type WriteRequest struct {
+	Keys   []Key   `json:"keys"`
+	Points []Point `json:"points"`
+}
+
+type WriteResponse struct {
+	Written int    `json:"written"`
+	Id      uint64 `json:"id"` // the id of the last point
+}
+
+type QueryResponse struct {
+	Key    []int64 `json:"key"`
+	Points []Point `json:"points"`
+}
+
+type AggregateResponse struct {
+	Key     []int64         `json:"key"`
+	Windows []server.Window `json:"windows"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errors.NotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, errors.AlreadyExists):
+		code = http.StatusConflict
+	case errors.Is(err, errors.NotValid), errors.Is(err, errors.NotSupported), errors.Is(err, errors.BadRequest):
+		code = http.StatusBadRequest
+	case errors.Is(err, errors.MethodNotAllowed):
+		code = http.StatusMethodNotAllowed
+	}
+	writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
+
+func (h *Handler) handleDBs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.server.ListDB())
+	case http.MethodPost:
+		var req CreateDBRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, errors.BadRequestf("decode body: %v", err))
+			return
+		}
+		config := server.DefaultConfig()
+		if req.Config != nil {
+			config = *req.Config
+		}
+		err = h.server.CreateDBWithConfig(req.Name, config)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, DBInfo{Name: req.Name, Config: config})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) handleDB(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/dbs/"), "/")
+	split := strings.SplitN(path, "/", 2)
+	name := split[0]
+	action := ""
+	if len(split) > 1 {
+		action = split[1]
+	}
+
+	db, err := h.server.Cake(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		config, err := h.server.Config(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, DBInfo{Name: name, Config: config, Id: db.Id()})
+	case action == "" && r.Method == http.MethodDelete:
+		err := h.server.DropDB(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "write" && r.Method == http.MethodPost:
+		h.write(w, r, db)
+	case action == "query" && r.Method == http.MethodGet:
+		h.query(w, r, db)
+	case action == "aggregate" && r.Method == http.MethodGet:
+		h.aggregate(w, r, db)
+	case action == "key" && r.Method == http.MethodGet:
+		h.key(w, r, db)
+	default:
+		writeError(w, errors.NotFoundf("%s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (h *Handler) write(w http.ResponseWriter, r *http.Request, db *server.Cake) {
+	var req WriteRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxWriteBytes)).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		writeError(w, errors.BadRequestf("decode body: %v", err))
+		return
+	}
+	err = checkWrite(db, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, key := range req.Keys {
+		err := db.WriteKey(key.DeviceId, key.Key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	resp := WriteResponse{}
+	for _, p := range req.Points {
+		if p.Id == 0 {
+			resp.Id, err = db.Append(p.DeviceId, p.Timestamp, p.Values)
+			if err != nil {
+				writeError(w, errors.BadRequestf("point %d: %v", resp.Written, err))
+				return
+			}
+		} else {
+			err := db.WriteValue(p.DeviceId, p.Timestamp, p.Values, p.Id)
+			if err != nil {
+				writeError(w, errors.BadRequestf("point %d id %d: %v", resp.Written, p.Id, err))
+				return
+			}
+			resp.Id = p.Id
+		}
+		resp.Written++
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// checkWrite rejects a request with a point whose device has no key or a different number of
+// registers, before anything of it is written
+func checkWrite(db *server.Cake, req *WriteRequest) error {
+	widths := map[int64]int{}
+	for _, key := range req.Keys {
+		if old, err := db.ReadKey(key.DeviceId); err == nil && len(old) != len(key.Key) {
+			return errors.BadRequestf("key of device %d has %d registers instead of %d", key.DeviceId, len(key.Key), len(old))
+		}
+		widths[key.DeviceId] = len(key.Key)
+	}
+	for i, p := range req.Points {
+		width, ok := widths[p.DeviceId]
+		if !ok {
+			key, err := db.ReadKey(p.DeviceId)
+			if err != nil {
+				return errors.BadRequestf("point %d: no key for device %d", i, p.DeviceId)
+			}
+			width = len(key)
+			widths[p.DeviceId] = width
+		}
+		if len(p.Values) != width {
+			return errors.BadRequestf("point %d: %d values for the %d registers of device %d", i, len(p.Values), width, p.DeviceId)
+		}
+	}
+	return nil
+}
+
+type rangeParams struct {
+	device, start, end int64
+}
+
+func intParam(r *http.Request, name string, def int64) (int64, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.BadRequestf("%s: %v", name, err)
+	}
+	return v, nil
+}
+
+func parseRange(r *http.Request) (rangeParams, error) {
+	var p rangeParams
+	var err error
+	if r.URL.Query().Get("device") == "" {
+		return p, errors.BadRequestf("device is required")
+	}
+	if p.device, err = intParam(r, "device", 0); err != nil {
+		return p, err
+	}
+	if p.start, err = intParam(r, "start", 0); err != nil {
+		return p, err
+	}
+	if p.end, err = intParam(r, "end", 1<<63-1); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func (h *Handler) query(w http.ResponseWriter, r *http.Request, db *server.Cake) {
+	p, err := parseRange(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	key, err := db.ReadKey(p.device)
+	if err != nil {
+		writeError(w, errors.NewNotFound(err, "key"))
+		return
+	}
+	values, err := db.ReadValue(p.device, p.start, p.end)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := QueryResponse{Key: key, Points: []Point{}}
+	for i := 0; i+len(key)+1 <= len(values); i += len(key) + 1 {
+		resp.Points = append(resp.Points, Point{
+			Timestamp: values[i],
+			Values:    values[i+1 : i+len(key)+1],
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) aggregate(w http.ResponseWriter, r *http.Request, db *server.Cake) {
+	p, err := parseRange(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	step, err := intParam(r, "step", 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fn := r.URL.Query().Get("fn")
+	if fn == "" {
+		fn = server.AggregateMean
+	}
+	key, err := db.ReadKey(p.device)
+	if err != nil {
+		writeError(w, errors.NewNotFound(err, "key"))
+		return
+	}
+	values, err := db.ReadValue(p.device, p.start, p.end)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	windows, err := server.Aggregate(values, len(key), step, fn)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if windows == nil {
+		windows = []server.Window{}
+	}
+	writeJSON(w, http.StatusOK, AggregateResponse{Key: key, Windows: windows})
+}
+
+func (h *Handler) key(w http.ResponseWriter, r *http.Request, db *server.Cake) {
+	if r.URL.Query().Get("device") == "" {
+		writeError(w, errors.BadRequestf("device is required"))
+		return
+	}
+	device, err := intParam(r, "device", 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	key, err := db.ReadKey(device)
+	if err != nil {
+		writeError(w, errors.NewNotFound(err, "key"))
+		return
+	}
+	writeJSON(w, http.StatusOK, Key{DeviceId: device, Key: key})
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"cake-db/server"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	s, err := server.NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	err = s.CreateDB("solar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHandler(s)
+}
+
+func do(h http.Handler, method, target string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if s, ok := body.(string); ok {
+		buf.WriteString(s)
+	} else if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, &buf))
+	return w
+}
+
+func TestHandler_Write(t *testing.T) {
+	h := newTestHandler(t)
+	w := do(h, http.MethodPost, "/dbs/solar/write", WriteRequest{
+		Keys:   []Key{{DeviceId: 1, Key: []int64{30775, 30813}}},
+		Points: []Point{{DeviceId: 1, Timestamp: 1, Values: []int64{10, 20}}, {DeviceId: 1, Timestamp: 2, Values: []int64{11, 21}, Id: 5}},
+	})
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"written":2,"id":5}` {
+		t.Fatalf("write: %d %s", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodGet, "/dbs/solar/query?device=1&start=0&end=10", nil)
+	var resp QueryResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || fmt.Sprint(resp) != "{[30775 30813] [{0 1 [10 20] 0} {0 2 [11 21] 0}]}" {
+		t.Fatalf("query: %d %v", w.Code, resp)
+	}
+
+	for name, req := range map[string]WriteRequest{
+		"too few values":  {Points: []Point{{DeviceId: 1, Timestamp: 3, Values: []int64{12}}}},
+		"too many values": {Points: []Point{{DeviceId: 1, Timestamp: 3, Values: []int64{12, 22, 32}, Id: 6}}},
+		"unknown key":     {Points: []Point{{DeviceId: 2, Timestamp: 3, Values: []int64{12}}}},
+		"changed key":     {Keys: []Key{{DeviceId: 1, Key: []int64{30775}}}, Points: []Point{{DeviceId: 1, Timestamp: 3, Values: []int64{12}}}},
+		"bad point after a good one": {Points: []Point{
+			{DeviceId: 1, Timestamp: 3, Values: []int64{12, 22}},
+			{DeviceId: 1, Timestamp: 4, Values: []int64{13}},
+		}},
+	} {
+		w := do(h, http.MethodPost, "/dbs/solar/write", req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	// nothing of a rejected request is written
+	w = do(h, http.MethodGet, "/dbs/solar/query?device=1&start=3&end=10", nil)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"key":[30775,30813],"points":[]}` {
+		t.Fatalf("query after rejected writes: %d %s", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodPost, "/dbs/solar/write", `{"points": [`+strings.Repeat(" ", MaxWriteBytes)+`]}`)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large body: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodPost, "/dbs/solar/write", `{"points": `)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("bad body: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodPost, "/dbs/wind/write", WriteRequest{})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown db: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestHandler_DBs(t *testing.T) {
+	h := newTestHandler(t)
+	w := do(h, http.MethodPost, "/dbs", CreateDBRequest{Name: "wind"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodPost, "/dbs", CreateDBRequest{Name: "wind"})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("create twice: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/dbs", nil)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `["solar","wind"]` {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodDelete, "/dbs/wind", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("drop: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/dbs/wind", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("dropped db: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/dbs/solar/query", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("query without device: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	cakedb "cake-db"
+	"github.com/juju/errors"
+	"net/http"
+	"strconv"
+)
+
+// DeadLetterHandler lists and deletes the dead letters of an Engine,
+// replaying them needs the analyzer and is done by cake-ingest -replay-dead-letters
+//
+//	GET    /deadletters?device=&kind=&reason=&start=&end=&limit=
+//	DELETE /deadletters?id=
+type DeadLetterHandler struct {
+	engine *cakedb.Engine
+}
+
+func NewDeadLetterHandler(engine *cakedb.Engine) *DeadLetterHandler {
+	return &DeadLetterHandler{engine: engine}
+}
+
+func formInt(r *http.Request, name string) (int64, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errors.BadRequestf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+func (h *DeadLetterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := cakedb.DeadLetterQuery{Kind: r.FormValue("kind"), Reason: r.FormValue("reason")}
+		values := map[string]int64{}
+		for _, name := range []string{"device", "start", "end", "limit"} {
+			n, err := formInt(r, name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			values[name] = n
+		}
+		q.DeviceId = cakedb.DeviceId(values["device"])
+		q.Start, q.End, q.Limit = values["start"], values["end"], int(values["limit"])
+		letters, err := h.engine.DeadLetters(q)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if letters == nil {
+			letters = []cakedb.DeadLetter{}
+		}
+		writeJSON(w, http.StatusOK, letters)
+	case http.MethodDelete:
+		id := r.FormValue("id")
+		if id == "" {
+			writeError(w, errors.BadRequestf("missing id"))
+			return
+		}
+		err := h.engine.DeleteDeadLetter(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, errors.MethodNotAllowedf("%s", r.Method))
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	cakedb "cake-db"
+	"github.com/juju/errors"
+	"net/http"
+)
+
+// QuarantineHandler lists, releases and deletes the points an Engine quarantined because of
+// their timestamp, a release writes the points through a backfill
+//
+//	GET    /quarantine?device=&reason=&start=&end=&limit=
+//	POST   /quarantine?device=&reason=&start=&end=
+//	DELETE /quarantine?id=
+type QuarantineHandler struct {
+	engine *cakedb.Engine
+}
+
+func NewQuarantineHandler(engine *cakedb.Engine) *QuarantineHandler {
+	return &QuarantineHandler{engine: engine}
+}
+
+func quarantineQuery(r *http.Request) (cakedb.QuarantineQuery, error) {
+	q := cakedb.QuarantineQuery{Reason: r.FormValue("reason")}
+	values := map[string]int64{}
+	for _, name := range []string{"device", "start", "end", "limit"} {
+		n, err := formInt(r, name)
+		if err != nil {
+			return q, err
+		}
+		values[name] = n
+	}
+	q.DeviceId = cakedb.DeviceId(values["device"])
+	q.Start, q.End, q.Limit = values["start"], values["end"], int(values["limit"])
+	return q, nil
+}
+
+func (h *QuarantineHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q, err := quarantineQuery(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		points, err := h.engine.Quarantined(q)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if points == nil {
+			points = []cakedb.QuarantinedPoint{}
+		}
+		writeJSON(w, http.StatusOK, points)
+	case http.MethodPost:
+		q, err := quarantineQuery(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		released, err := h.engine.ReleaseQuarantine(q)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"released": released})
+	case http.MethodDelete:
+		id := r.FormValue("id")
+		if id == "" {
+			writeError(w, errors.BadRequestf("missing id"))
+			return
+		}
+		err := h.engine.DeleteQuarantined(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, errors.MethodNotAllowedf("%s", r.Method))
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	cakedb "cake-db"
+	"github.com/juju/errors"
+	"net/http"
+	"time"
+)
+
+// QueryHandler runs statements of the query language on an Engine
+//
+//	GET|POST /query?q=SELECT ...[&explain=true]
+type QueryHandler struct {
+	engine *cakedb.Engine
+}
+
+func NewQueryHandler(engine *cakedb.Engine) *QueryHandler {
+	return &QueryHandler{engine: engine}
+}
+
+type ExplainResponse struct {
+	Plan     string            `json:"plan"`
+	ShardIds []int64           `json:"shard_ids"`
+	Devices  []cakedb.DeviceId `json:"devices"`
+}
+
+func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, errors.MethodNotAllowedf("%s", r.Method))
+		return
+	}
+	q := r.FormValue("q")
+	if q == "" {
+		writeError(w, errors.BadRequestf("missing q"))
+		return
+	}
+	s, err := cakedb.ParseQuery(q, time.Now())
+	if err != nil {
+		writeError(w, errors.BadRequestf("%v", err))
+		return
+	}
+	plan, err := h.engine.Plan(s)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if r.FormValue("explain") == "true" {
+		writeJSON(w, http.StatusOK, ExplainResponse{
+			Plan:     plan.String(),
+			ShardIds: plan.ShardIds,
+			Devices:  plan.Devices,
+		})
+		return
+	}
+	result, err := h.engine.Execute(plan)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
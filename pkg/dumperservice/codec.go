@@ -0,0 +1,125 @@
+package dumpservice
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Codec decompresses the dump files with its extension
+type Codec interface {
+	// Open returns the decompressed content of the file at path from off on.
+	// A seekable format starts at the frame holding off instead of decoding from the beginning.
+	Open(path string, off int64) (io.ReadCloser, error)
+}
+
+type registeredCodec struct {
+	ext   string
+	codec Codec
+}
+
+var codecs = []registeredCodec{{ext: ".gz", codec: GzipCodec{}}}
+
+// RegisterCodec adds a format that FetchMessage tries when a dump file exists only with ext.
+// A codec registered for an existing extension replaces it.
+func RegisterCodec(ext string, codec Codec) {
+	for i := range codecs {
+		if codecs[i].ext == ext {
+			codecs[i].codec = codec
+			return
+		}
+	}
+	codecs = append(codecs, registeredCodec{ext: ext, codec: codec})
+}
+
+// GzipIndexSuffix is appended to the path of a gzip file to get its index
+const GzipIndexSuffix = ".idx"
+
+// GzipIndexEntry is the start of a gzip member, the offset of its first byte
+// in the decompressed and in the compressed file
+type GzipIndexEntry struct {
+	Raw        int64
+	Compressed int64
+}
+
+// ReadGzipIndex reads the index of a gzip file made of several members,
+// it is a list of 16 byte big-endian entries sorted by offset.
+func ReadGzipIndex(path string) ([]GzipIndexEntry, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf)%16 != 0 {
+		return nil, fmt.Errorf("gzip index %s: invalid length %d", path, len(buf))
+	}
+	entries := make([]GzipIndexEntry, 0, len(buf)/16)
+	for i := 0; i < len(buf); i += 16 {
+		entries = append(entries, GzipIndexEntry{
+			Raw:        int64(binary.BigEndian.Uint64(buf[i:])),
+			Compressed: int64(binary.BigEndian.Uint64(buf[i+8:])),
+		})
+	}
+	return entries, nil
+}
+
+// GzipCodec reads gzip files sequentially. With an index next to the file it starts
+// at the member holding the offset, otherwise it decodes and skips everything before it.
+type GzipCodec struct{}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r gzipReadCloser) Close() error {
+	err := r.Reader.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (GzipCodec) Open(path string, off int64) (io.ReadCloser, error) {
+	// io.CopyN would skip nothing and the read would restart at the beginning of the file
+	if off < 0 {
+		return nil, fmt.Errorf("%s: negative offset %d", path, off)
+	}
+	var start GzipIndexEntry
+	entries, err := ReadGzipIndex(path + GzipIndexSuffix)
+	if err == nil {
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].Raw > off
+		})
+		if i > 0 {
+			start = entries[i-1]
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(start.Compressed, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	gzReader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r := gzipReadCloser{Reader: gzReader, file: file}
+	_, err = io.CopyN(io.Discard, r, off-start.Raw)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: skip to %d: %w", path, off, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,72 @@
+package dumpservice
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGzipCodec_Open(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0000")
+	raw := make([]byte, 0)
+	for i := 0; i < 100; i++ {
+		record := make([]byte, 24+i)
+		record[3] = byte(i)
+		for j := 24; j < len(record); j++ {
+			record[j] = byte(i + j)
+		}
+		raw = append(raw, record...)
+	}
+	err := os.WriteFile(path, raw, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CompressFile(path, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadGzipIndex(path + ".gz" + GzipIndexSuffix)
+	if err != nil || len(entries) < 5 || entries[0] != (GzipIndexEntry{}) {
+		t.Fatalf("index: %v %v", entries, err)
+	}
+
+	check := func(name string) {
+		for _, off := range []int64{0, 1, 24, entries[1].Raw - 1, entries[1].Raw, entries[len(entries)-1].Raw + 3, int64(len(raw))} {
+			r, err := GzipCodec{}.Open(path+".gz", off)
+			if err != nil {
+				t.Fatalf("%s %d: %v", name, off, err)
+			}
+			buf, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(buf, raw[off:]) {
+				t.Fatalf("%s %d: %d bytes %v", name, off, len(buf), err)
+			}
+		}
+		if _, err := (GzipCodec{}).Open(path+".gz", int64(len(raw))+1); err == nil {
+			t.Fatalf("%s: offset after the end", name)
+		}
+		if _, err := (GzipCodec{}).Open(path+".gz", -1); err == nil {
+			t.Fatalf("%s: negative offset", name)
+		}
+	}
+	check("index")
+	// without the index every member before the offset is decoded
+	err = os.Remove(path + ".gz" + GzipIndexSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("no index")
+
+	err = os.WriteFile(path+".gz"+GzipIndexSuffix, make([]byte, 17), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadGzipIndex(path + ".gz" + GzipIndexSuffix); err == nil {
+		t.Fatal("index of 17 bytes")
+	}
+	if _, err := (GzipCodec{}).Open(path+".gz", 0); err == nil {
+		t.Fatal("open with an invalid index")
+	}
+}
@@ -1,9 +1,9 @@
 package dumpservice
 
 import (
-	"bytes"
-	"compress/gzip"
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -17,6 +17,8 @@ type File interface {
 type Service struct {
 	solarDumpService SolarDumpService
 	file             File
+	stream           *bufio.Reader
+	closer           io.Closer
 }
 
 type SolarDumpService struct {
@@ -25,7 +27,7 @@ type SolarDumpService struct {
 	Part   int32  `gorm:"column:part;type:integer;not null" json:"part"`
 	Path   int32  `gorm:"column:path;type:integer;not null" json:"path"`
 	File   int32  `gorm:"column:file;type:integer;not null" json:"file"`
-	Off    int32  `gorm:"column:off;type:integer;not null" json:"off"`
+	Off    int64  `gorm:"column:off;type:bigint;not null" json:"off"`
 	Cnt    int32  `gorm:"column:cnt;type:integer;not null" json:"cnt"`
 }
 
@@ -36,22 +38,31 @@ func NewService(info SolarDumpService) *Service {
 	}
 }
 
+// FilesPerPath is the number of files in a path directory
+const FilesPerPath = 10000
+
+func (s SolarDumpService) fullPath() string {
+	return fmt.Sprintf("%s/%s/%02d/%03d/%04d", s.Prefix, s.Topic, s.Part, s.Path, s.File)
+}
+
+// next is the start of the file after s
+func (s SolarDumpService) next() SolarDumpService {
+	s.Off = 0
+	s.Cnt = 0
+	s.File++
+	if s.File >= FilesPerPath {
+		s.File = 0
+		s.Path++
+	}
+	return s
+}
+
 func (service *Service) getFullPath() string {
-	s := service.solarDumpService
-	fullPath := fmt.Sprintf("%s/%s/%02d/%03d/%04d", s.Prefix, s.Topic, s.Part, s.Path, s.File)
-	return fullPath
+	return service.solarDumpService.fullPath()
 }
 
 func (service *Service) getNextFile() string {
-	s := service.solarDumpService
-	f := s.File + 1
-	p := s.Path
-	if f >= 10000 {
-		f = 0
-		p++
-	}
-	fullPath := fmt.Sprintf("%s/%s/%02d/%03d/%04d", s.Prefix, s.Topic, s.Part, p, f)
-	return fullPath
+	return service.solarDumpService.next().fullPath()
 }
 
 type Message struct {
@@ -60,39 +71,123 @@ type Message struct {
 	Offset   int
 	Time     int
 	Data     []byte
+	// Position is where the record starts in the dump files
+	Position SolarDumpService
 }
 
-func (service *Service) FetchMessage() ([]Message, error) {
-	if service.file == nil {
-		path := service.getFullPath()
-		file, err := os.Open(path)
+// MaxFetchBytes bounds the size of the records one FetchMessage returns
+const MaxFetchBytes = 16 << 20
+
+// open opens the current file. A plain file may still grow and is read at offsets,
+// a compressed one is complete and is read sequentially from Off on.
+func (service *Service) open() error {
+	path := service.getFullPath()
+	file, err := os.Open(path)
+	if err == nil {
+		service.file = file
+		service.closer = file
+		return nil
+	}
+	for _, c := range codecs {
+		if _, statErr := os.Stat(path + c.ext); statErr != nil {
+			continue
+		}
+		r, err := c.codec.Open(path+c.ext, service.solarDumpService.Off)
 		if err != nil {
-			compressedData, err := os.Open(path + ".gz")
-			if err != nil {
-				return nil, err
-			}
-			gzReader, err := gzip.NewReader(compressedData)
-			if err != nil {
-				panic(err)
-			}
-			defer func(gzReader *gzip.Reader) {
-				err := gzReader.Close()
-				if err != nil {
-					panic(err)
-				}
-			}(gzReader)
-
-			buf, err := io.ReadAll(gzReader)
-			if err != nil {
-				return nil, err
-			}
-			service.file = bytes.NewReader(buf)
+			return err
+		}
+		service.stream = bufio.NewReaderSize(r, 1<<20)
+		service.closer = r
+		return nil
+	}
+	return err
+}
+
+func (service *Service) close() {
+	if service.closer != nil {
+		service.closer.Close()
+	}
+	service.file = nil
+	service.stream = nil
+	service.closer = nil
+}
 
-		} else {
-			service.file = file
+func (service *Service) nextFileExists() bool {
+	next := service.getNextFile()
+	if _, err := os.Stat(next); err == nil {
+		return true
+	}
+	for _, c := range codecs {
+		if _, err := os.Stat(next + c.ext); err == nil {
+			return true
 		}
+	}
+	return false
+}
+
+// errIncomplete is a record of a plain file that ends before its length, the writer may still append it
+var errIncomplete = errors.New("incomplete record")
 
-		_, err = service.file.Seek(int64(service.solarDumpService.Off), io.SeekStart)
+// read fills buf with the bytes at off from the current record
+func (service *Service) read(buf []byte, off int64) error {
+	if service.stream != nil {
+		_, err := io.ReadFull(service.stream, buf)
+		return err
+	}
+	n, err := service.file.ReadAt(buf, service.solarDumpService.Off+off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == io.EOF && n > 0 || err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readRecord reads the record at the current position. It returns io.EOF at the end of the data,
+// errIncomplete for a partial record of a plain file and any other error for corrupt data.
+func (service *Service) readRecord(header []byte) (Message, error) {
+	err := service.read(header, 0)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF && service.file != nil {
+			return Message{}, errIncomplete
+		}
+		return Message{}, err
+	}
+	msgLen := binary.BigEndian.Uint32(header[0:])
+	msgDid := binary.BigEndian.Uint32(header[4:])
+	msgOff := binary.BigEndian.Uint64(header[8:])
+	msgTime := binary.BigEndian.Uint64(header[16:])
+
+	data := make([]byte, msgLen)
+	err = service.read(data, 24)
+	if err != nil {
+		if service.file != nil && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return Message{}, errIncomplete
+		}
+		// a compressed file is complete, it cannot end inside a record
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Message{}, err
+	}
+	return Message{
+		Len:      int(msgLen),
+		DeviceId: int(msgDid),
+		Offset:   int(msgOff),
+		Time:     int(msgTime),
+		Data:     data,
+		Position: service.solarDumpService,
+	}, nil
+}
+
+// FetchMessage returns the next records, none if the writer has not appended any yet.
+// It moves on to the next file once the current one ends and the next one exists.
+// Corrupt data or a file that ends inside a record while the next one exists is an error,
+// the position stays at the record so that the same error is returned until it is fixed.
+func (service *Service) FetchMessage() ([]Message, error) {
+	if service.file == nil && service.stream == nil {
+		err := service.open()
 		if err != nil {
 			return nil, err
 		}
@@ -101,58 +196,44 @@ func (service *Service) FetchMessage() ([]Message, error) {
 	header := make([]byte, 24)
 
 	ret := make([]Message, 0)
+	size := 0
 
-	for {
-
-		// read header
-		n, err := service.file.ReadAt(header, int64(service.solarDumpService.Off))
-
-		if err != nil {
-			// write is not finished, read next time
-			// check new file
-
-			_, err1 := os.Stat(service.getNextFile())
-			_, err2 := os.Stat(service.getNextFile() + ".gz")
+	for size < MaxFetchBytes {
+		msg, err := service.readRecord(header)
+		if (err == io.EOF || err == errIncomplete) && service.file != nil && service.nextFileExists() {
+			// the writer may have appended to the file before it created the next one
+			msg, err = service.readRecord(header)
+		}
 
+		if err == io.EOF {
 			// skip if a file already exists.
-			if err1 != nil && err2 != nil {
-				break
+			if service.nextFileExists() {
+				service.close()
+				service.solarDumpService = service.solarDumpService.next()
 			}
-
-			service.solarDumpService.Off = 0
-			service.solarDumpService.Cnt = 0
-			service.solarDumpService.File++
-			if service.solarDumpService.File >= 10000 {
-				service.solarDumpService.File = 0
-				service.solarDumpService.Path++
-			}
-			service.file = nil
 			break
 		}
-
-		msgLen := binary.BigEndian.Uint32(header[0:])
-		msgDid := binary.BigEndian.Uint32(header[4:])
-		msgOff := binary.BigEndian.Uint64(header[8:])
-		msgTime := binary.BigEndian.Uint64(header[16:])
-
-		data := make([]byte, msgLen)
-
-		// read body
-		n, err = service.file.ReadAt(data, int64(service.solarDumpService.Off)+24)
-		if err != nil || n != int(msgLen) {
+		if err == errIncomplete && !service.nextFileExists() {
+			// write is not finished, read next time
 			break
 		}
+		if err != nil {
+			// a stream stopped inside a record is opened at Off again
+			if service.stream != nil {
+				service.close()
+			}
+			// the records before it are returned first
+			if len(ret) > 0 {
+				break
+			}
+			return nil, fmt.Errorf("%s at offset %d: %w", service.getFullPath(), service.solarDumpService.Off, err)
+		}
 
-		ret = append(ret, Message{
-			Len:      int(msgLen),
-			DeviceId: int(msgDid),
-			Offset:   int(msgOff),
-			Time:     int(msgTime),
-			Data:     data,
-		})
+		ret = append(ret, msg)
 
 		service.solarDumpService.Cnt++
-		service.solarDumpService.Off += 24 + int32(msgLen)
+		service.solarDumpService.Off += 24 + int64(msg.Len)
+		size += 24 + msg.Len
 
 	}
 	return ret, nil
@@ -0,0 +1,174 @@
+package dumpservice
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// writeMessages writes n records to files of maxFileSize bytes from pos on
+func writeMessages(t *testing.T, pos SolarDumpService, n int, maxFileSize int64, compress bool) []Message {
+	w := NewWriter(pos)
+	w.MaxFileSize = maxFileSize
+	w.Compress = compress
+	w.GzipMemberSize = 200
+	msgs := make([]Message, 0, n)
+	for i := 0; i < n; i++ {
+		msg := Message{DeviceId: i % 7, Offset: i, Time: 1000 + i, Data: []byte(fmt.Sprint("message ", i))}
+		msg.Len = len(msg.Data)
+		err := w.Write(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the position after the write is the end of the record in its file
+		msg.Position = w.Position()
+		msg.Position.Off -= int64(24 + msg.Len)
+		msg.Position.Cnt--
+		msgs = append(msgs, msg)
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// fetchAll fetches until a fetch returns no records
+func fetchAll(t *testing.T, service *Service) []Message {
+	ret := make([]Message, 0)
+	for {
+		msgs, err := service.FetchMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 {
+			return ret
+		}
+		ret = append(ret, msgs...)
+	}
+}
+
+func TestFetchMessage(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 1, Path: 0, File: 0}
+		want := writeMessages(t, pos, 100, 500, compress)
+		if want[len(want)-1].Position.File < 3 {
+			t.Fatalf("%v: %+v", compress, want[len(want)-1].Position)
+		}
+		if _, err := os.Stat(pos.fullPath() + ".gz"); (err == nil) != compress {
+			t.Fatalf("%v: gzip %v", compress, err)
+		}
+
+		got := fetchAll(t, NewService(pos))
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%v: %v != %v", compress, got, want)
+		}
+
+		// resume at the position of a record, inside a file and at its start
+		for _, i := range []int{1, 37, 99} {
+			got := fetchAll(t, NewService(want[i].Position))
+			if fmt.Sprint(got) != fmt.Sprint(want[i:]) {
+				t.Fatalf("%v %d: %v != %v", compress, i, got, want[i:])
+			}
+		}
+	}
+}
+
+func TestFetchMessage_Growing(t *testing.T) {
+	pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 1}
+	want := writeMessages(t, pos, 3, 1<<20, false)
+	service := NewService(pos)
+	got := fetchAll(t, service)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%v != %v", got, want)
+	}
+
+	// a record whose body is not written yet is read once it is complete
+	file, err := os.OpenFile(pos.fullPath(), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	record := []byte{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 4, 'o', 'k'}
+	file.Write(record[:25])
+	msgs, err := service.FetchMessage()
+	if len(msgs) != 0 || err != nil {
+		t.Fatalf("incomplete: %v %v", msgs, err)
+	}
+	file.Write(record[25:])
+	msgs, err = service.FetchMessage()
+	if len(msgs) != 1 || string(msgs[0].Data) != "ok" || msgs[0].Time != 4 || err != nil {
+		t.Fatalf("complete: %v %v", msgs, err)
+	}
+}
+
+func TestFetchMessage_Errors(t *testing.T) {
+	// a plain file that ends inside a record while the next file exists
+	pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 1}
+	want := writeMessages(t, pos, 20, 200, false)
+	info, err := os.Stat(pos.fullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(pos.fullPath(), info.Size()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewService(pos)
+	msgs, err := service.FetchMessage()
+	if err != nil || len(msgs) == 0 {
+		t.Fatalf("records before the truncation: %v %v", msgs, err)
+	}
+	for i := 0; i < 2; i++ {
+		msgs, err = service.FetchMessage()
+		if err == nil || len(msgs) != 0 {
+			t.Fatalf("truncated: %v %v", msgs, err)
+		}
+	}
+	if service.LastCommit().File != 0 {
+		t.Fatalf("skipped to %+v", service.LastCommit())
+	}
+	// a header cut off in the middle is an error as well
+	err = os.Truncate(pos.fullPath(), want[1].Position.Off+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service = NewService(want[1].Position)
+	msgs, err = service.FetchMessage()
+	if err == nil || len(msgs) != 0 || service.LastCommit() != want[1].Position {
+		t.Fatalf("truncated header: %v %v", msgs, err)
+	}
+
+	// a truncated and a corrupt gzip file
+	for _, corrupt := range []func(buf []byte) []byte{
+		func(buf []byte) []byte { return buf[:len(buf)-20] },
+		func(buf []byte) []byte { buf[len(buf)/2] ^= 0xff; return buf },
+	} {
+		pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 1}
+		writeMessages(t, pos, 40, 1000, true)
+		path := pos.fullPath() + ".gz"
+		os.Remove(path + GzipIndexSuffix)
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, corrupt(buf), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service := NewService(pos)
+		var msgs []Message
+		for err == nil {
+			msgs, err = service.FetchMessage()
+			if len(msgs) == 0 && err == nil {
+				t.Fatal("no error")
+			}
+		}
+		if service.LastCommit().File != 0 {
+			t.Fatalf("skipped to %+v", service.LastCommit())
+		}
+		if _, err = service.FetchMessage(); err == nil {
+			t.Fatal("no error when fetching again")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package dumpservice
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Partitions lists the partition directories under prefix/topic
+func Partitions(prefix, topic string) ([]int32, error) {
+	entries, err := os.ReadDir(fmt.Sprintf("%s/%s", prefix, topic))
+	if err != nil {
+		return nil, err
+	}
+	var parts []int32
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) < 2 {
+			continue
+		}
+		part, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil || part < 0 {
+			continue
+		}
+		parts = append(parts, int32(part))
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i] < parts[j]
+	})
+	return parts, nil
+}
+
+const DefaultDiscoverInterval = time.Minute
+
+// Consumer follows one partition until ctx is done
+type Consumer func(ctx context.Context, part int32) error
+
+// Group consumes every partition of a topic concurrently, like a consumer group
+// with a single member. Partitions created later are picked up by the next discovery.
+type Group struct {
+	Prefix string
+	Topic  string
+
+	DiscoverInterval time.Duration
+}
+
+func NewGroup(prefix, topic string) *Group {
+	return &Group{
+		Prefix:           prefix,
+		Topic:            topic,
+		DiscoverInterval: DefaultDiscoverInterval,
+	}
+}
+
+// Run starts consume for every partition and waits for all of them.
+// The first error of a consumer stops the others and is returned.
+func (g *Group) Run(ctx context.Context, consume Consumer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	started := map[int32]bool{}
+	discover := func() error {
+		parts, err := Partitions(g.Prefix, g.Topic)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if started[part] {
+				continue
+			}
+			started[part] = true
+			wg.Add(1)
+			go func(part int32) {
+				defer wg.Done()
+				err := consume(ctx, part)
+				if err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("partition %02d: %w", part, err)
+						cancel()
+					})
+				}
+			}(part)
+		}
+		return nil
+	}
+
+	err := discover()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(g.DiscoverInterval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			err := discover()
+			if err != nil && !os.IsNotExist(err) {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,87 @@
+package dumpservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartitions(t *testing.T) {
+	prefix := t.TempDir()
+	for _, dir := range []string{"00", "10", "01", "7", "ab", "-1"} {
+		err := os.MkdirAll(fmt.Sprintf("%s/topic/%s", prefix, dir), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(prefix+"/topic/02", nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := Partitions(prefix, "topic")
+	if err != nil || fmt.Sprint(parts) != "[0 1 10]" {
+		t.Fatalf("partitions: %v %v", parts, err)
+	}
+	if _, err := Partitions(prefix, "missing"); !os.IsNotExist(err) {
+		t.Fatalf("missing topic: %v", err)
+	}
+}
+
+func TestGroup_Run(t *testing.T) {
+	prefix := t.TempDir()
+	for _, dir := range []string{"00", "01"} {
+		os.MkdirAll(fmt.Sprintf("%s/topic/%s", prefix, dir), 0777)
+	}
+	g := NewGroup(prefix, "topic")
+	g.DiscoverInterval = 10 * time.Millisecond
+
+	// every partition is consumed once, a later one after the next discovery
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan int32, 10)
+	done := make(chan error)
+	go func() {
+		done <- g.Run(ctx, func(ctx context.Context, part int32) error {
+			started <- part
+			<-ctx.Done()
+			return nil
+		})
+	}()
+	got := map[int32]bool{}
+	for len(got) < 2 {
+		got[<-started] = true
+	}
+	os.MkdirAll(prefix+"/topic/02", 0777)
+	if part := <-started; part != 2 {
+		t.Fatalf("discovered %d", part)
+	}
+	select {
+	case part := <-started:
+		t.Fatalf("%d consumed twice", part)
+	case <-time.After(5 * g.DiscoverInterval):
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the first error stops the other consumers
+	err := g.Run(context.Background(), func(ctx context.Context, part int32) error {
+		if part == 1 {
+			return errors.New("corrupt")
+		}
+		<-ctx.Done()
+		return nil
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "partition 01: corrupt") {
+		t.Fatalf("error: %v", err)
+	}
+
+	if err := NewGroup(prefix, "missing").Run(context.Background(), nil); !os.IsNotExist(err) {
+		t.Fatalf("missing topic: %v", err)
+	}
+}
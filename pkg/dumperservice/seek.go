@@ -0,0 +1,282 @@
+package dumpservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// files lists the positions of the dump files of the partition of s in order
+func (s SolarDumpService) files() ([]SolarDumpService, error) {
+	dir := fmt.Sprintf("%s/%s/%02d", s.Prefix, s.Topic, s.Part)
+	paths, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []SolarDumpService
+	for _, p := range paths {
+		path, err := strconv.ParseInt(p.Name(), 10, 32)
+		if !p.IsDir() || err != nil {
+			continue
+		}
+		entries, err := os.ReadDir(fmt.Sprintf("%s/%s", dir, p.Name()))
+		if err != nil {
+			return nil, err
+		}
+		seen := map[int64]bool{}
+		for _, entry := range entries {
+			name := entry.Name()
+			for _, c := range codecs {
+				name = strings.TrimSuffix(name, c.ext)
+			}
+			file, err := strconv.ParseInt(name, 10, 32)
+			if entry.IsDir() || err != nil || seen[file] {
+				continue
+			}
+			seen[file] = true
+			files = append(files, SolarDumpService{
+				Prefix: s.Prefix,
+				Topic:  s.Topic,
+				Part:   s.Part,
+				Path:   int32(path),
+				File:   int32(file),
+			})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Path != files[j].Path {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].File < files[j].File
+	})
+	return files, nil
+}
+
+// timeAt returns the time of the record at the offset of pos, ok is false past the last record
+func timeAt(pos SolarDumpService) (t int64, ok bool, err error) {
+	s := NewService(pos)
+	err = s.open()
+	if err != nil {
+		return 0, false, err
+	}
+	defer s.close()
+	header := make([]byte, 24)
+	if s.read(header, 0) != nil {
+		return 0, false, nil
+	}
+	return int64(binary.BigEndian.Uint64(header[16:])), true, nil
+}
+
+// scan returns the offset of the first record at or after target from the offset of pos on,
+// found is false if every record is older and off is the end of the file then
+func scan(pos SolarDumpService, target int64) (off int64, found bool, err error) {
+	s := NewService(pos)
+	err = s.open()
+	if err != nil {
+		return 0, false, err
+	}
+	defer s.close()
+	header := make([]byte, 24)
+	for {
+		if s.read(header, 0) != nil {
+			return s.solarDumpService.Off, false, nil
+		}
+		if int64(binary.BigEndian.Uint64(header[16:])) >= target {
+			return s.solarDumpService.Off, true, nil
+		}
+		msgLen := binary.BigEndian.Uint32(header[0:])
+		if s.stream != nil {
+			_, err := io.CopyN(io.Discard, s.stream, int64(msgLen))
+			if err != nil {
+				return s.solarDumpService.Off, false, nil
+			}
+		}
+		s.solarDumpService.Off += 24 + int64(msgLen)
+	}
+}
+
+// scanStart returns where scan starts looking for the first record at or after target, a record
+// boundary found by bisect in a plain file, the gzip member holding the record in a compressed file
+// with an index and 0 in one without
+func scanStart(pos SolarDumpService, target int64) (int64, error) {
+	path := pos.fullPath()
+	if _, err := os.Stat(path); err == nil {
+		return bisect(path, target)
+	}
+	entries, err := ReadGzipIndex(path + ".gz" + GzipIndexSuffix)
+	if err != nil {
+		return 0, nil
+	}
+	var searchErr error
+	i := sort.Search(len(entries), func(i int) bool {
+		at := pos
+		at.Off = entries[i].Raw
+		t, ok, err := timeAt(at)
+		if err != nil {
+			searchErr = err
+		}
+		return !ok || t >= target
+	})
+	if i == 0 {
+		return 0, searchErr
+	}
+	return entries[i-1].Raw, searchErr
+}
+
+// SeekToTime moves the service to the first record at or after t of its partition and
+// returns that position. Without such a record it is the end of the newest file.
+//
+// The files are binary searched by the time of their first record. A plain file found is
+// binary searched by byte offsets, see bisect, a gzip file by its members if it has an index,
+// and the few records left are scanned one after the other.
+// The times of the records must grow along the files. Cnt counts from the new position.
+func (service *Service) SeekToTime(t time.Time) (SolarDumpService, error) {
+	target := t.UnixMilli()
+	files, err := service.solarDumpService.files()
+	if err != nil {
+		return service.solarDumpService, err
+	}
+	if len(files) == 0 {
+		return service.solarDumpService, fmt.Errorf("no dump files in %s/%s/%02d", service.solarDumpService.Prefix, service.solarDumpService.Topic, service.solarDumpService.Part)
+	}
+
+	var searchErr error
+	i := sort.Search(len(files), func(i int) bool {
+		first, ok, err := timeAt(files[i])
+		if err != nil {
+			searchErr = err
+		}
+		// an empty file is the one being written
+		return !ok || first > target
+	})
+	if searchErr != nil {
+		return service.solarDumpService, searchErr
+	}
+	if i > 0 {
+		i--
+	}
+
+	position := files[i]
+	position.Off, err = scanStart(position, target)
+	if err != nil {
+		return service.solarDumpService, err
+	}
+	off, found, err := scan(position, target)
+	if err != nil {
+		return service.solarDumpService, err
+	}
+	position.Off = off
+	if !found && i+1 < len(files) {
+		position = files[i+1]
+	}
+
+	service.close()
+	service.solarDumpService = position
+	return position, nil
+}
+
+const (
+	// bisectWindow is the range of a plain file bisect leaves to scan
+	bisectWindow = 4096
+	// syncRecords is the number of chained headers that make an offset a record boundary
+	syncRecords = 4
+)
+
+// bisect returns a record boundary of the plain file at path from which scan finds the first
+// record at or after target within about bisectWindow bytes. The records hold no marker, so a
+// byte offset is resynced to the next boundary, the first offset whose header chains syncRecords
+// records with growing times, or the end of the file, see boundary.
+func bisect(path string, target int64) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	floor, ok, err := boundary(file, 0, size, 0)
+	if err != nil || !ok || floor >= target {
+		return 0, err
+	}
+
+	// lo is a boundary of a record before target, no boundary from hi to the first record at target is searched
+	lo, hi := int64(0), size
+	for hi-lo > bisectWindow {
+		mid := lo + (hi-lo)/2
+		off, t, ok, err := resync(file, mid, hi, size, floor)
+		if err != nil {
+			return 0, err
+		}
+		if !ok || t >= target {
+			// no boundary between mid and hi is before target
+			hi = mid
+			continue
+		}
+		lo, floor = off, t
+	}
+	return lo, nil
+}
+
+// resync returns the first record boundary in [from, limit) and the time of its record
+func resync(file *os.File, from, limit, size, floor int64) (off, t int64, ok bool, err error) {
+	buf := make([]byte, bisectWindow+24)
+	for start := from; start < limit; start += bisectWindow {
+		n, err := file.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return 0, 0, false, err
+		}
+		for i := 0; i+24 <= n && start+int64(i) < limit; i++ {
+			// most offsets fail on their own header, the chain is read for the others
+			msgLen := int64(binary.BigEndian.Uint32(buf[i:]))
+			if int64(binary.BigEndian.Uint64(buf[i+16:])) < floor || start+int64(i)+24+msgLen > size {
+				continue
+			}
+			t, ok, err := boundary(file, start+int64(i), size, floor)
+			if err != nil {
+				return 0, 0, false, err
+			}
+			if ok {
+				return start + int64(i), t, true, nil
+			}
+		}
+	}
+	return 0, 0, false, nil
+}
+
+// boundary tells if a record starts at off: syncRecords headers chain from it, or fewer up to
+// exactly the end of the file, and their times do not go below floor. t is the time of the record.
+// A truncated record at the end of the file being written fails the check, bisect keeps the
+// range before it then.
+func boundary(file *os.File, off, size, floor int64) (t int64, ok bool, err error) {
+	header := make([]byte, 24)
+	for i := 0; i < syncRecords; i++ {
+		if off == size {
+			return t, i > 0, nil
+		}
+		if off+24 > size {
+			return 0, false, nil
+		}
+		_, err := file.ReadAt(header, off)
+		if err != nil {
+			return 0, false, err
+		}
+		recordTime := int64(binary.BigEndian.Uint64(header[16:]))
+		off += 24 + int64(binary.BigEndian.Uint32(header[0:]))
+		if recordTime < floor || off > size {
+			return 0, false, nil
+		}
+		if i == 0 {
+			t = recordTime
+		}
+		floor = recordTime
+	}
+	return t, true, nil
+}
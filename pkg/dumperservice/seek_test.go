@@ -0,0 +1,103 @@
+package dumpservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSeekToTime(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 2}
+		// records of the times 1000 to 1099 in files of 15 records
+		msgs := writeMessages(t, pos, 100, 500, compress)
+		if _, err := os.Stat(msgs[50].Position.fullPath() + ".gz" + GzipIndexSuffix); (err == nil) != compress {
+			t.Fatalf("%v: index %v", compress, err)
+		}
+		last := msgs[len(msgs)-1].Position
+		last.Off += int64(24 + msgs[len(msgs)-1].Len)
+		last.Cnt = 0
+		for _, c := range []struct {
+			t    int64
+			want SolarDumpService
+		}{
+			{0, msgs[0].Position},
+			{1000, msgs[0].Position},
+			{1001, msgs[1].Position},
+			// the first record of a file and one in a later member
+			{1015, msgs[15].Position},
+			{1052, msgs[52].Position},
+			{1099, msgs[99].Position},
+			// after every record the end of the newest file
+			{1100, last},
+		} {
+			service := NewService(pos)
+			got, err := service.SeekToTime(time.UnixMilli(c.t))
+			want := c.want
+			want.Cnt = 0
+			if err != nil || got != want || service.LastCommit() != want {
+				t.Fatalf("%v %d: %+v != %+v %v", compress, c.t, got, want, err)
+			}
+			msg, err := service.FetchMessage()
+			if c.t < 1100 && (err != nil || len(msg) == 0 || msg[0].Position != want) {
+				t.Fatalf("%v %d: fetched %v %v", compress, c.t, msg, err)
+			}
+		}
+	}
+
+	// a record time between two files is the start of the later one
+	pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 2}
+	w := NewWriter(pos)
+	w.Write(Message{Time: 10, Data: []byte("a")})
+	w.Rotate()
+	w.Write(Message{Time: 20, Data: []byte("b")})
+	w.Close()
+	got, err := NewService(pos).SeekToTime(time.UnixMilli(15))
+	if err != nil || got.File != 1 || got.Off != 0 {
+		t.Fatalf("between files: %+v %v", got, err)
+	}
+
+	if _, err := NewService(SolarDumpService{Prefix: t.TempDir(), Topic: "topic"}).SeekToTime(time.Now()); err == nil {
+		t.Fatal("no dump files")
+	}
+}
+
+func TestSeekToTime_Bisect(t *testing.T) {
+	pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic"}
+	w := NewWriter(pos)
+	// the bodies hold what looks like the header of a record
+	fake := make([]byte, 48)
+	binary.BigEndian.PutUint32(fake[0:], 10)
+	binary.BigEndian.PutUint64(fake[16:], 5000)
+	var offsets []int64
+	for i := 0; i < 3000; i++ {
+		offsets = append(offsets, w.Position().Off)
+		err := w.Write(Message{Time: 1000 + i/3, Data: append([]byte(fmt.Sprint("message ", i)), fake[:i%len(fake)]...)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	end := w.Position()
+	w.Close()
+
+	for _, target := range []int64{0, 1000, 1001, 1333, 1500, 1998, 1999, 2000} {
+		lo, err := bisect(pos.fullPath(), target)
+		i := int(target-1000) * 3
+		if i < 0 {
+			i = 0
+		}
+		want := end.Off
+		if i < len(offsets) {
+			want = offsets[i]
+		}
+		if err != nil || lo > want || want-lo > 2*bisectWindow {
+			t.Fatalf("%d: bisect %d, record at %d %v", target, lo, want, err)
+		}
+		got, err := NewService(pos).SeekToTime(time.UnixMilli(target))
+		if err != nil || got.Off != want {
+			t.Fatalf("%d: %+v, record at %d %v", target, got, want, err)
+		}
+	}
+}
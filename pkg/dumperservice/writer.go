@@ -0,0 +1,247 @@
+package dumpservice
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DefaultMaxFileSize    = 256 << 20
+	DefaultGzipMemberSize = 4 << 20
+)
+
+// Writer appends records in the format read by FetchMessage and starts the next file
+// once a file would grow beyond MaxFileSize.
+//
+// With Compress a file is replaced by a gzip file after it is closed. The gzip file is made
+// of members of about GzipMemberSize decompressed bytes and comes with an index, so GzipCodec
+// opens it at an offset without decoding the members before it.
+type Writer struct {
+	position SolarDumpService
+	file     *os.File
+
+	MaxFileSize    int64
+	Compress       bool
+	GzipMemberSize int64
+}
+
+// NewWriter writes from position on, an existing file at position is appended to.
+// A file that was compressed is complete, the records go to the first file after it.
+func NewWriter(position SolarDumpService) *Writer {
+	position.Off = 0
+	position.Cnt = 0
+	return &Writer{
+		position:       position,
+		MaxFileSize:    DefaultMaxFileSize,
+		GzipMemberSize: DefaultGzipMemberSize,
+	}
+}
+
+// Position returns the file and the offset the next record is written to
+func (w *Writer) Position() SolarDumpService {
+	return w.position
+}
+
+func (w *Writer) open() error {
+	for w.compressed() {
+		w.position = w.position.next()
+	}
+	path := w.position.fullPath()
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.position.Off = info.Size()
+	return nil
+}
+
+// compressed tells whether the current file exists in a format of a codec
+func (w *Writer) compressed() bool {
+	path := w.position.fullPath()
+	for _, c := range codecs {
+		if _, err := os.Stat(path + c.ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Write appends msg, Len is taken from Data
+func (w *Writer) Write(msg Message) error {
+	size := int64(24 + len(msg.Data))
+	if w.file != nil && w.position.Off > 0 && w.position.Off+size > w.MaxFileSize {
+		err := w.Rotate()
+		if err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		err := w.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(msg.Data)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(msg.DeviceId))
+	binary.BigEndian.PutUint64(buf[8:], uint64(msg.Offset))
+	binary.BigEndian.PutUint64(buf[16:], uint64(msg.Time))
+	copy(buf[24:], msg.Data)
+	// one write per record, a reader following the file never sees a header without its body for long
+	_, err := w.file.Write(buf)
+	if err != nil {
+		return err
+	}
+	w.position.Off += size
+	w.position.Cnt++
+	return nil
+}
+
+// Rotate closes the current file and starts the next one
+func (w *Writer) Rotate() error {
+	err := w.closeFile()
+	if err != nil {
+		return err
+	}
+	w.position = w.position.next()
+	return nil
+}
+
+// Close closes the current file, a compressed Writer also compresses it
+func (w *Writer) Close() error {
+	return w.closeFile()
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	path := w.file.Name()
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	if err != nil || !w.Compress {
+		return err
+	}
+	return CompressFile(path, w.GzipMemberSize)
+}
+
+// CompressFile replaces a dump file by an indexed gzip file of members of about memberSize
+// decompressed bytes. Members end at record boundaries.
+func CompressFile(path string, memberSize int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	index, err := compress(bufio.NewReaderSize(src, 1<<20), dst, memberSize)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.WriteFile(path+".gz"+GzipIndexSuffix, index, 0666)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compress %s: %w", path, err)
+	}
+	err = os.Rename(tmp, path+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// countingWriter counts the compressed bytes to find the start of every member
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func compress(src io.Reader, dst io.Writer, memberSize int64) ([]byte, error) {
+	out := &countingWriter{w: dst}
+	var (
+		index  []byte
+		member *gzip.Writer
+		raw    int64
+		start  int64
+	)
+	header := make([]byte, 24)
+	for {
+		_, err := io.ReadFull(src, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if member != nil && raw-start >= memberSize {
+			err := member.Close()
+			if err != nil {
+				return nil, err
+			}
+			member = nil
+		}
+		if member == nil {
+			entry := make([]byte, 16)
+			binary.BigEndian.PutUint64(entry[0:], uint64(raw))
+			binary.BigEndian.PutUint64(entry[8:], uint64(out.n))
+			index = append(index, entry...)
+			member = gzip.NewWriter(out)
+			start = raw
+		}
+		body := int64(binary.BigEndian.Uint32(header))
+		_, err = member.Write(header)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.CopyN(member, src, body)
+		if err != nil {
+			return nil, err
+		}
+		raw += 24 + n
+	}
+	if member == nil {
+		// an empty file is a single empty member
+		index = make([]byte, 16)
+		member = gzip.NewWriter(out)
+	}
+	err := member.Close()
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
@@ -0,0 +1,118 @@
+package dumpservice
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestWriter_RoundTrip(t *testing.T) {
+	pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 3, Path: 2, File: 7}
+	w := NewWriter(pos)
+	want := make([]Message, 0)
+	for i, data := range []string{"", "a", "message"} {
+		msg := Message{Len: len(data), DeviceId: 1<<32 - 1, Offset: i, Time: 1684168368974, Data: []byte(data), Position: w.Position()}
+		err := w.Write(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, msg)
+	}
+	if w.Position().Off != 24*3+8 || w.Position().Cnt != 3 {
+		t.Fatalf("position: %+v", w.Position())
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fetchAll(t, NewService(pos))
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%v != %v", got, want)
+	}
+
+	// another writer appends to the file
+	w = NewWriter(pos)
+	err = w.Write(Message{Data: []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Position().Off != 24*4+9 || w.Position().File != 7 {
+		t.Fatalf("append: %+v", w.Position())
+	}
+	w.Close()
+}
+
+func TestWriter_Rollover(t *testing.T) {
+	for _, start := range []SolarDumpService{{Path: 5, File: FilesPerPath - 2}, {Path: 999, File: FilesPerPath - 1}} {
+		start.Prefix = t.TempDir()
+		start.Topic = "topic"
+		start.Part = 1
+		// one record per file
+		msgs := writeMessages(t, start, 3, 40, false)
+		paths := make([]string, 0)
+		for _, msg := range msgs {
+			paths = append(paths, msg.Position.fullPath()[len(start.Prefix):])
+		}
+		want := map[int32]string{
+			5:   "[/topic/01/005/9998 /topic/01/005/9999 /topic/01/006/0000]",
+			999: "[/topic/01/999/9999 /topic/01/1000/0000 /topic/01/1000/0001]",
+		}[start.Path]
+		if fmt.Sprint(paths) != want {
+			t.Fatalf("%v != %v", paths, want)
+		}
+		got := fetchAll(t, NewService(start))
+		if fmt.Sprint(got) != fmt.Sprint(msgs) {
+			t.Fatalf("%v != %v", got, msgs)
+		}
+	}
+}
+
+func TestWriter_Compress(t *testing.T) {
+	pos := SolarDumpService{Prefix: t.TempDir(), Topic: "topic", Part: 1}
+	want := writeMessages(t, pos, 50, 1<<20, true)
+	path := pos.fullPath()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("plain file: %v", err)
+	}
+	entries, err := ReadGzipIndex(path + ".gz" + GzipIndexSuffix)
+	if err != nil || len(entries) < 2 {
+		t.Fatalf("index: %v %v", entries, err)
+	}
+	// members start at records
+	for _, entry := range entries {
+		at := pos
+		at.Off = entry.Raw
+		msgs, err := NewService(at).FetchMessage()
+		if err != nil || len(msgs) == 0 || msgs[0].Position.Off != entry.Raw || string(msgs[0].Data) != string(messageAt(want, entry.Raw).Data) {
+			t.Fatalf("member at %d: %v %v", entry.Raw, msgs, err)
+		}
+	}
+	got := fetchAll(t, NewService(pos))
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%v != %v", got, want)
+	}
+
+	// a writer at the compressed file starts the next one
+	w := NewWriter(pos)
+	err = w.Write(Message{Data: []byte("next")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if w.Position().File != 1 || w.Position().Off != 28 {
+		t.Fatalf("next: %+v", w.Position())
+	}
+	got = fetchAll(t, NewService(pos))
+	if len(got) != len(want)+1 || string(got[len(want)].Data) != "next" {
+		t.Fatalf("after the compressed file: %v", got[len(want):])
+	}
+}
+
+func messageAt(msgs []Message, off int64) Message {
+	for _, msg := range msgs {
+		if msg.Position.Off == off {
+			return msg
+		}
+	}
+	return Message{}
+}
@@ -0,0 +1,356 @@
+package grafana
+
+import (
+	cakedb "cake-db"
+	"encoding/json"
+	"github.com/juju/errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler implements the simple JSON datasource contract of Grafana on top of an Engine
+//
+//	GET  /              connection test
+//	POST /search        devices, or the registers of a device as "device.register"
+//	POST /query         windows of "device.register[:fn]" sized to intervalMs
+//	POST /annotations   gaps longer than the duration in the query "device duration"
+type Handler struct {
+	engine *cakedb.Engine
+	mux    *http.ServeMux
+}
+
+func NewHandler(engine *cakedb.Engine) *Handler {
+	h := &Handler{
+		engine: engine,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/", h.handleTest)
+	h.mux.HandleFunc("/search", h.handleSearch)
+	h.mux.HandleFunc("/query", h.handleQuery)
+	h.mux.HandleFunc("/annotations", h.handleAnnotations)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+const (
+	FnMin   = "min"
+	FnMax   = "max"
+	FnMean  = "mean"
+	FnLast  = "last"
+	FnCount = "count"
+)
+
+type Range struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type SearchRequest struct {
+	Target string `json:"target"`
+}
+
+type Target struct {
+	Target string `json:"target"`
+	RefId  string `json:"refId"`
+	Type   string `json:"type"`
+	Hide   bool   `json:"hide"`
+}
+
+type QueryRequest struct {
+	Range         Range    `json:"range"`
+	IntervalMs    int64    `json:"intervalMs"`
+	MaxDataPoints int64    `json:"maxDataPoints"`
+	Targets       []Target `json:"targets"`
+}
+
+// TimeSeries holds datapoints as [value, unix milliseconds]
+type TimeSeries struct {
+	Target     string       `json:"target"`
+	RefId      string       `json:"refId,omitempty"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type Annotation struct {
+	Name   string `json:"name"`
+	Query  string `json:"query"`
+	Enable bool   `json:"enable"`
+}
+
+type AnnotationRequest struct {
+	Range      Range      `json:"range"`
+	Annotation Annotation `json:"annotation"`
+}
+
+type AnnotationResponse struct {
+	Annotation Annotation `json:"annotation"`
+	Time       int64      `json:"time"`
+	TimeEnd    int64      `json:"timeEnd"`
+	IsRegion   bool       `json:"isRegion"`
+	Title      string     `json:"title"`
+	Text       string     `json:"text"`
+	Tags       []string   `json:"tags"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	// a device without a key
+	case errors.Is(err, errors.NotFound), os.IsNotExist(errors.Cause(err)):
+		code = http.StatusNotFound
+	case errors.Is(err, errors.NotValid), errors.Is(err, errors.NotSupported), errors.Is(err, errors.BadRequest):
+		code = http.StatusBadRequest
+	case errors.Is(err, errors.MethodNotAllowed):
+		code = http.StatusMethodNotAllowed
+	}
+	writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
+
+func decode(r *http.Request, v any) error {
+	if r.Method != http.MethodPost {
+		return errors.MethodNotAllowedf("%s", r.Method)
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return errors.BadRequestf("decode body: %v", err)
+	}
+	return nil
+}
+
+func (r Range) check() error {
+	if r.To.Before(r.From) {
+		return errors.NotValidf("range from %s to %s", r.From.Format(time.RFC3339), r.To.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (h *Handler) handleTest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, errors.NotFoundf("%s", r.URL.Path))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) handleSearch(w http.ResponseWriter, r *http.Request) {
+	var req SearchRequest
+	err := decode(r, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	device := strings.TrimSuffix(strings.TrimSpace(req.Target), ".")
+	if did, err := strconv.ParseUint(device, 10, 32); err == nil {
+		if key, err := h.engine.ReadKey(cakedb.DeviceId(did)); err == nil {
+			targets := make([]string, 0, len(key))
+			for _, register := range key {
+				targets = append(targets, device+"."+strconv.FormatInt(register, 10))
+			}
+			writeJSON(w, http.StatusOK, targets)
+			return
+		}
+	}
+	targets := []string{}
+	for _, did := range h.engine.Devices() {
+		id := strconv.FormatUint(uint64(did), 10)
+		if strings.HasPrefix(id, device) {
+			targets = append(targets, id)
+		}
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+type target struct {
+	did      cakedb.DeviceId
+	register int64 // -1 selects every register of the device
+	fn       string
+}
+
+// parseTarget parses "device[.register][:fn]"
+func parseTarget(s string) (target, error) {
+	t := target{register: -1, fn: FnMean}
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		t.fn = s[i+1:]
+		s = s[:i]
+		switch t.fn {
+		case FnMin, FnMax, FnMean, FnLast, FnCount:
+		default:
+			return t, errors.NotValidf("aggregate %q", t.fn)
+		}
+	}
+	device, register, ok := strings.Cut(s, ".")
+	did, err := strconv.ParseUint(device, 10, 32)
+	if err != nil {
+		return t, errors.NotValidf("target %q", s)
+	}
+	t.did = cakedb.DeviceId(did)
+	if ok {
+		t.register, err = strconv.ParseInt(register, 10, 64)
+		if err != nil {
+			return t, errors.NotValidf("target %q", s)
+		}
+	}
+	return t, nil
+}
+
+func (t target) value(w *cakedb.WindowPoint, i int) int64 {
+	switch t.fn {
+	case FnMin:
+		return w.Min[i]
+	case FnMax:
+		return w.Max[i]
+	case FnLast:
+		return w.Last[i]
+	case FnCount:
+		return w.Count
+	}
+	return w.Mean[i]
+}
+
+// step returns the window size in nanoseconds
+func (req *QueryRequest) step() int64 {
+	if req.IntervalMs > 0 {
+		return req.IntervalMs * int64(time.Millisecond)
+	}
+	span := req.Range.To.Sub(req.Range.From)
+	if req.MaxDataPoints > 0 && span > 0 {
+		if step := int64(span) / req.MaxDataPoints; step > 0 {
+			return step
+		}
+	}
+	return int64(time.Second)
+}
+
+func (h *Handler) query(req *QueryRequest, t Target) ([]TimeSeries, error) {
+	parsed, err := parseTarget(t.Target)
+	if err != nil {
+		return nil, err
+	}
+	key, windows, err := h.engine.ReadWindow(parsed.did, req.Range.From.UnixNano(), req.Range.To.UnixNano(), req.step())
+	if err != nil {
+		return nil, errors.Annotatef(err, "device %d", parsed.did)
+	}
+	var series []TimeSeries
+	for i, register := range key {
+		if parsed.register >= 0 && parsed.register != register {
+			continue
+		}
+		s := TimeSeries{
+			Target:     strconv.FormatUint(uint64(parsed.did), 10) + "." + strconv.FormatInt(register, 10),
+			RefId:      t.RefId,
+			Datapoints: make([][2]float64, 0, len(windows)),
+		}
+		if parsed.fn != FnMean {
+			s.Target += ":" + parsed.fn
+		}
+		for j := range windows {
+			s.Datapoints = append(s.Datapoints, [2]float64{
+				float64(parsed.value(&windows[j], i)),
+				float64(windows[j].Timestamp / int64(time.Millisecond)),
+			})
+		}
+		series = append(series, s)
+	}
+	if parsed.register >= 0 && len(series) == 0 {
+		return nil, errors.NotFoundf("register %d of device %d", parsed.register, parsed.did)
+	}
+	return series, nil
+}
+
+func (h *Handler) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	err := decode(r, &req)
+	if err == nil {
+		err = req.Range.check()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := []TimeSeries{}
+	for _, t := range req.Targets {
+		if t.Hide || t.Target == "" {
+			continue
+		}
+		series, err := h.query(&req, t)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = append(resp, series...)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	var req AnnotationRequest
+	err := decode(r, &req)
+	if err == nil {
+		err = req.Range.check()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fields := strings.Fields(req.Annotation.Query)
+	if len(fields) != 2 {
+		writeError(w, errors.NotValidf("annotation query %q, want \"device duration\"", req.Annotation.Query))
+		return
+	}
+	parsed, err := parseTarget(fields[0])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	gap, err := time.ParseDuration(fields[1])
+	if err != nil || gap <= 0 {
+		writeError(w, errors.NotValidf("gap %q", fields[1]))
+		return
+	}
+	_, points, err := h.engine.ReadStreamContext(r.Context(), parsed.did, req.Range.From.UnixNano(), req.Range.To.UnixNano())
+	if err != nil {
+		writeError(w, errors.Annotatef(err, "device %d", parsed.did))
+		return
+	}
+	resp := []AnnotationResponse{}
+	last := req.Range.From.UnixNano()
+	gapEnd := func(end int64) {
+		if end-last > int64(gap) {
+			resp = append(resp, AnnotationResponse{
+				Annotation: req.Annotation,
+				Time:       last / int64(time.Millisecond),
+				TimeEnd:    end / int64(time.Millisecond),
+				IsRegion:   true,
+				Title:      "no data",
+				Text:       "no data from device " + fields[0] + " for " + time.Duration(end-last).String(),
+				Tags:       []string{"gap"},
+			})
+		}
+		last = end
+	}
+	for p := range points {
+		gapEnd(p.Timestamp)
+	}
+	if now := time.Now().UnixNano(); req.Range.To.UnixNano() < now {
+		gapEnd(req.Range.To.UnixNano())
+	} else {
+		gapEnd(now)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,146 @@
+package grafana
+
+import (
+	"bytes"
+	cakedb "cake-db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// base is far from the shards the other tests write
+var base = time.Unix(0, cakedb.ShardSize*2835)
+
+var (
+	engineOnce sync.Once
+	engine     *cakedb.Engine
+)
+
+// newTestHandler writes ten points of device 900035 once, Init only starts the first engine of a process
+func newTestHandler(t *testing.T) *Handler {
+	engineOnce.Do(func() {
+		engine = cakedb.New()
+		engine.Init()
+		for i := int64(0); i < 10; i++ {
+			err := engine.Write(cakedb.Data{30775, 30813}, &cakedb.Point{
+				DeviceId:  900035,
+				Timestamp: base.UnixNano() + i*int64(time.Second),
+				Data:      cakedb.Data{i, -i},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		engine.Flush()
+	})
+	return NewHandler(engine)
+}
+
+func do(h http.Handler, method, target string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if s, ok := body.(string); ok {
+		buf.WriteString(s)
+	} else if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, &buf))
+	return w
+}
+
+func TestHandler_Query(t *testing.T) {
+	h := newTestHandler(t)
+	query := func(target string, from, to time.Time) *httptest.ResponseRecorder {
+		return do(h, http.MethodPost, "/query", QueryRequest{
+			Range:      Range{From: from, To: to},
+			IntervalMs: 5000,
+			Targets:    []Target{{Target: target, RefId: "A"}},
+		})
+	}
+
+	w := query("900035.30775:max", base, base.Add(9*time.Second))
+	ms := base.UnixMilli()
+	want := fmt.Sprintf(`[{"target":"900035.30775:max","refId":"A","datapoints":[[4,%d],[9,%d]]}]`, ms, ms+5000)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != want {
+		t.Fatalf("query: %d %s", w.Code, w.Body)
+	}
+
+	for target, code := range map[string]int{
+		"900036":         http.StatusNotFound,
+		"900035.1":       http.StatusNotFound,
+		"x":              http.StatusBadRequest,
+		"900035.x":       http.StatusBadRequest,
+		"900035:median":  http.StatusBadRequest,
+		"99999999999999": http.StatusBadRequest,
+	} {
+		w := query(target, base, base.Add(time.Minute))
+		if w.Code != code {
+			t.Fatalf("%s: %d %s", target, w.Code, w.Body)
+		}
+	}
+	w = query("900035", base.Add(time.Minute), base)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("reversed range: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/query", nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("get: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodPost, "/query", `{"targets": [`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("bad body: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/unknown", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown path: %d %s", w.Code, w.Body)
+	}
+	w = do(h, http.MethodGet, "/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("test: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestHandler_SearchAnnotations(t *testing.T) {
+	h := newTestHandler(t)
+	w := do(h, http.MethodPost, "/search", SearchRequest{Target: "900035."})
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `["900035.30775","900035.30813"]` {
+		t.Fatalf("search: %d %s", w.Code, w.Body)
+	}
+
+	annotations := func(query string, to time.Time) *httptest.ResponseRecorder {
+		return do(h, http.MethodPost, "/annotations", AnnotationRequest{
+			Range:      Range{From: base.Add(-time.Minute), To: to},
+			Annotation: Annotation{Name: "gaps", Query: query, Enable: true},
+		})
+	}
+	w = annotations("900035 30s", base.Add(2*time.Minute))
+	var resp []AnnotationResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || len(resp) != 2 ||
+		resp[0].Time != base.Add(-time.Minute).UnixMilli() || resp[0].TimeEnd != base.UnixMilli() ||
+		resp[1].Time != base.Add(9*time.Second).UnixMilli() || resp[1].TimeEnd != base.Add(2*time.Minute).UnixMilli() {
+		t.Fatalf("annotations: %d %+v", w.Code, resp)
+	}
+
+	for query, code := range map[string]int{
+		"900036 30s":  http.StatusNotFound,
+		"900035":      http.StatusBadRequest,
+		"900035 soon": http.StatusBadRequest,
+		"900035 -1s":  http.StatusBadRequest,
+		"x 30s":       http.StatusBadRequest,
+	} {
+		w := annotations(query, base.Add(2*time.Minute))
+		if w.Code != code {
+			t.Fatalf("%s: %d %s", query, w.Code, w.Body)
+		}
+	}
+	w = annotations("900035 30s", base.Add(-2*time.Minute))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("reversed range: %d %s", w.Code, w.Body)
+	}
+}
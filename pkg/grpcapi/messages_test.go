@@ -0,0 +1,73 @@
+package grpcapi
+
+import (
+	"bytes"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func TestMessages_RoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		in, out proto.Message
+	}{
+		{&WriteRequest{
+			Keys:   []*DeviceKey{{DeviceId: 1, Key: []int64{30775, 30813}}, {DeviceId: 2}},
+			Points: []*Point{{DeviceId: 1, Timestamp: 1684168368974000000, Values: []int64{-1, 0, 1 << 62}}, {DeviceId: 2, Timestamp: -5}},
+		}, &WriteRequest{}},
+		{&WriteResponse{Points: 1 << 40}, &WriteResponse{}},
+		{&QueryRequest{DeviceId: 1<<32 - 1, Start: -1, End: 1<<63 - 1, BatchSize: 100}, &QueryRequest{}},
+		{&QueryResponse{Key: []int64{30775}, Points: []*Point{{DeviceId: 1, Timestamp: 2, Values: []int64{3}}}}, &QueryResponse{}},
+		{&QueryResponse{}, &QueryResponse{}},
+	} {
+		buf, err := proto.Marshal(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = proto.Unmarshal(buf, c.out)
+		if err != nil {
+			t.Fatalf("%T: %v", c.in, err)
+		}
+		if !proto.Equal(c.in, c.out) {
+			t.Fatalf("%T: %v != %v", c.in, c.in, c.out)
+		}
+	}
+}
+
+func TestMessages_Wire(t *testing.T) {
+	buf, _ := proto.Marshal(&Point{DeviceId: 1, Timestamp: 150, Values: []int64{-1, 2}})
+	want := []byte{
+		0x08, 0x01, // device_id = 1
+		0x10, 0x96, 0x01, // timestamp = 150
+		0x1a, 0x0b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x02, // values = [-1, 2] packed
+	}
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("point: % x", buf)
+	}
+
+	// unpacked repeated values and unknown fields of a newer client
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 2)
+	b = protowire.AppendTag(b, 9, protowire.BytesType)
+	b = protowire.AppendString(b, "unknown")
+	k := &DeviceKey{}
+	err := proto.Unmarshal(b, k)
+	if err != nil || k.DeviceId != 7 || fmt.Sprint(k.Key) != "[1 2]" {
+		t.Fatalf("key: %v %v", k, err)
+	}
+}
+
+func TestMessages_Errors(t *testing.T) {
+	buf, _ := proto.Marshal(&WriteRequest{Points: []*Point{{DeviceId: 1, Values: []int64{1, 2, 3}}}})
+	for i := 1; i < len(buf); i++ {
+		if err := proto.Unmarshal(buf[:i], &WriteRequest{}); err == nil {
+			t.Fatalf("truncated at %d: no error", i)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package grpcapi
+
+import (
+	cakedb "cake-db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cake.proto
+
+const DefaultBatchSize = 1000
+
+// Service implements CakeServer on top of an Engine
+type Service struct {
+	UnimplementedCakeServer
+	engine *cakedb.Engine
+}
+
+func NewService(engine *cakedb.Engine) *Service {
+	return &Service{engine: engine}
+}
+
+func (s *Service) Write(stream Cake_WriteServer) error {
+	keys := map[uint32]cakedb.Data{}
+	resp := &WriteResponse{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+		for _, k := range req.Keys {
+			// the points of a device in the files have one value per register of its stored key
+			stored, err := s.engine.ReadKey(cakedb.DeviceId(k.DeviceId))
+			if err == nil && len(stored) != len(k.Key) {
+				return status.Errorf(codes.InvalidArgument, "device %d: key with %d registers for %d stored", k.DeviceId, len(k.Key), len(stored))
+			}
+			if err == nil {
+				k.Key = stored
+			}
+			keys[k.DeviceId] = k.Key
+		}
+		for _, p := range req.Points {
+			key, ok := keys[p.DeviceId]
+			if !ok {
+				key, err = s.engine.ReadKey(cakedb.DeviceId(p.DeviceId))
+				if err != nil {
+					return status.Errorf(codes.FailedPrecondition, "device %d has no key", p.DeviceId)
+				}
+				keys[p.DeviceId] = key
+			}
+			if len(p.Values) != len(key) {
+				return status.Errorf(codes.InvalidArgument, "device %d: %d values for %d registers", p.DeviceId, len(p.Values), len(key))
+			}
+			err := s.engine.Write(key, &cakedb.Point{
+				Data:      p.Values,
+				DeviceId:  cakedb.DeviceId(p.DeviceId),
+				Timestamp: p.Timestamp,
+			})
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			resp.Points++
+		}
+	}
+}
+
+func (s *Service) Query(req *QueryRequest, stream Cake_QueryServer) error {
+	batchSize := int(req.BatchSize)
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	key, points, err := s.engine.ReadStreamContext(stream.Context(), cakedb.DeviceId(req.DeviceId), req.Start, req.End)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "device %d: %v", req.DeviceId, err)
+	}
+	// the read path stops with the context of the stream, drain what it has buffered
+	defer func() {
+		for range points {
+		}
+	}()
+
+	resp := &QueryResponse{Key: key}
+	for p := range points {
+		resp.Points = append(resp.Points, &Point{
+			DeviceId:  uint32(p.DeviceId),
+			Timestamp: p.Timestamp,
+			Values:    p.Data,
+		})
+		if len(resp.Points) >= batchSize {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &QueryResponse{}
+		}
+	}
+	if len(resp.Points) > 0 || resp.Key != nil {
+		return stream.Send(resp)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package grpcapi
+
+import (
+	cakedb "cake-db"
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestService(t *testing.T) {
+	// base is far from the shards the other tests write
+	base := cakedb.ShardSize * 2832
+	engine := cakedb.New()
+	engine.Init()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	RegisterCakeServer(server, NewService(engine))
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.Dial("bufnet", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := NewCakeClient(conn)
+	ctx := context.Background()
+
+	// the generated stubs with the default proto codec of grpc
+	write, err := client.Write(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = write.Send(&WriteRequest{
+		Keys:   []*DeviceKey{{DeviceId: 900132, Key: []int64{30775}}},
+		Points: []*Point{{DeviceId: 900132, Timestamp: base + 1, Values: []int64{5}}, {DeviceId: 900132, Timestamp: base + 2, Values: []int64{6}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := write.CloseAndRecv()
+	if err != nil || resp.Points != 2 {
+		t.Fatalf("write: %v %v", resp, err)
+	}
+
+	err = engine.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := client.Query(ctx, &QueryRequest{DeviceId: 900132, Start: base, End: base + 10, BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []int64
+	for {
+		resp, err := query.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range resp.Points {
+			values = append(values, p.Values...)
+		}
+	}
+	if len(values) != 2 || values[0] != 5 || values[1] != 6 {
+		t.Fatalf("query: %v", values)
+	}
+}
@@ -0,0 +1,184 @@
+package influx
+
+import (
+	cakedb "cake-db"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultBatchSize = 5000
+
+// Handler implements the /api/v2/write endpoint of InfluxDB on top of an Engine.
+// Valid lines are written even if other lines of the body are rejected, like InfluxDB does.
+type Handler struct {
+	engine    *cakedb.Engine
+	mapping   *Mapping
+	BatchSize int
+
+	mu   sync.Mutex
+	keys map[cakedb.DeviceId]cakedb.Data
+}
+
+func NewHandler(engine *cakedb.Engine, mapping *Mapping) *Handler {
+	if mapping == nil {
+		mapping = DefaultMapping()
+	}
+	return &Handler{
+		engine:    engine,
+		mapping:   mapping,
+		BatchSize: DefaultBatchSize,
+		keys:      map[cakedb.DeviceId]cakedb.Data{},
+	}
+}
+
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	kind := "invalid"
+	if code >= 500 {
+		kind = "internal error"
+	}
+	_ = json.NewEncoder(w).Encode(errorResponse{Code: kind, Message: message})
+}
+
+// key returns the key of did, a new device takes the registers of its first line
+func (h *Handler) key(did cakedb.DeviceId, registers cakedb.Data) cakedb.Data {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if key, ok := h.keys[did]; ok {
+		return key
+	}
+	key, err := h.engine.ReadKey(did)
+	if err != nil {
+		key = registers
+	}
+	h.keys[did] = key
+	return key
+}
+
+// point orders the values of a line by the key of its device
+func (h *Handler) point(line *Line) (cakedb.Data, *cakedb.Point, error) {
+	did, registers, values, err := h.mapping.Map(line)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := h.key(did, registers)
+	data := make(cakedb.Data, len(key))
+	j := 0
+	for i, register := range key {
+		for j < len(registers) && registers[j] < register {
+			j++
+		}
+		if j >= len(registers) || registers[j] != register {
+			return nil, nil, errors.NotFoundf("register %d of device %d", register, did)
+		}
+		data[i] = values[j]
+	}
+	if len(registers) != len(key) {
+		return nil, nil, errors.NotValidf("device %d has %d registers, line has %d", did, len(key), len(registers))
+	}
+	timestamp := line.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano()
+	}
+	return key, &cakedb.Point{
+		Data:      data,
+		DeviceId:  did,
+		Timestamp: timestamp,
+	}, nil
+}
+
+type keyPoint struct {
+	key   cakedb.Data
+	point *cakedb.Point
+}
+
+func (h *Handler) write(batch []keyPoint) error {
+	for _, p := range batch {
+		err := h.engine.Write(p.key, p.point)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	precision, err := Precision(r.URL.Query().Get("precision"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	batchSize := h.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	batch := make([]keyPoint, 0, batchSize)
+	var writeErr error
+	lineErrors, err := Parse(body, precision, func(line *Line) error {
+		if writeErr != nil {
+			return writeErr
+		}
+		key, point, err := h.point(line)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, keyPoint{key: key, point: point})
+		if len(batch) >= batchSize {
+			writeErr = h.write(batch)
+			batch = batch[:0]
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if writeErr == nil {
+		writeErr = h.write(batch)
+	}
+	if writeErr != nil {
+		writeError(w, http.StatusInternalServerError, writeErr.Error())
+		return
+	}
+	if len(lineErrors) > 0 {
+		var messages []string
+		for i, e := range lineErrors {
+			if i == 10 {
+				messages = append(messages, fmt.Sprintf("and %d more", len(lineErrors)-i))
+				break
+			}
+			messages = append(messages, fmt.Sprintf("line %d: %v", e.Line, e.Err))
+		}
+		writeError(w, http.StatusBadRequest, "partial write: "+strings.Join(messages, "; "))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package influx
+
+import (
+	cakedb "cake-db"
+	"encoding/json"
+	"github.com/juju/errors"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule maps the lines of a measurement to a device and its registers
+type Rule struct {
+	Measurement string `json:"measurement"` // empty matches every measurement
+	// DeviceTag is the tag holding the numeric device id,
+	// without it the device id is a hash of the measurement and all tags
+	DeviceTag string `json:"device_tag"`
+	// Fields maps field keys to register numbers
+	Fields map[string]int64 `json:"fields"`
+	// FieldPrefix maps the fields not in Fields by stripping the prefix, e.g. r30775 -> 30775
+	FieldPrefix string `json:"field_prefix"`
+	// Scale multiplies float fields before they are rounded to an integer, 0 means 1
+	Scale float64 `json:"scale"`
+}
+
+type Mapping struct {
+	Rules []Rule `json:"rules"`
+}
+
+// DefaultMapping reads the device id from the "device" tag and registers from numeric field keys
+func DefaultMapping() *Mapping {
+	return &Mapping{Rules: []Rule{{DeviceTag: "device"}}}
+}
+
+func LoadMapping(path string) (*Mapping, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapping{}
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		return nil, errors.Annotatef(err, "mapping %s", path)
+	}
+	return m, nil
+}
+
+func (m *Mapping) rule(measurement string) *Rule {
+	for i := range m.Rules {
+		if m.Rules[i].Measurement == "" || m.Rules[i].Measurement == measurement {
+			return &m.Rules[i]
+		}
+	}
+	return nil
+}
+
+func hashDevice(line *Line) cakedb.DeviceId {
+	keys := make([]string, 0, len(line.Tags))
+	for k := range line.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New32a()
+	h.Write([]byte(line.Measurement))
+	for _, k := range keys {
+		h.Write([]byte("," + k + "=" + line.Tags[k]))
+	}
+	return cakedb.DeviceId(h.Sum32())
+}
+
+func (r *Rule) register(field string) (int64, bool) {
+	if register, ok := r.Fields[field]; ok {
+		return register, true
+	}
+	if !strings.HasPrefix(field, r.FieldPrefix) {
+		return 0, false
+	}
+	register, err := strconv.ParseInt(strings.TrimPrefix(field, r.FieldPrefix), 10, 64)
+	return register, err == nil
+}
+
+// value returns the integer value of a field, ok is false for the fields without one
+func (r *Rule) value(field Field) (v int64, ok bool, err error) {
+	switch field.Type {
+	case Integer:
+		return field.Int, true, nil
+	case Unsigned:
+		if field.Uint > math.MaxInt64 {
+			return 0, false, errors.NotValidf("unsigned value %d", field.Uint)
+		}
+		return int64(field.Uint), true, nil
+	case Boolean:
+		if field.Bool {
+			return 1, true, nil
+		}
+		return 0, true, nil
+	case Float:
+		scale := r.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		f := math.Round(field.Float * scale)
+		// -2^63 is the smallest int64, 2^63 is one past the largest
+		if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, false, errors.NotValidf("float value %v scaled by %v", field.Float, scale)
+		}
+		return int64(f), true, nil
+	}
+	return 0, false, nil
+}
+
+// Map returns the device and the registers and values of a line sorted by register,
+// string fields and fields without a register are ignored.
+func (m *Mapping) Map(line *Line) (did cakedb.DeviceId, registers, values cakedb.Data, err error) {
+	rule := m.rule(line.Measurement)
+	if rule == nil {
+		return 0, nil, nil, errors.NotFoundf("rule of measurement %q", line.Measurement)
+	}
+	if rule.DeviceTag != "" {
+		tag, ok := line.Tags[rule.DeviceTag]
+		if !ok {
+			return 0, nil, nil, errors.NotFoundf("device tag %q", rule.DeviceTag)
+		}
+		id, err := strconv.ParseUint(tag, 10, 32)
+		if err != nil {
+			return 0, nil, nil, errors.NotValidf("device %q", tag)
+		}
+		did = cakedb.DeviceId(id)
+	} else {
+		did = hashDevice(line)
+	}
+
+	type register struct {
+		register, value int64
+	}
+	var regs []register
+	for k, field := range line.Fields {
+		r, ok := rule.register(k)
+		if !ok {
+			continue
+		}
+		v, ok, err := rule.value(field)
+		if err != nil {
+			return 0, nil, nil, errors.Annotatef(err, "field %q", k)
+		}
+		if !ok {
+			continue
+		}
+		regs = append(regs, register{register: r, value: v})
+	}
+	if len(regs) == 0 {
+		return 0, nil, nil, errors.NotFoundf("register fields")
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].register < regs[j].register
+	})
+	for _, r := range regs {
+		registers = append(registers, r.register)
+		values = append(values, r.value)
+	}
+	return did, registers, values, nil
+}
@@ -0,0 +1,80 @@
+package influx
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMapping_Map(t *testing.T) {
+	m := &Mapping{Rules: []Rule{
+		{Measurement: "meter", Fields: map[string]int64{"power": 30775}, FieldPrefix: "r", Scale: 10},
+		{DeviceTag: "device"},
+	}}
+
+	line, _ := ParseLine(`inverter,device=7 30813=2i,30775=1.6,on=t,name="x",other=1`, 1)
+	did, registers, values, err := m.Map(line)
+	if err != nil || did != 7 || fmt.Sprint(registers, values) != "[30775 30813] [2 2]" {
+		t.Fatalf("inverter: %d %v %v %v", did, registers, values, err)
+	}
+
+	// without a device tag the id is a hash of the measurement and the tags, whatever their order
+	a, _ := ParseLine(`meter,site=a,phase=1 power=1.26,r30813=3u`, 1)
+	b, _ := ParseLine(`meter,phase=1,site=a power=1`, 1)
+	c, _ := ParseLine(`meter,phase=2,site=a power=1`, 1)
+	did, registers, values, err = m.Map(a)
+	if err != nil || did != hashDevice(b) || did == hashDevice(c) || fmt.Sprint(registers, values) != "[30775 30813] [13 3]" {
+		t.Fatalf("meter: %d %v %v %v", did, registers, values, err)
+	}
+
+	for line, want := range map[string]string{
+		`inverter 30775=1i`:                            "not found",
+		`inverter,device=x 30775=1i`:                   "not valid",
+		`inverter,device=4294967296 30775=1i`:          "not valid",
+		`inverter,device=1 name="x"`:                   "not found",
+		`inverter,device=1 30775=9223372036854775808u`: "not valid",
+		`inverter,device=1 30775=9.3e18`:               "not valid",
+		`inverter,device=1 30775=-9.3e18`:              "not valid",
+		`meter power=1e18`:                             "not valid",
+	} {
+		l, err := ParseLine(line, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		_, _, _, err = m.Map(l)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+
+	empty := &Mapping{Rules: []Rule{{Measurement: "meter"}}}
+	if _, _, _, err := empty.Map(line); err == nil {
+		t.Fatal("measurement without a rule")
+	}
+}
+
+func TestRule_Value(t *testing.T) {
+	r := &Rule{}
+	for _, c := range []struct {
+		field Field
+		want  int64
+	}{
+		{Field{Type: Float, Float: -2.5}, -3},
+		{Field{Type: Float, Float: math.MinInt64}, math.MinInt64},
+		{Field{Type: Unsigned, Uint: math.MaxInt64}, math.MaxInt64},
+		{Field{Type: Integer, Int: math.MinInt64}, math.MinInt64},
+		{Field{Type: Boolean, Bool: true}, 1},
+	} {
+		v, ok, err := r.value(c.field)
+		if err != nil || !ok || v != c.want {
+			t.Fatalf("%+v: %d %v %v", c.field, v, ok, err)
+		}
+	}
+	if _, ok, err := r.value(Field{Type: String, Str: "x"}); ok || err != nil {
+		t.Fatal("string field")
+	}
+	if _, _, err := r.value(Field{Type: Float, Float: math.NaN()}); err == nil {
+		t.Fatal("NaN field")
+	}
+}
@@ -0,0 +1,209 @@
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/juju/errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FieldType int
+
+const (
+	Float FieldType = iota
+	Integer
+	Unsigned
+	Boolean
+	String
+)
+
+type Field struct {
+	Type  FieldType
+	Float float64
+	Int   int64
+	Uint  uint64
+	Bool  bool
+	Str   string
+}
+
+// Line is one point of the InfluxDB line protocol
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+type Line struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]Field
+	Timestamp   int64 // nanoseconds, 0 if the line has no timestamp
+}
+
+// Precision returns the multiplier of a precision parameter of the write api
+func Precision(s string) (int64, error) {
+	switch s {
+	case "", "ns", "n":
+		return int64(time.Nanosecond), nil
+	case "us", "u":
+		return int64(time.Microsecond), nil
+	case "ms":
+		return int64(time.Millisecond), nil
+	case "s":
+		return int64(time.Second), nil
+	}
+	return 0, errors.NotValidf("precision %q", s)
+}
+
+// scan reads s from i until one of the unescaped stop bytes and returns the unescaped token
+func scan(s string, i int, stops string) (string, int) {
+	var b strings.Builder
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && strings.IndexByte(stops+"\\", s[i+1]) >= 0 {
+			b.WriteByte(s[i+1])
+			i++
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), i
+}
+
+func parseField(s string) (Field, error) {
+	switch {
+	case s == "":
+		return Field{}, errors.NotValidf("empty field value")
+	case s == "t" || s == "T" || s == "true" || s == "True" || s == "TRUE":
+		return Field{Type: Boolean, Bool: true}, nil
+	case s == "f" || s == "F" || s == "false" || s == "False" || s == "FALSE":
+		return Field{Type: Boolean}, nil
+	case strings.HasSuffix(s, "i"):
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return Field{}, errors.NotValidf("integer field %q", s)
+		}
+		return Field{Type: Integer, Int: v}, nil
+	case strings.HasSuffix(s, "u"):
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return Field{}, errors.NotValidf("unsigned field %q", s)
+		}
+		return Field{Type: Unsigned, Uint: v}, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	// NaN and infinities are not part of the line protocol and have no integer value
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return Field{}, errors.NotValidf("float field %q", s)
+	}
+	return Field{Type: Float, Float: v}, nil
+}
+
+// ParseLine parses one line, precision is the multiplier of the timestamp to nanoseconds
+func ParseLine(s string, precision int64) (*Line, error) {
+	line := &Line{
+		Tags:   map[string]string{},
+		Fields: map[string]Field{},
+	}
+
+	// measurement and tags
+	var i int
+	line.Measurement, i = scan(s, 0, ", ")
+	if line.Measurement == "" {
+		return nil, errors.NotValidf("missing measurement")
+	}
+	for i < len(s) && s[i] == ',' {
+		var key, value string
+		key, i = scan(s, i+1, ",= ")
+		if i >= len(s) || s[i] != '=' || key == "" {
+			return nil, errors.NotValidf("tag %q", key)
+		}
+		value, i = scan(s, i+1, ", ")
+		if value == "" {
+			return nil, errors.NotValidf("tag %q value", key)
+		}
+		line.Tags[key] = value
+	}
+
+	// fields
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	for {
+		var key string
+		key, i = scan(s, i, ",= ")
+		if i >= len(s) || s[i] != '=' || key == "" {
+			return nil, errors.NotValidf("field %q", key)
+		}
+		i++
+		if i < len(s) && s[i] == '"' {
+			var b strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.NotValidf("unterminated string field %q", key)
+			}
+			i++
+			line.Fields[key] = Field{Type: String, Str: b.String()}
+		} else {
+			var value string
+			value, i = scan(s, i, ", ")
+			field, err := parseField(value)
+			if err != nil {
+				return nil, errors.Annotatef(err, "field %q", key)
+			}
+			line.Fields[key] = field
+		}
+		if i >= len(s) || s[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	// timestamp
+	rest := strings.TrimSpace(s[i:])
+	if rest != "" {
+		timestamp, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, errors.NotValidf("timestamp %q", rest)
+		}
+		line.Timestamp = timestamp * precision
+	}
+	return line, nil
+}
+
+// LineError is the error of one line of a body
+type LineError struct {
+	Line int
+	Err  error
+}
+
+// Parse calls fn for every valid line of r and collects the errors of the invalid lines
+func Parse(r io.Reader, precision int64, fn func(line *Line) error) ([]LineError, error) {
+	var lineErrors []LineError
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		line, err := ParseLine(string(text), precision)
+		if err == nil {
+			err = fn(line)
+		}
+		if err != nil {
+			lineErrors = append(lineErrors, LineError{Line: n, Err: err})
+		}
+	}
+	return lineErrors, scanner.Err()
+}
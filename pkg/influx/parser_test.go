@@ -0,0 +1,76 @@
+package influx
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	for _, c := range []struct {
+		line, want string
+	}{
+		{`inverter,device=1 30775=1200i,30813=-5i 1684168368`, `inverter map[device:1] map[30775:{1 0 1200 0 false } 30813:{1 0 -5 0 false }] 1684168368000000000`},
+		{`inverter p=1.5,u=7u,on=t,off=FALSE,s="a \"b\" c"`, `inverter map[] map[off:{3 0 0 0 false } on:{3 0 0 0 true } p:{0 1.5 0 0 false } s:{4 0 0 0 false a "b" c} u:{2 0 0 7 false }] 0`},
+		{`my\ meter,site\=id=a\,b\ c v=-1e3 5`, `my meter map[site=id:a,b c] map[v:{0 -1000 0 0 false }] 5000000000`},
+		{`m v=1  `, `m map[] map[v:{0 1 0 0 false }] 0`},
+	} {
+		line, err := ParseLine(c.line, 1e9)
+		if err != nil {
+			t.Fatalf("%s: %v", c.line, err)
+		}
+		got := fmt.Sprint(line.Measurement, " ", line.Tags, " ", line.Fields, " ", line.Timestamp)
+		if got != c.want {
+			t.Fatalf("%s: %s", c.line, got)
+		}
+	}
+
+	for _, line := range []string{
+		``,
+		`m`,
+		`,t=1 v=1`,
+		`m,t v=1`,
+		`m,t= v=1`,
+		`m v=`,
+		`m =1`,
+		`m v="open`,
+		`m v=1x`,
+		`m v=99999999999999999999i`,
+		`m v=-1u`,
+		`m v=NaN`,
+		`m v=nan`,
+		`m v=Inf`,
+		`m v=-Infinity`,
+		`m v=1e400`,
+		`m v=1 now`,
+	} {
+		if _, err := ParseLine(line, 1); err == nil {
+			t.Fatalf("%q: no error", line)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	body := "# comment\nm v=1 1\n\nm v=NaN 2\n  m v=3 3  \nm v=4 x\n"
+	var got []int64
+	lineErrors, err := Parse(strings.NewReader(body), 1, func(line *Line) error {
+		got = append(got, line.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[1 3]" || len(lineErrors) != 2 || lineErrors[0].Line != 4 || lineErrors[1].Line != 6 {
+		t.Fatalf("lines %v, errors %v", got, lineErrors)
+	}
+
+	for s, want := range map[string]int64{"": 1, "ns": 1, "us": 1e3, "ms": 1e6, "s": 1e9} {
+		p, err := Precision(s)
+		if err != nil || p != want {
+			t.Fatalf("precision %q: %d %v", s, p, err)
+		}
+	}
+	if _, err := Precision("h"); err == nil {
+		t.Fatal("precision h")
+	}
+}
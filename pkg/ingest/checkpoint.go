@@ -0,0 +1,70 @@
+package ingest
+
+import (
+	dumpservice "cake-db/pkg/dumperservice"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// LoadCheckpoint reads the position saved by SaveCheckpoint, ok is false if there is none yet
+func LoadCheckpoint(path string) (position dumpservice.SolarDumpService, ok bool, err error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return position, false, nil
+	}
+	if err != nil {
+		return position, false, err
+	}
+	err = json.Unmarshal(buf, &position)
+	if err != nil {
+		return position, false, err
+	}
+	return position, true, nil
+}
+
+// SaveCheckpoint replaces the checkpoint atomically, a crash leaves either the old or the new one
+func SaveCheckpoint(path string, position dumpservice.SolarDumpService) error {
+	buf, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	// the rename is durable once the directory is synced
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err1 := dir.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
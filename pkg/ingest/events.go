@@ -0,0 +1,62 @@
+package ingest
+
+import (
+	"cake-db/pkg/analyzer"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventSink stores the events of devices, Sync makes the events written so far durable
+type EventSink interface {
+	WriteEvent(deviceId int, at time.Time, event analyzer.Event) error
+	Sync() error
+}
+
+// EventLog appends events as JSON lines to a file, it is shared by the pipelines of a Group.
+// A pipeline resuming from its checkpoint analyzes the messages after it again, so the events
+// written between the last checkpoint and a crash are appended a second time.
+type EventLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+type eventLine struct {
+	DeviceId int   `json:"device_id"`
+	Time     int64 `json:"time"`
+	analyzer.Event
+}
+
+func OpenEventLog(path string) (*EventLog, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLog{file: file}, nil
+}
+
+// WriteEvent appends event, time is in unix ms
+func (l *EventLog) WriteEvent(deviceId int, at time.Time, event analyzer.Event) error {
+	buf, err := json.Marshal(eventLine{DeviceId: deviceId, Time: at.UnixMilli(), Event: event})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(buf, '\n'))
+	return err
+}
+
+func (l *EventLog) Sync() error {
+	return l.file.Sync()
+}
+
+func (l *EventLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,113 @@
+package ingest
+
+import (
+	cakedb "cake-db"
+	"cake-db/pkg/analyzer"
+	dumpservice "cake-db/pkg/dumperservice"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// CheckpointPath is the checkpoint file of a partition in dir
+func CheckpointPath(dir, topic string, part int32) string {
+	return fmt.Sprintf("%s/%s-%d.json", dir, topic, part)
+}
+
+// Group runs a Pipeline for every partition of a topic into one Engine.
+//
+// Every partition resumes from its own checkpoint, a new partition starts at its first file or at Since.
+// The pipelines share the write buffer of the Engine and pause while it is filled
+// beyond MaxPending, so the partitions consume as fast as the Engine accepts points.
+// The commits of the pipelines share the flushes of the Engine.
+type Group struct {
+	engine        *cakedb.Engine
+	group         *dumpservice.Group
+	flusher       *flusher
+	analyzer      analyzer.Analyzer
+	checkpointDir string
+
+	DiscoverInterval time.Duration
+	// Since is the time a partition without a checkpoint starts from, zero is its first file
+	Since time.Time
+	// Configure is called with the Pipeline of every partition before it runs
+	Configure func(p *Pipeline)
+}
+
+func NewGroup(engine *cakedb.Engine, prefix, topic string, a analyzer.Analyzer, checkpointDir string) *Group {
+	return &Group{
+		engine:           engine,
+		group:            dumpservice.NewGroup(prefix, topic),
+		flusher:          &flusher{flush: engine.Flush},
+		analyzer:         a,
+		checkpointDir:    checkpointDir,
+		DiscoverInterval: dumpservice.DefaultDiscoverInterval,
+	}
+}
+
+func (g *Group) consume(ctx context.Context, part int32) error {
+	checkpoint := CheckpointPath(g.checkpointDir, g.group.Topic, part)
+	position, ok, err := LoadCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		position = dumpservice.SolarDumpService{
+			Prefix: g.group.Prefix,
+			Topic:  g.group.Topic,
+			Part:   part,
+		}
+	}
+	service := dumpservice.NewService(position)
+	if !ok && !g.Since.IsZero() {
+		position, err = service.SeekToTime(g.Since)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("partition %02d from %+v", part, position)
+	pipeline := NewPipeline(g.engine, service, g.analyzer, checkpoint)
+	pipeline.flush = g.flusher.Flush
+	if g.Configure != nil {
+		g.Configure(pipeline)
+	}
+	return pipeline.Run(ctx)
+}
+
+// Run consumes every partition until ctx is done or a pipeline fails
+func (g *Group) Run(ctx context.Context) error {
+	g.group.DiscoverInterval = g.DiscoverInterval
+	return g.group.Run(ctx, g.consume)
+}
+
+// flusher shares Engine.Flush between pipelines. Flush returns once a flush that started after
+// it was called is done, so the commits that wait for a running flush are served by one flush.
+type flusher struct {
+	flush func() error
+
+	mu      sync.Mutex // held while flushing
+	started sync.Mutex
+	count   int
+	err     error
+}
+
+func (f *flusher) Flush() error {
+	f.started.Lock()
+	asked := f.count
+	f.started.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started.Lock()
+	if f.count > asked {
+		// a flush started after the call and is done
+		f.started.Unlock()
+		return f.err
+	}
+	f.count++
+	f.started.Unlock()
+	f.err = f.flush()
+	return f.err
+}
@@ -0,0 +1,228 @@
+package ingest
+
+import (
+	cakedb "cake-db"
+	"cake-db/pkg/analyzer"
+	dumpservice "cake-db/pkg/dumperservice"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlusher(t *testing.T) {
+	entered := make(chan struct{})
+	results := make(chan error, 2)
+	count := 0
+	f := &flusher{flush: func() error {
+		count++
+		entered <- struct{}{}
+		return <-results
+	}}
+
+	first := make(chan error)
+	go func() {
+		first <- f.Flush()
+	}()
+	<-entered
+
+	// the commits that arrive during a flush may have written after it started, they share the next one
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f.Flush()
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	results <- nil
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	results <- errors.New("disk full")
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil || err.Error() != "disk full" {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	if count != 2 {
+		t.Fatalf("%d flushes", count)
+	}
+}
+
+type countAnalyzer struct {
+	calls int
+}
+
+func (a *countAnalyzer) Analyze(analyzer.Message) ([]analyzer.Record, error) {
+	a.calls++
+	return nil, nil
+}
+
+func TestPipeline_Backpressure(t *testing.T) {
+	pos := dumpservice.SolarDumpService{Prefix: t.TempDir(), Topic: "topic"}
+	w := dumpservice.NewWriter(pos)
+	for i := 0; i < 2; i++ {
+		err := w.Write(dumpservice.Message{DeviceId: 900043, Time: i, Data: []byte("{}")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	end := w.Position()
+	w.Close()
+
+	// without Init nothing takes the points off the write buffer
+	engine := cakedb.New()
+	for i := 0; i < 3; i++ {
+		err := engine.Write(cakedb.Data{1}, &cakedb.Point{DeviceId: 900043, Timestamp: int64(i + 1), Data: cakedb.Data{int64(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := &countAnalyzer{}
+	checkpoint := t.TempDir() + "/topic-0.json"
+	p := NewPipeline(engine, dumpservice.NewService(pos), a, checkpoint)
+	p.PollInterval = 10 * time.Millisecond
+	flushes := 0
+	p.flush = func() error {
+		flushes++
+		return nil
+	}
+	run := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := p.Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p.MaxPending = 2
+	run()
+	position, ok, err := LoadCheckpoint(checkpoint)
+	if a.calls != 0 || !ok || err != nil || position != pos || flushes != 1 {
+		t.Fatalf("paused: %d calls, %+v %v %v, %d flushes", a.calls, position, ok, err, flushes)
+	}
+
+	p.MaxPending = 3
+	run()
+	position, ok, err = LoadCheckpoint(checkpoint)
+	if a.calls != 2 || !ok || err != nil || position != end {
+		t.Fatalf("resumed: %d calls, %+v != %+v %v %v", a.calls, position, end, ok, err)
+	}
+}
+
+type rejectAnalyzer struct{}
+
+func (rejectAnalyzer) Analyze(m analyzer.Message) ([]analyzer.Record, error) {
+	if string(m.Bytes) == "bad" {
+		return nil, errors.New("still bad")
+	}
+	return nil, nil
+}
+
+func TestPipeline_Replay(t *testing.T) {
+	engine := cakedb.New()
+	for _, data := range []string{"bad", "good"} {
+		id, err := engine.AddDeadLetter(cakedb.DeadLetter{DeviceId: 900049, Kind: DeadLetterInvalid, Data: []byte(data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer engine.DeleteDeadLetter(id)
+	}
+	p := NewPipeline(engine, nil, rejectAnalyzer{}, "")
+	flushErr := errors.New("disk full")
+	p.flush = func() error {
+		return flushErr
+	}
+	q := cakedb.DeadLetterQuery{DeviceId: 900049}
+
+	// the accepted letter stays until its points are flushed
+	replayed, rejected, err := p.Replay(q)
+	letters, _ := engine.DeadLetters(q)
+	if err != flushErr || replayed != 0 || rejected != 1 || len(letters) != 2 {
+		t.Fatalf("failed flush: %d %d %v %v", replayed, rejected, err, letters)
+	}
+	flushErr = nil
+	replayed, rejected, err = p.Replay(q)
+	letters, _ = engine.DeadLetters(q)
+	if err != nil || replayed != 1 || rejected != 1 || len(letters) != 1 || letters[0].Reason != "still bad" || letters[0].Attempts != 2 {
+		t.Fatalf("replay: %d %d %v %v", replayed, rejected, err, letters)
+	}
+}
+
+type seriesAnalyzer struct{ start int64 }
+
+func (a seriesAnalyzer) Analyze(m analyzer.Message) ([]analyzer.Record, error) {
+	return []analyzer.Record{{
+		DeviceId:  m.DeviceId,
+		UpdatedAt: time.Unix(0, a.start+m.CreatedAt.UnixMilli()),
+		Data:      analyzer.Series{DeviceId: m.DeviceId, Registers: []int64{1}, Values: []int64{m.CreatedAt.UnixMilli()}},
+	}}, nil
+}
+
+func TestPipeline_Backfill(t *testing.T) {
+	pos := dumpservice.SolarDumpService{Prefix: t.TempDir(), Topic: "topic"}
+	w := dumpservice.NewWriter(pos)
+	for i := 0; i < 2; i++ {
+		err := w.Write(dumpservice.Message{DeviceId: 900150, Time: i, Data: []byte("{}")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	engine := cakedb.New()
+	shardId := int64(5150)
+	defer os.RemoveAll(filepath.Join(cakedb.ValuePath, strconv.FormatInt(cakedb.ShardSize, 10), strconv.FormatInt(shardId, 10)))
+	checkpoint := t.TempDir() + "/topic-0.json"
+	p := NewPipeline(engine, dumpservice.NewService(pos), seriesAnalyzer{start: shardId * cakedb.ShardSize}, checkpoint)
+	p.Backfill = true
+	p.CheckpointInterval = 0
+	p.PollInterval = 10 * time.Millisecond
+	flushes := 0
+	p.flush = func() error {
+		flushes++
+		return nil
+	}
+
+	// the checkpoints wait for the backfill to fill up, Run writes it once before it returns
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := p.Run(ctx)
+	if err != nil || flushes != 1 || p.backfill != nil {
+		t.Fatalf("run: %v, %d flushes", err, flushes)
+	}
+	_, values, err := engine.Read(900150, shardId*cakedb.ShardSize, (shardId+1)*cakedb.ShardSize)
+	if err != nil || len(values) != 2 {
+		t.Fatalf("read: %v %v", values, err)
+	}
+}
+
+func TestPipeline_Mismatch(t *testing.T) {
+	engine := cakedb.New()
+	err := engine.Write(cakedb.Data{2}, &cakedb.Point{Data: cakedb.Data{0}, DeviceId: 900141, Timestamp: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPipeline(engine, nil, seriesAnalyzer{}, "")
+
+	// the key of the device has register 2, the series register 1
+	err = p.write(dumpservice.Message{DeviceId: 900141, Time: 5, Data: []byte("{}")})
+	letters, _ := engine.DeadLetters(cakedb.DeadLetterQuery{DeviceId: 900141})
+	for _, l := range letters {
+		defer engine.DeleteDeadLetter(l.Id)
+	}
+	if err != nil || p.written != 0 || p.skipped != 1 || len(letters) != 1 || letters[0].Kind != DeadLetterInvalid {
+		t.Fatalf("%v: %d written, %d skipped, %v", err, p.written, p.skipped, letters)
+	}
+}
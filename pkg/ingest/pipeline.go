@@ -0,0 +1,372 @@
+package ingest
+
+import (
+	cakedb "cake-db"
+	"cake-db/pkg/analyzer"
+	dumpservice "cake-db/pkg/dumperservice"
+	"context"
+	"encoding/json"
+	"github.com/juju/errors"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultCheckpointInterval = 10 * time.Second
+	DefaultPollInterval       = time.Second
+	// DefaultMaxPending is half of the write buffer of the Engine
+	DefaultMaxPending = 500000
+	// DefaultBackfillCommitSize is a quarter of the size at which a Backfill writes its largest shard
+	DefaultBackfillCommitSize = cakedb.DefaultBackfillSize / 4
+)
+
+// Pipeline feeds the messages of a dump service through an analyzer into an Engine.
+//
+// The position of the service is saved only after Engine.Flush returned, so a restart
+// from the checkpoint writes every point at least once; rewriting a point is harmless
+// because the newest version of a timestamp wins.
+type Pipeline struct {
+	engine     *cakedb.Engine
+	service    *dumpservice.Service
+	analyzer   analyzer.Analyzer
+	checkpoint string
+
+	CheckpointInterval time.Duration
+	PollInterval       time.Duration
+	// Events receives the events of the analyzer, without it they are dropped
+	Events EventSink
+	// DeadLetters stores the messages the analyzer rejects in the Engine
+	DeadLetters bool
+	// MaxPending pauses fetching while more points wait for the Engine, 0 disables it
+	MaxPending int
+	// Backfill writes the points through an Engine.Backfill that stays open until Run returns, for
+	// catching up on old dumps without the acceptance window and without a small file per shard and flush
+	Backfill bool
+	// BackfillCommitSize holds the checkpoints of Run back until the backfill buffers that many bytes,
+	// so that a checkpoint does not write a small file per shard
+	BackfillCommitSize int
+
+	// flush is Engine.Flush or the one a Group shares between its pipelines
+	flush    func() error
+	backfill *cakedb.Backfill
+	keys     map[cakedb.DeviceId]cakedb.Data
+	written  int
+	skipped  int
+}
+
+func NewPipeline(engine *cakedb.Engine, service *dumpservice.Service, a analyzer.Analyzer, checkpoint string) *Pipeline {
+	return &Pipeline{
+		engine:             engine,
+		service:            service,
+		analyzer:           a,
+		checkpoint:         checkpoint,
+		CheckpointInterval: DefaultCheckpointInterval,
+		PollInterval:       DefaultPollInterval,
+		MaxPending:         DefaultMaxPending,
+		BackfillCommitSize: DefaultBackfillCommitSize,
+		DeadLetters:        true,
+		flush:              engine.Flush,
+		keys:               map[cakedb.DeviceId]cakedb.Data{},
+	}
+}
+
+// Point converts the registers of a SolarData record or a Series, ok is false for other records
+func Point(record analyzer.Record) (registers cakedb.Data, point *cakedb.Point, ok bool) {
+	if series, ok := record.Data.(analyzer.Series); ok {
+		return seriesPoint(record, series)
+	}
+	if record.MsgType != analyzer.MsgTypeSolarData {
+		return nil, nil, false
+	}
+	m, ok := record.Data.(analyzer.SolarMessage)
+	if !ok {
+		return nil, nil, false
+	}
+	if _, ok := m.Data.(map[string]any); !ok {
+		return nil, nil, false
+	}
+	data := m.GetSolarData()
+	if data == nil || len(data.Regs) == 0 {
+		return nil, nil, false
+	}
+	regs := make([][]int, 0, len(data.Regs))
+	for _, reg := range data.Regs {
+		if len(reg) >= 2 {
+			regs = append(regs, reg)
+		}
+	}
+	sort.SliceStable(regs, func(i, j int) bool {
+		return regs[i][0] < regs[j][0]
+	})
+	var values cakedb.Data
+	for _, reg := range regs {
+		registers = append(registers, int64(reg[0]))
+		values = append(values, int64(reg[1]))
+	}
+	return registers, &cakedb.Point{
+		Data:      values,
+		DeviceId:  cakedb.DeviceId(record.DeviceId),
+		Timestamp: record.UpdatedAt.UnixNano(),
+	}, len(registers) > 0
+}
+
+func seriesPoint(record analyzer.Record, series analyzer.Series) (cakedb.Data, *cakedb.Point, bool) {
+	if len(series.Registers) == 0 || len(series.Registers) != len(series.Values) {
+		return nil, nil, false
+	}
+	order := make([]int, len(series.Registers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return series.Registers[order[i]] < series.Registers[order[j]]
+	})
+	registers := make(cakedb.Data, len(order))
+	values := make(cakedb.Data, len(order))
+	for i, j := range order {
+		registers[i] = series.Registers[j]
+		values[i] = series.Values[j]
+	}
+	return registers, &cakedb.Point{
+		Data:      values,
+		DeviceId:  cakedb.DeviceId(series.DeviceId),
+		Timestamp: record.UpdatedAt.UnixNano(),
+	}, true
+}
+
+// key returns the key of a device, a new device takes the registers of its first point
+func (p *Pipeline) key(did cakedb.DeviceId, registers cakedb.Data) cakedb.Data {
+	if key, ok := p.keys[did]; ok {
+		return key
+	}
+	key, err := p.engine.ReadKey(did)
+	if err != nil {
+		key = registers
+	}
+	p.keys[did] = key
+	return key
+}
+
+// align orders the values of a point by the key of its device, it fails if a register is missing
+func align(key, registers cakedb.Data, point *cakedb.Point) bool {
+	data := make(cakedb.Data, len(key))
+	j := 0
+	for i, register := range key {
+		for j < len(registers) && registers[j] < register {
+			j++
+		}
+		if j >= len(registers) || registers[j] != register {
+			return false
+		}
+		data[i] = point.Data[j]
+	}
+	point.Data = data
+	return true
+}
+
+// kinds of dead letters
+const (
+	DeadLetterTimeout = "timeout"
+	DeadLetterInvalid = "invalid"
+)
+
+func (p *Pipeline) write(msg dumpservice.Message) error {
+	rejected, err := p.process(msg)
+	if err != nil || rejected == nil {
+		return err
+	}
+	p.skipped++
+	if !p.DeadLetters {
+		return nil
+	}
+	kind := DeadLetterInvalid
+	if errors.Is(rejected, errors.Timeout) {
+		kind = DeadLetterTimeout
+	}
+	position, err := json.Marshal(msg.Position)
+	if err != nil {
+		return err
+	}
+	_, err = p.engine.AddDeadLetter(cakedb.DeadLetter{
+		DeviceId:  cakedb.DeviceId(msg.DeviceId),
+		Kind:      kind,
+		Reason:    rejected.Error(),
+		Position:  position,
+		Offset:    int64(msg.Offset),
+		CreatedAt: int64(msg.Time),
+		Data:      msg.Data,
+	})
+	return err
+}
+
+// process writes the records of msg, rejected is the error of the analyzer if it rejected msg,
+// or the mismatch of a point whose registers are not those of its device. The other points of
+// such a message are written, a replay writes them again.
+func (p *Pipeline) process(msg dumpservice.Message) (rejected error, err error) {
+	records, rejected := p.analyzer.Analyze(analyzer.Message{
+		Offset:    msg.Offset,
+		CreatedAt: time.UnixMilli(int64(msg.Time)),
+		DeviceId:  msg.DeviceId,
+		Bytes:     msg.Data,
+		Length:    msg.Len,
+	})
+	if rejected != nil {
+		return rejected, nil
+	}
+	for _, record := range records {
+		if attrs := analyzer.Attributes(record); len(attrs) > 0 {
+			err := p.engine.SetAttributes(cakedb.DeviceId(record.DeviceId), record.UpdatedAt.UnixNano(), attrs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if event, ok := record.Data.(analyzer.Event); ok {
+			if p.Events != nil {
+				err := p.Events.WriteEvent(record.DeviceId, record.UpdatedAt, event)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		registers, point, ok := Point(record)
+		if !ok {
+			continue
+		}
+		key := p.key(point.DeviceId, registers)
+		if !align(key, registers, point) {
+			if rejected == nil {
+				rejected = errors.NotValidf("registers %v of device %d for its key %v", registers, point.DeviceId, key)
+			}
+			continue
+		}
+		err := p.writePoint(key, point)
+		if err != nil {
+			return nil, err
+		}
+		p.written++
+	}
+	return rejected, nil
+}
+
+// writePoint writes through the open backfill with Backfill, a negative timestamp still goes
+// to the Engine so that it ends up in the quarantine
+func (p *Pipeline) writePoint(key cakedb.Data, point *cakedb.Point) error {
+	if !p.Backfill || point.Timestamp < 0 {
+		return p.engine.Write(key, point)
+	}
+	if p.backfill == nil {
+		p.backfill = p.engine.Backfill()
+	}
+	return p.backfill.Write(key, point)
+}
+
+// Replay runs the dead letters matching q through the analyzer again, the ones it accepts
+// are written and removed from the store once their points are flushed.
+// A failed write stops the replay and leaves the letters that were not rejected in the store.
+func (p *Pipeline) Replay(q cakedb.DeadLetterQuery) (replayed, rejected int, err error) {
+	replayed, rejected, err = p.engine.ReplayDeadLetters(q, func(l cakedb.DeadLetter) (error, error) {
+		return p.process(dumpservice.Message{
+			Len:      len(l.Data),
+			DeviceId: int(l.DeviceId),
+			Offset:   int(l.Offset),
+			Time:     int(l.CreatedAt),
+			Data:     l.Data,
+		})
+	}, p.persist)
+	// the points of a replay that stopped before persist are dropped, their letters stay in the store
+	p.discardBackfill()
+	return replayed, rejected, err
+}
+
+// persist writes the backfill without closing it and flushes the Engine,
+// every point written before is in the files after it
+func (p *Pipeline) persist() error {
+	if p.backfill != nil {
+		err := p.backfill.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return p.flush()
+}
+
+// discardBackfill releases the shards of the backfill, the points it still buffers are not committed
+func (p *Pipeline) discardBackfill() {
+	if p.backfill != nil {
+		p.backfill.Discard()
+		p.backfill = nil
+	}
+}
+
+// committable tells if the backfill buffers enough to be written by a checkpoint of Run
+func (p *Pipeline) committable() bool {
+	return p.backfill == nil || p.backfill.Size() >= p.BackfillCommitSize
+}
+
+// Commit persists every written point and then saves the position of the service
+func (p *Pipeline) Commit() error {
+	// the checkpoint must not move past points that are not in the files
+	err := p.persist()
+	if err != nil {
+		return err
+	}
+	if p.Events != nil {
+		err := p.Events.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	position := p.service.LastCommit()
+	err = SaveCheckpoint(p.checkpoint, position)
+	if err != nil {
+		return err
+	}
+	log.Printf("checkpoint %+v written %d skipped %d", position, p.written, p.skipped)
+	return nil
+}
+
+// Run consumes the service until ctx is done and commits before it returns,
+// the points that are not committed when it fails are read again from the checkpoint
+func (p *Pipeline) Run(ctx context.Context) error {
+	defer p.discardBackfill()
+	lastCommit := time.Now()
+	saved := p.service.LastCommit()
+	for ctx.Err() == nil {
+		if p.MaxPending > 0 && p.engine.Pending() > p.MaxPending {
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.PollInterval / 10):
+			}
+			continue
+		}
+		messages, err := p.service.FetchMessage()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, msg := range messages {
+			err := p.write(msg)
+			if err != nil {
+				return err
+			}
+		}
+		// the position also moves on without messages when the service opens the next file
+		if p.service.LastCommit() != saved && time.Since(lastCommit) >= p.CheckpointInterval && p.committable() {
+			saved = p.service.LastCommit()
+			err := p.Commit()
+			if err != nil {
+				return err
+			}
+			lastCommit = time.Now()
+		}
+		if len(messages) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.PollInterval):
+			}
+		}
+	}
+	return p.Commit()
+}
@@ -0,0 +1,241 @@
+package prometheus
+
+import (
+	cakedb "cake-db"
+	"encoding/json"
+	"github.com/golang/snappy"
+	"github.com/juju/errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	MetricName           = "__name__"
+	DefaultRegisterLabel = "register"
+	DefaultScale         = 1000
+	// StaleNaN is the bits of the NaN prometheus writes as a stale marker
+	StaleNaN = 0x7ff0000000000002
+)
+
+// Config maps the series of prometheus to devices and registers.
+//
+// Every series is a device of its own with a key of one register, because remote_write
+// spreads the series of a scrape over concurrent requests.
+type Config struct {
+	// Registers maps metric names to register numbers
+	Registers map[string]int64 `json:"registers"`
+	// RegisterLabel holds the register number of metrics not in Registers
+	RegisterLabel string `json:"register_label"`
+	// Scale multiplies sample values before they are rounded to an integer, 0 means DefaultScale
+	Scale float64 `json:"scale"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{RegisterLabel: DefaultRegisterLabel, Scale: DefaultScale}
+}
+
+func LoadConfig(path string) (*Config, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := DefaultConfig()
+	err = json.Unmarshal(buf, c)
+	if err != nil {
+		return nil, errors.Annotatef(err, "prometheus config %s", path)
+	}
+	return c, nil
+}
+
+func (c *Config) scale() float64 {
+	if c.Scale == 0 {
+		return DefaultScale
+	}
+	return c.Scale
+}
+
+// value returns the integer of a sample value, it fails for NaN, infinities and values out of
+// the range of an int64 once scaled
+func (c *Config) value(v float64) (int64, error) {
+	scale := c.scale()
+	f := math.Round(v * scale)
+	// -2^63 is the smallest int64, 2^63 is one past the largest
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, errors.NotValidf("sample value %v scaled by %v", v, scale)
+	}
+	return int64(f), nil
+}
+
+func (c *Config) register(labels []Label) int64 {
+	for _, l := range labels {
+		if l.Name == MetricName {
+			if register, ok := c.Registers[l.Value]; ok {
+				return register
+			}
+		}
+	}
+	for _, l := range labels {
+		if l.Name == c.RegisterLabel {
+			if register, err := strconv.ParseInt(l.Value, 10, 64); err == nil {
+				return register
+			}
+		}
+	}
+	return 0
+}
+
+type Handler struct {
+	engine *cakedb.Engine
+	index  *Index
+	config *Config
+}
+
+func NewHandler(engine *cakedb.Engine, index *Index, config *Config) *Handler {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &Handler{
+		engine: engine,
+		index:  index,
+		config: config,
+	}
+}
+
+func readSnappy(r *http.Request) ([]byte, error) {
+	if r.Method != http.MethodPost {
+		return nil, errors.MethodNotAllowedf("%s", r.Method)
+	}
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, errors.BadRequestf("snappy: %v", err)
+	}
+	return buf, nil
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, errors.BadRequest) || errors.Is(err, errors.NotValid) || errors.Is(err, errors.NotSupported) {
+		code = http.StatusBadRequest
+	} else if errors.Is(err, errors.MethodNotAllowed) {
+		code = http.StatusMethodNotAllowed
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func (h *Handler) taken(id cakedb.DeviceId) bool {
+	_, err := h.engine.ReadKey(id)
+	return err == nil
+}
+
+// Write handles a remote_write request
+func (h *Handler) Write(w http.ResponseWriter, r *http.Request) {
+	buf, err := readSnappy(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	var req WriteRequest
+	err = req.Unmarshal(buf)
+	if err != nil {
+		httpError(w, errors.BadRequestf("decode: %v", err))
+		return
+	}
+	// the values are checked first so that a rejected request writes nothing
+	values := make([][]int64, len(req.Timeseries))
+	for i, series := range req.Timeseries {
+		values[i] = make([]int64, len(series.Samples))
+		for j, s := range series.Samples {
+			if math.Float64bits(s.Value) == StaleNaN {
+				continue
+			}
+			values[i][j], err = h.config.value(s.Value)
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+		}
+	}
+	for i, series := range req.Timeseries {
+		id, err := h.index.GetOrCreate(series.Labels, h.taken)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		key := cakedb.Data{h.config.register(series.Labels)}
+		for j, s := range series.Samples {
+			// a series that ends has no point
+			if math.Float64bits(s.Value) == StaleNaN {
+				continue
+			}
+			err := h.engine.Write(key, &cakedb.Point{
+				Data:      cakedb.Data{values[i][j]},
+				DeviceId:  id,
+				Timestamp: s.Timestamp * 1e6,
+			})
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Read handles a remote_read request with the SAMPLES response type
+func (h *Handler) Read(w http.ResponseWriter, r *http.Request) {
+	buf, err := readSnappy(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	var req ReadRequest
+	err = req.Unmarshal(buf)
+	if err != nil {
+		httpError(w, errors.BadRequestf("decode: %v", err))
+		return
+	}
+
+	scale := h.config.scale()
+	resp := ReadResponse{}
+	for _, q := range req.Queries {
+		ids, err := h.index.Select(q.Matchers)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		result := QueryResult{}
+		for _, id := range ids {
+			_, points, err := h.engine.ReadStream(id, q.StartTimestampMs*1e6, q.EndTimestampMs*1e6+1e6-1)
+			if os.IsNotExist(err) {
+				// a series in the index whose first write failed has no points
+				continue
+			}
+			if err != nil {
+				httpError(w, errors.Annotatef(err, "series %d", id))
+				return
+			}
+			series := TimeSeries{Labels: h.index.Labels(id)}
+			for p := range points {
+				series.Samples = append(series.Samples, Sample{
+					Value:     float64(p.Data[0]) / scale,
+					Timestamp: p.Timestamp / 1e6,
+				})
+			}
+			if len(series.Samples) > 0 {
+				result.Timeseries = append(result.Timeseries, series)
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	_, _ = w.Write(snappy.Encode(nil, resp.Marshal()))
+}
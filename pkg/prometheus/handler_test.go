@@ -0,0 +1,40 @@
+package prometheus
+
+import (
+	"bytes"
+	cakedb "cake-db"
+	"github.com/golang/snappy"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandler_Write(t *testing.T) {
+	index, err := OpenIndex(filepath.Join(t.TempDir(), "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	h := NewHandler(cakedb.New(), index, nil)
+	write := func(values ...float64) int {
+		req := &WriteRequest{Timeseries: []TimeSeries{{Labels: []Label{{Name: "__name__", Value: "test034"}}}}}
+		for i, v := range values {
+			req.Timeseries[0].Samples = append(req.Timeseries[0].Samples, Sample{Value: v, Timestamp: int64(i + 1)})
+		}
+		w := httptest.NewRecorder()
+		h.Write(w, httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, req.Marshal()))))
+		return w.Code
+	}
+
+	// a stale marker is skipped, every other value has to fit an int64 once scaled
+	if code := write(1.5, math.Float64frombits(StaleNaN)); code != http.StatusNoContent {
+		t.Fatalf("stale marker: %d", code)
+	}
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e16, -1e16} {
+		if code := write(1, v); code != http.StatusBadRequest {
+			t.Fatalf("%v: %d", v, code)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package prometheus
+
+import (
+	"bufio"
+	cakedb "cake-db"
+	"encoding/json"
+	"github.com/juju/errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SeriesBit marks the device ids of prometheus series, so they do not collide with real devices
+const SeriesBit = 1 << 31
+
+// Index maps label sets to device ids, every new series is appended to a json lines file
+type Index struct {
+	mu       sync.RWMutex
+	file     *os.File
+	series   map[cakedb.DeviceId][]Label
+	ids      map[string]cakedb.DeviceId
+	postings map[string]map[string][]cakedb.DeviceId // name -> value -> ids
+}
+
+type indexRecord struct {
+	Id     cakedb.DeviceId   `json:"id"`
+	Labels map[string]string `json:"labels"`
+}
+
+func OpenIndex(path string) (*Index, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	i := &Index{
+		file:     file,
+		series:   map[cakedb.DeviceId][]Label{},
+		ids:      map[string]cakedb.DeviceId{},
+		postings: map[string]map[string][]cakedb.DeviceId{},
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record indexRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// a torn last line after a crash
+			continue
+		}
+		var labels []Label
+		for name, value := range record.Labels {
+			labels = append(labels, Label{Name: name, Value: value})
+		}
+		i.add(record.Id, sortLabels(labels))
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// the next record must not be appended to a torn line
+	if err := endLine(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// the file may have just been created
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return i, nil
+}
+
+func endLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	_, err = file.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return err
+	}
+	_, err = file.Write([]byte{'\n'})
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (i *Index) Close() error {
+	return i.file.Close()
+}
+
+func sortLabels(labels []Label) []Label {
+	sort.Slice(labels, func(a, b int) bool {
+		return labels[a].Name < labels[b].Name
+	})
+	return labels
+}
+
+func labelsString(labels []Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0)
+		b.WriteString(l.Value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func (i *Index) add(id cakedb.DeviceId, labels []Label) {
+	i.series[id] = labels
+	i.ids[labelsString(labels)] = id
+	for _, l := range labels {
+		values, ok := i.postings[l.Name]
+		if !ok {
+			values = map[string][]cakedb.DeviceId{}
+			i.postings[l.Name] = values
+		}
+		values[l.Value] = append(values[l.Value], id)
+	}
+}
+
+// GetOrCreate returns the device of a label set, taken is asked before a new id is used
+func (i *Index) GetOrCreate(labels []Label, taken func(id cakedb.DeviceId) bool) (cakedb.DeviceId, error) {
+	labels = sortLabels(append([]Label{}, labels...))
+	s := labelsString(labels)
+	i.mu.RLock()
+	id, ok := i.ids[s]
+	i.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if id, ok := i.ids[s]; ok {
+		return id, nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	id = cakedb.DeviceId(h.Sum32() | SeriesBit)
+	for {
+		if _, ok := i.series[id]; !ok && (taken == nil || !taken(id)) {
+			break
+		}
+		id = (id + 1) | SeriesBit
+	}
+
+	record := indexRecord{Id: id, Labels: map[string]string{}}
+	for _, l := range labels {
+		record.Labels[l.Name] = l.Value
+	}
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	_, err = i.file.Write(append(buf, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	// the id is used for points as soon as it is returned, a lost record would leave them without labels
+	err = i.file.Sync()
+	if err != nil {
+		return 0, err
+	}
+	i.add(id, labels)
+	return id, nil
+}
+
+func (i *Index) Labels(id cakedb.DeviceId) []Label {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.series[id]
+}
+
+func (m LabelMatcher) matcher() (func(string) bool, error) {
+	switch m.Type {
+	case MatchEqual:
+		return func(s string) bool { return s == m.Value }, nil
+	case MatchNotEqual:
+		return func(s string) bool { return s != m.Value }, nil
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, errors.NotValidf("matcher %s=~%q", m.Name, m.Value)
+		}
+		if m.Type == MatchRegexp {
+			return re.MatchString, nil
+		}
+		return func(s string) bool { return !re.MatchString(s) }, nil
+	}
+	return nil, errors.NotSupportedf("matcher type %d", m.Type)
+}
+
+// Select returns the devices whose labels match every matcher, a missing label matches as ""
+func (i *Index) Select(matchers []LabelMatcher) ([]cakedb.DeviceId, error) {
+	fns := make([]func(string) bool, len(matchers))
+	for j, m := range matchers {
+		fn, err := m.matcher()
+		if err != nil {
+			return nil, err
+		}
+		fns[j] = fn
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	// start from the postings of an equal matcher if there is one
+	var candidates []cakedb.DeviceId
+	seeded := false
+	for _, m := range matchers {
+		if m.Type == MatchEqual && m.Value != "" {
+			candidates = i.postings[m.Name][m.Value]
+			seeded = true
+			break
+		}
+	}
+	if !seeded {
+		for id := range i.series {
+			candidates = append(candidates, id)
+		}
+	}
+
+	var ids []cakedb.DeviceId
+	for _, id := range candidates {
+		values := map[string]string{}
+		for _, l := range i.series[id] {
+			values[l.Name] = l.Value
+		}
+		ok := true
+		for j, m := range matchers {
+			if !fns[j](values[m.Name]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return ids[a] < ids[b]
+	})
+	return ids, nil
+}
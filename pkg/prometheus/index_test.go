@@ -0,0 +1,112 @@
+package prometheus
+
+import (
+	cakedb "cake-db"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestIndex_GetOrCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	index, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	power := []Label{{Name: "site", Value: "a"}, {Name: "__name__", Value: "power"}}
+	id, err := index.GetOrCreate(power, nil)
+	if err != nil || id&SeriesBit == 0 {
+		t.Fatalf("id %d: %v", id, err)
+	}
+	// the order of the labels does not matter
+	same, _ := index.GetOrCreate([]Label{power[1], power[0]}, nil)
+	if same != id {
+		t.Fatalf("same series: %d != %d", same, id)
+	}
+	// a taken id is skipped
+	up := []Label{{Name: "__name__", Value: "up"}}
+	first, _ := index.GetOrCreate(append(up, Label{Name: "site", Value: "b"}), nil)
+	taken := []cakedb.DeviceId{}
+	other, _ := index.GetOrCreate(up, func(id cakedb.DeviceId) bool {
+		taken = append(taken, id)
+		return len(taken) == 1
+	})
+	if len(taken) != 2 || other == taken[0] || other == first || other&SeriesBit == 0 {
+		t.Fatalf("taken %v, id %d", taken, other)
+	}
+	index.Close()
+
+	// a torn line after a crash is skipped and the next record starts on a new line
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	f.WriteString(`{"id":1,"labels":{"__na`)
+	f.Close()
+	index, err = OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wind := []Label{{Name: "__name__", Value: "wind"}}
+	windId, _ := index.GetOrCreate(wind, nil)
+	index.Close()
+
+	index, err = OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for _, c := range []struct {
+		id     cakedb.DeviceId
+		labels []Label
+	}{
+		{id, power}, {other, up}, {windId, wind},
+	} {
+		got, _ := index.GetOrCreate(c.labels, func(cakedb.DeviceId) bool { return true })
+		if got != c.id || fmt.Sprint(index.Labels(c.id)) != fmt.Sprint(sortLabels(c.labels)) {
+			t.Fatalf("reopened %v: %d %v", c.labels, got, index.Labels(c.id))
+		}
+	}
+	if index.Labels(1) != nil {
+		t.Fatal("torn record")
+	}
+}
+
+func TestIndex_Select(t *testing.T) {
+	index, err := OpenIndex(filepath.Join(t.TempDir(), "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	a, _ := index.GetOrCreate([]Label{{Name: "__name__", Value: "power"}, {Name: "site", Value: "a"}}, nil)
+	b, _ := index.GetOrCreate([]Label{{Name: "__name__", Value: "power"}, {Name: "site", Value: "b"}}, nil)
+	c, _ := index.GetOrCreate([]Label{{Name: "__name__", Value: "power"}}, nil)
+	d, _ := index.GetOrCreate([]Label{{Name: "__name__", Value: "up"}, {Name: "site", Value: "a"}}, nil)
+
+	for _, q := range []struct {
+		matchers []LabelMatcher
+		want     []cakedb.DeviceId
+	}{
+		{[]LabelMatcher{{Type: MatchEqual, Name: "__name__", Value: "power"}}, []cakedb.DeviceId{a, b, c}},
+		{[]LabelMatcher{{Type: MatchEqual, Name: "site", Value: "a"}}, []cakedb.DeviceId{a, d}},
+		{[]LabelMatcher{{Type: MatchEqual, Name: "site", Value: ""}}, []cakedb.DeviceId{c}},
+		{[]LabelMatcher{{Type: MatchNotEqual, Name: "site", Value: "a"}, {Type: MatchEqual, Name: "__name__", Value: "power"}}, []cakedb.DeviceId{b, c}},
+		{[]LabelMatcher{{Type: MatchRegexp, Name: "site", Value: "a|b"}}, []cakedb.DeviceId{a, b, d}},
+		{[]LabelMatcher{{Type: MatchNotRegexp, Name: "__name__", Value: "pow.*"}}, []cakedb.DeviceId{d}},
+		{[]LabelMatcher{{Type: MatchRegexp, Name: "__name__", Value: "pow"}}, nil},
+	} {
+		ids, err := index.Select(q.matchers)
+		want := append([]cakedb.DeviceId{}, q.want...)
+		sort.Slice(want, func(i, j int) bool {
+			return want[i] < want[j]
+		})
+		if err != nil || fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Fatalf("%v: %v %v, want %v", q.matchers, ids, err, want)
+		}
+	}
+	if _, err := index.Select([]LabelMatcher{{Type: MatchRegexp, Name: "site", Value: "("}}); err == nil {
+		t.Fatal("invalid regexp")
+	}
+	if _, err := index.Select([]LabelMatcher{{Type: 9, Name: "site"}}); err == nil {
+		t.Fatal("unknown matcher type")
+	}
+}
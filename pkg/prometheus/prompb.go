@@ -0,0 +1,341 @@
+package prometheus
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// the subset of prometheus/prompb used by remote_write and remote_read, encoded by hand
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value     float64
+	Timestamp int64 // milliseconds
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+type ReadRequest struct {
+	Queries []Query
+}
+
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+func parse(b []byte, field func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		err := field(num, typ, b[:m])
+		if err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+func consumeBytes(typ protowire.Type, v []byte) ([]byte, error) {
+	if typ != protowire.BytesType {
+		return nil, fmt.Errorf("unexpected wire type %d", typ)
+	}
+	b, n := protowire.ConsumeBytes(v)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	return b, nil
+}
+
+func consumeVarint(typ protowire.Type, v []byte) (uint64, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("unexpected wire type %d", typ)
+	}
+	i, n := protowire.ConsumeVarint(v)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	return i, nil
+}
+
+func (l *Label) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		s, err := consumeBytes(typ, v)
+		switch num {
+		case 1:
+			l.Name = string(s)
+		case 2:
+			l.Value = string(s)
+		}
+		return err
+	})
+}
+
+func (s *Sample) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case 1:
+			if typ != protowire.Fixed64Type {
+				return fmt.Errorf("unexpected wire type %d", typ)
+			}
+			i, n := protowire.ConsumeFixed64(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			s.Value = math.Float64frombits(i)
+		case 2:
+			i, err := consumeVarint(typ, v)
+			s.Timestamp = int64(i)
+			return err
+		}
+		return nil
+	})
+}
+
+func (t *TimeSeries) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case 1:
+			m, err := consumeBytes(typ, v)
+			if err != nil {
+				return err
+			}
+			l := Label{}
+			err = l.unmarshal(m)
+			t.Labels = append(t.Labels, l)
+			return err
+		case 2:
+			m, err := consumeBytes(typ, v)
+			if err != nil {
+				return err
+			}
+			s := Sample{}
+			err = s.unmarshal(m)
+			t.Samples = append(t.Samples, s)
+			return err
+		}
+		return nil
+	})
+}
+
+func (w *WriteRequest) Unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		m, err := consumeBytes(typ, v)
+		if err != nil {
+			return err
+		}
+		t := TimeSeries{}
+		err = t.unmarshal(m)
+		w.Timeseries = append(w.Timeseries, t)
+		return err
+	})
+}
+
+func (m *LabelMatcher) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case 1:
+			i, err := consumeVarint(typ, v)
+			m.Type = MatchType(i)
+			return err
+		case 2, 3:
+			s, err := consumeBytes(typ, v)
+			if num == 2 {
+				m.Name = string(s)
+			} else {
+				m.Value = string(s)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (q *Query) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case 1, 2:
+			i, err := consumeVarint(typ, v)
+			if num == 1 {
+				q.StartTimestampMs = int64(i)
+			} else {
+				q.EndTimestampMs = int64(i)
+			}
+			return err
+		case 3:
+			b, err := consumeBytes(typ, v)
+			if err != nil {
+				return err
+			}
+			m := LabelMatcher{}
+			err = m.unmarshal(b)
+			q.Matchers = append(q.Matchers, m)
+			return err
+		}
+		return nil
+	})
+}
+
+func (r *ReadRequest) Unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		m, err := consumeBytes(typ, v)
+		if err != nil {
+			return err
+		}
+		q := Query{}
+		err = q.unmarshal(m)
+		r.Queries = append(r.Queries, q)
+		return err
+	})
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func (l *Label) marshal(b []byte) []byte {
+	b = appendBytes(b, 1, []byte(l.Name))
+	return appendBytes(b, 2, []byte(l.Value))
+}
+
+func (s *Sample) marshal(b []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(s.Value))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(s.Timestamp))
+}
+
+func (t *TimeSeries) marshal(b []byte) []byte {
+	for i := range t.Labels {
+		b = appendBytes(b, 1, t.Labels[i].marshal(nil))
+	}
+	for i := range t.Samples {
+		b = appendBytes(b, 2, t.Samples[i].marshal(nil))
+	}
+	return b
+}
+
+// Marshal is only used by tests and clients of the read endpoint
+func (w *WriteRequest) Marshal() []byte {
+	var b []byte
+	for i := range w.Timeseries {
+		b = appendBytes(b, 1, w.Timeseries[i].marshal(nil))
+	}
+	return b
+}
+
+func (r *ReadResponse) Marshal() []byte {
+	var b []byte
+	for i := range r.Results {
+		var result []byte
+		for j := range r.Results[i].Timeseries {
+			result = appendBytes(result, 1, r.Results[i].Timeseries[j].marshal(nil))
+		}
+		b = appendBytes(b, 1, result)
+	}
+	return b
+}
+
+func (r *ReadResponse) Unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		m, err := consumeBytes(typ, v)
+		if err != nil {
+			return err
+		}
+		result := QueryResult{}
+		err = parse(m, func(num protowire.Number, typ protowire.Type, v []byte) error {
+			if num != 1 {
+				return nil
+			}
+			m, err := consumeBytes(typ, v)
+			if err != nil {
+				return err
+			}
+			t := TimeSeries{}
+			err = t.unmarshal(m)
+			result.Timeseries = append(result.Timeseries, t)
+			return err
+		})
+		r.Results = append(r.Results, result)
+		return err
+	})
+}
+
+func (m *LabelMatcher) marshal(b []byte) []byte {
+	if m.Type != MatchEqual {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Type))
+	}
+	b = appendBytes(b, 2, []byte(m.Name))
+	return appendBytes(b, 3, []byte(m.Value))
+}
+
+func (r *ReadRequest) Marshal() []byte {
+	var b []byte
+	for _, q := range r.Queries {
+		var query []byte
+		query = protowire.AppendTag(query, 1, protowire.VarintType)
+		query = protowire.AppendVarint(query, uint64(q.StartTimestampMs))
+		query = protowire.AppendTag(query, 2, protowire.VarintType)
+		query = protowire.AppendVarint(query, uint64(q.EndTimestampMs))
+		for i := range q.Matchers {
+			query = appendBytes(query, 3, q.Matchers[i].marshal(nil))
+		}
+		b = appendBytes(b, 1, query)
+	}
+	return b
+}
@@ -0,0 +1,82 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestWriteRequest_RoundTrip(t *testing.T) {
+	w := &WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "power"}, {Name: "site", Value: ""}},
+			Samples: []Sample{{Value: 1.5, Timestamp: 1684168368974}, {Value: math.Inf(-1), Timestamp: -1}},
+		},
+		{Labels: []Label{{Name: "__name__", Value: "up"}}},
+	}}
+	got := &WriteRequest{}
+	err := got.Unmarshal(w.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(w) {
+		t.Fatalf("%v != %v", got, w)
+	}
+
+	// the encoding of the prometheus generated code
+	buf := (&WriteRequest{Timeseries: []TimeSeries{{Samples: []Sample{{Value: 1, Timestamp: 2}}}}}).Marshal()
+	want := []byte{0x0a, 0x0d, 0x12, 0x0b, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0x02}
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("% x", buf)
+	}
+}
+
+func TestReadRequest_RoundTrip(t *testing.T) {
+	r := &ReadRequest{Queries: []Query{{
+		StartTimestampMs: 1,
+		EndTimestampMs:   2,
+		Matchers: []LabelMatcher{
+			{Type: MatchEqual, Name: "__name__", Value: "power"},
+			{Type: MatchNotRegexp, Name: "site", Value: "a.*"},
+		},
+	}}}
+	got := &ReadRequest{}
+	err := got.Unmarshal(r.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(r) {
+		t.Fatalf("%v != %v", got, r)
+	}
+
+	resp := &ReadResponse{Results: []QueryResult{
+		{Timeseries: []TimeSeries{{Labels: []Label{{Name: "a", Value: "b"}}, Samples: []Sample{{Value: -2, Timestamp: 3}}}}},
+		{},
+	}}
+	gotResp := &ReadResponse{}
+	err = gotResp.Unmarshal(resp.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(gotResp) != fmt.Sprint(resp) {
+		t.Fatalf("%v != %v", gotResp, resp)
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	buf := (&WriteRequest{Timeseries: []TimeSeries{{
+		Labels:  []Label{{Name: "a", Value: "b"}},
+		Samples: []Sample{{Value: 1, Timestamp: 2}},
+	}}}).Marshal()
+	for i := 1; i < len(buf); i++ {
+		if err := (&WriteRequest{}).Unmarshal(buf[:i]); err == nil {
+			t.Fatalf("truncated at %d: no error", i)
+		}
+	}
+	// a sample value as a varint instead of a double
+	buf = appendBytes(nil, 1, appendBytes(nil, 2, []byte{0x08, 0x01}))
+	if err := (&WriteRequest{}).Unmarshal(buf); err == nil {
+		t.Fatal("wrong wire type: no error")
+	}
+}
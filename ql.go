@@ -0,0 +1,661 @@
+package cakedb
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the query language
+//
+//	SELECT <field>[, <field>...] FROM devices | <continuous query>
+//	  [WHERE <cond> [AND <cond>...]]
+//	  [GROUP BY time(<duration>)[, device]]
+//	  [RESAMPLE(<duration>)]
+//	  [FILL(none | null | previous | linear | <number>)]
+//	  [LIMIT <n>]
+//	  [SCALED]
+//
+//	field    = * | <reg> | <fn>(<reg> | *) [AS <name>] | <counter>(<reg>[, <bits>]) [AS <name>]
+//	reg      = r<register> | <name in the register catalog>
+//	fn       = mean | min | max | sum | count | first | last
+//	counter  = rate | increase | derivative | non_negative_difference
+//	cond     = device = <id> | device IN (<id>, ...) | attr(<name>) = '<value>' | time <op> <time>
+//	time     = now() | <unix ns> | '<RFC3339>' [(+|-) <duration>...]
+//	duration = <n>(ns|us|ms|s|m|h|d|w)
+//
+// a continuous query is read by the windows it stored, its raw fields are the window means.
+// SCALED returns the engineering values of the register catalog, named by the catalog.
+// attr() keeps a device that had the value at some time in the time range, not only the current one.
+// RESAMPLE puts the raw fields onto a grid of the duration from the start time, a grid timestamp
+// takes the newest point in (t-duration, t] and FILL fills the ones without a point.
+
+const (
+	FnMean  = "mean"
+	FnMin   = "min"
+	FnMax   = "max"
+	FnSum   = "sum"
+	FnCount = "count"
+	FnFirst = "first"
+	FnLast  = "last"
+)
+
+var counters = map[string]bool{
+	FnRate:                  true,
+	FnIncrease:              true,
+	FnDerivative:            true,
+	FnNonNegativeDifference: true,
+}
+
+var aggregates = map[string]bool{
+	FnMean:  true,
+	FnMin:   true,
+	FnMax:   true,
+	FnSum:   true,
+	FnCount: true,
+	FnFirst: true,
+	FnLast:  true,
+}
+
+// keywords cannot be register names
+var keywords = map[string]bool{
+	"select": true, "from": true, "where": true, "and": true, "group": true, "by": true,
+	"fill": true, "limit": true, "as": true, "scaled": true, "resample": true,
+}
+
+type FillMode int
+
+const (
+	FillNull FillMode = iota
+	FillNone
+	FillPrevious
+	FillValue
+	FillLinear
+)
+
+// QueryField is a selected register, Register < 0 without RegisterName selects every register of the device
+type QueryField struct {
+	Func         string
+	Register     int64
+	RegisterName string // resolved by the register catalog for the model of every device
+	Bits         int    // wrap-around width of a counter function, 0 treats every decrease as a reset
+	Alias        string
+}
+
+func (f QueryField) Name() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	register := "*"
+	if f.RegisterName != "" {
+		register = f.RegisterName
+	} else if f.Register >= 0 {
+		register = "r" + strconv.FormatInt(f.Register, 10)
+	}
+	if f.Func == "" {
+		return register
+	}
+	if f.Bits > 0 {
+		register += ", " + strconv.Itoa(f.Bits)
+	}
+	return f.Func + "(" + register + ")"
+}
+
+type Statement struct {
+	Fields        []QueryField
+	From          string
+	Devices       []DeviceId        // empty selects every device
+	Attributes    map[string]string // keeps the devices that had these attributes in the time range
+	Start, End    int64             // inclusive, in ns
+	HasStart      bool
+	Interval      int64 // GROUP BY time(), 0 aggregates the whole range into one row
+	Resample      int64 // RESAMPLE(), the step of the grid raw fields are put on
+	GroupByDevice bool
+	Fill          FillMode
+	FillValue     float64
+	Limit         int
+	Scaled        bool
+}
+
+// Aggregate reports whether the statement selects windows instead of rows per point
+func (s *Statement) Aggregate() bool {
+	if s.Interval > 0 {
+		return true
+	}
+	for _, f := range s.Fields {
+		if aggregates[f.Func] {
+			return true
+		}
+	}
+	return false
+}
+
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query: %s at position %d", e.Msg, e.Pos)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokDuration
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(q string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(q) {
+		c := rune(q[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(q) && (unicode.IsLetter(rune(q[j])) || unicode.IsDigit(rune(q[j])) || q[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: q[i:j], pos: i})
+			i = j
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(q) && (unicode.IsDigit(rune(q[j])) || q[j] == '.') {
+				j++
+			}
+			kind := tokNumber
+			if j < len(q) && unicode.IsLetter(rune(q[j])) {
+				kind = tokDuration
+				for j < len(q) && unicode.IsLetter(rune(q[j])) {
+					j++
+				}
+			}
+			tokens = append(tokens, token{kind: kind, text: q[i:j], pos: i})
+			i = j
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(q[i+1:], q[i])
+			if j < 0 {
+				return nil, &QueryError{Pos: i, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{kind: tokString, text: q[i+1 : i+1+j], pos: i})
+			i += j + 2
+		default:
+			op := string(c)
+			if i+1 < len(q) {
+				switch q[i : i+2] {
+				case ">=", "<=", "!=", "<>":
+					op = q[i : i+2]
+				}
+			}
+			if !strings.Contains("()*,=<>+-", op) && len(op) == 1 {
+				return nil, &QueryError{Pos: i, Msg: fmt.Sprintf("unexpected %q", op)}
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(q)}), nil
+}
+
+var durationUnits = map[string]int64{
+	"ns": 1,
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+	"d":  24 * int64(time.Hour),
+	"w":  7 * 24 * int64(time.Hour),
+}
+
+func parseDuration(s string) (int64, bool) {
+	i := strings.IndexFunc(s, unicode.IsLetter)
+	if i <= 0 {
+		return 0, false
+	}
+	unit, ok := durationUnits[s[i:]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+type parser struct {
+	tokens []token
+	i      int
+	now    time.Time
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return &QueryError{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokIdent && strings.EqualFold(t.text, word) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(word string) error {
+	if !p.keyword(word) {
+		return p.errorf(p.peek(), "expected %s", strings.ToUpper(word))
+	}
+	return nil
+}
+
+func (p *parser) op(op string) bool {
+	t := p.peek()
+	if t.kind == tokOp && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.op(op) {
+		return p.errorf(p.peek(), "expected %q", op)
+	}
+	return nil
+}
+
+// ParseQuery parses a statement, now is the value of now()
+func ParseQuery(q string, now time.Time) (*Statement, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, now: now}
+	s := &Statement{Start: math.MinInt64, End: now.UnixNano()}
+
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		s.Fields = append(s.Fields, field)
+		if !p.op(",") {
+			break
+		}
+	}
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	from := p.next()
+	if from.kind != tokIdent {
+		return nil, p.errorf(from, "expected a source")
+	}
+	s.From = from.text
+
+	if p.keyword("where") {
+		for {
+			err := p.condition(s)
+			if err != nil {
+				return nil, err
+			}
+			if !p.keyword("and") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("group") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			err := p.groupBy(s)
+			if err != nil {
+				return nil, err
+			}
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("resample") {
+		err := p.resample(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("fill") {
+		err := p.fill(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("limit") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n < 0 {
+			return nil, p.errorf(t, "invalid limit %q", t.text)
+		}
+		s.Limit = n
+	}
+
+	if p.keyword("scaled") {
+		s.Scaled = true
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	for _, f := range s.Fields {
+		if f.Func == "" && s.Aggregate() {
+			return nil, &QueryError{Msg: "mixing aggregate and raw fields"}
+		}
+	}
+	if s.Start > s.End {
+		return nil, &QueryError{Msg: "empty time range"}
+	}
+	if s.Resample > 0 {
+		if s.Aggregate() {
+			return nil, &QueryError{Msg: "RESAMPLE of aggregate fields, use GROUP BY time"}
+		}
+		if !s.HasStart {
+			return nil, &QueryError{Msg: "RESAMPLE without a start time"}
+		}
+		if (s.End-s.Start)/s.Resample >= MaxQueryWindows {
+			return nil, &QueryError{Msg: fmt.Sprintf("RESAMPLE of %d steps", (s.End-s.Start)/s.Resample)}
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) register() (int64, string, error) {
+	if p.op("*") {
+		return -1, "", nil
+	}
+	t := p.next()
+	if t.kind == tokIdent && len(t.text) > 1 && (t.text[0] == 'r' || t.text[0] == 'R') {
+		register, err := strconv.ParseInt(t.text[1:], 10, 64)
+		if err == nil {
+			return register, "", nil
+		}
+	}
+	if t.kind == tokString || t.kind == tokIdent && !keywords[strings.ToLower(t.text)] {
+		return -1, t.text, nil
+	}
+	return 0, "", p.errorf(t, "expected a register like r30775 or a register name, got %q", t.text)
+}
+
+func (p *parser) field() (QueryField, error) {
+	field := QueryField{}
+	t := p.peek()
+	if t.kind == tokIdent && p.tokens[p.i+1].kind == tokOp && p.tokens[p.i+1].text == "(" {
+		fn := strings.ToLower(t.text)
+		if !aggregates[fn] && !counters[fn] {
+			return field, p.errorf(t, "unknown function %q", t.text)
+		}
+		p.i += 2
+		field.Func = fn
+		register, name, err := p.register()
+		if err != nil {
+			return field, err
+		}
+		field.Register, field.RegisterName = register, name
+		if counters[fn] && p.op(",") {
+			b := p.next()
+			bits, err := strconv.Atoi(b.text)
+			if b.kind != tokNumber || err != nil || bits <= 0 || bits > 64 {
+				return field, p.errorf(b, "invalid bit width %q", b.text)
+			}
+			field.Bits = bits
+		}
+		if err := p.expectOp(")"); err != nil {
+			return field, err
+		}
+	} else {
+		register, name, err := p.register()
+		if err != nil {
+			return field, err
+		}
+		field.Register, field.RegisterName = register, name
+	}
+	if p.keyword("as") {
+		alias := p.next()
+		if alias.kind != tokIdent && alias.kind != tokString {
+			return field, p.errorf(alias, "expected an alias")
+		}
+		field.Alias = alias.text
+	}
+	return field, nil
+}
+
+func (p *parser) deviceId() (DeviceId, error) {
+	t := p.next()
+	id, err := strconv.ParseUint(t.text, 10, 32)
+	if t.kind != tokNumber || err != nil {
+		return 0, p.errorf(t, "invalid device %q", t.text)
+	}
+	return DeviceId(id), nil
+}
+
+func (p *parser) condition(s *Statement) error {
+	t := p.next()
+	switch {
+	case t.kind == tokIdent && strings.EqualFold(t.text, "device"):
+		if p.op("=") {
+			id, err := p.deviceId()
+			if err != nil {
+				return err
+			}
+			s.Devices = append(s.Devices, id)
+			return nil
+		}
+		if err := p.expectKeyword("in"); err != nil {
+			return err
+		}
+		if err := p.expectOp("("); err != nil {
+			return err
+		}
+		for {
+			id, err := p.deviceId()
+			if err != nil {
+				return err
+			}
+			s.Devices = append(s.Devices, id)
+			if !p.op(",") {
+				break
+			}
+		}
+		return p.expectOp(")")
+	case t.kind == tokIdent && strings.EqualFold(t.text, "attr"):
+		if err := p.expectOp("("); err != nil {
+			return err
+		}
+		name := p.next()
+		if name.kind != tokIdent && name.kind != tokString {
+			return p.errorf(name, "expected an attribute name, got %q", name.text)
+		}
+		if err := p.expectOp(")"); err != nil {
+			return err
+		}
+		if err := p.expectOp("="); err != nil {
+			return err
+		}
+		value := p.next()
+		if value.kind != tokString && value.kind != tokNumber && value.kind != tokIdent {
+			return p.errorf(value, "expected an attribute value, got %q", value.text)
+		}
+		if s.Attributes == nil {
+			s.Attributes = map[string]string{}
+		}
+		s.Attributes[name.text] = value.text
+		return nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "time"):
+		op := p.next()
+		value, err := p.timeExpr()
+		if err != nil {
+			return err
+		}
+		switch op.text {
+		case ">":
+			s.Start, s.HasStart = value+1, true
+		case ">=":
+			s.Start, s.HasStart = value, true
+		case "<":
+			s.End = value - 1
+		case "<=":
+			s.End = value
+		case "=":
+			s.Start, s.End, s.HasStart = value, value, true
+		default:
+			return p.errorf(op, "unexpected %q", op.text)
+		}
+		return nil
+	}
+	return p.errorf(t, "expected device, attr or time, got %q", t.text)
+}
+
+func (p *parser) timeExpr() (int64, error) {
+	var value int64
+	t := p.next()
+	switch {
+	case t.kind == tokIdent && strings.EqualFold(t.text, "now"):
+		if err := p.expectOp("("); err != nil {
+			return 0, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return 0, err
+		}
+		value = p.now.UnixNano()
+	case t.kind == tokNumber:
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return 0, p.errorf(t, "invalid time %q", t.text)
+		}
+		value = n
+	case t.kind == tokString:
+		ts, err := time.Parse(time.RFC3339Nano, t.text)
+		if err != nil {
+			return 0, p.errorf(t, "invalid time %q", t.text)
+		}
+		value = ts.UnixNano()
+	default:
+		return 0, p.errorf(t, "expected a time, got %q", t.text)
+	}
+	for {
+		sign := int64(1)
+		if p.op("-") {
+			sign = -1
+		} else if !p.op("+") {
+			return value, nil
+		}
+		t := p.next()
+		d, ok := parseDuration(t.text)
+		if t.kind != tokDuration || !ok {
+			return 0, p.errorf(t, "invalid duration %q", t.text)
+		}
+		value += sign * d
+	}
+}
+
+func (p *parser) groupBy(s *Statement) error {
+	t := p.next()
+	switch {
+	case t.kind == tokIdent && strings.EqualFold(t.text, "device"):
+		s.GroupByDevice = true
+		return nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "time"):
+		if err := p.expectOp("("); err != nil {
+			return err
+		}
+		d := p.next()
+		interval, ok := parseDuration(d.text)
+		if d.kind != tokDuration || !ok || interval <= 0 {
+			return p.errorf(d, "invalid duration %q", d.text)
+		}
+		s.Interval = interval
+		return p.expectOp(")")
+	}
+	return p.errorf(t, "expected time() or device, got %q", t.text)
+}
+
+func (p *parser) resample(s *Statement) error {
+	if err := p.expectOp("("); err != nil {
+		return err
+	}
+	d := p.next()
+	step, ok := parseDuration(d.text)
+	if d.kind != tokDuration || !ok || step <= 0 {
+		return p.errorf(d, "invalid duration %q", d.text)
+	}
+	s.Resample = step
+	return p.expectOp(")")
+}
+
+func (p *parser) fill(s *Statement) error {
+	if err := p.expectOp("("); err != nil {
+		return err
+	}
+	negative := p.op("-")
+	t := p.next()
+	switch {
+	case t.kind == tokIdent && strings.EqualFold(t.text, "null"):
+		s.Fill = FillNull
+	case t.kind == tokIdent && strings.EqualFold(t.text, "none"):
+		s.Fill = FillNone
+	case t.kind == tokIdent && strings.EqualFold(t.text, "previous"):
+		s.Fill = FillPrevious
+	case t.kind == tokIdent && strings.EqualFold(t.text, "linear"):
+		s.Fill = FillLinear
+	case t.kind == tokNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return p.errorf(t, "invalid fill value %q", t.text)
+		}
+		if negative {
+			v = -v
+		}
+		s.Fill, s.FillValue = FillValue, v
+	default:
+		return p.errorf(t, "invalid fill %q", t.text)
+	}
+	if negative && s.Fill != FillValue {
+		return p.errorf(t, "invalid fill %q", t.text)
+	}
+	return p.expectOp(")")
+}
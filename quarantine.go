@@ -0,0 +1,178 @@
+package cakedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/peterbourgon/diskv/v3"
+	"sort"
+	"sync"
+	"time"
+)
+
+const QuarantinePath = "/data/cake-db/data/quarantine"
+
+// reasons a point is quarantined
+const (
+	QuarantineNegative = "negative" // the timestamp is before 1970, it would land in a negative shard
+	QuarantineLate     = "late"     // older than the past bound of the acceptance window
+	QuarantineFuture   = "future"   // newer than the future bound of the acceptance window
+)
+
+// QuarantinedPoint is a point Write kept out of the shards because of its timestamp
+type QuarantinedPoint struct {
+	Id     string `json:"id"`
+	Time   int64  `json:"time"` // ns when it was written
+	Reason string `json:"reason"`
+	Key    Data   `json:"key"`
+	Point  Point  `json:"point"`
+}
+
+// QuarantineQuery selects quarantined points, zero values select everything
+type QuarantineQuery struct {
+	DeviceId   DeviceId
+	Reason     string
+	Start, End int64 // write time in ns, inclusive, End 0 is no bound
+	Limit      int
+}
+
+func (q QuarantineQuery) match(p *QuarantinedPoint) bool {
+	return (q.DeviceId == 0 || p.Point.DeviceId == q.DeviceId) &&
+		(q.Reason == "" || p.Reason == q.Reason) &&
+		p.Time >= q.Start && (q.End == 0 || p.Time <= q.End)
+}
+
+// WithAcceptWindow quarantines the points Write gets with a timestamp more than past before
+// or future after the current time, a bound of 0 accepts everything on its side.
+// Negative timestamps are quarantined with or without a window.
+func WithAcceptWindow(past, future time.Duration) Option {
+	return func(e *Engine) {
+		e.acceptPast, e.acceptFuture = int64(past), int64(future)
+	}
+}
+
+// checkWindow returns why ts is outside the acceptance window, empty if it is inside
+func (e *Engine) checkWindow(ts int64) string {
+	if ts < 0 {
+		return QuarantineNegative
+	}
+	now := time.Now().UnixNano()
+	if e.acceptPast > 0 && ts < now-e.acceptPast {
+		return QuarantineLate
+	}
+	if e.acceptFuture > 0 && ts > now+e.acceptFuture {
+		return QuarantineFuture
+	}
+	return ""
+}
+
+// quarantine stores one diskv value per point like deadLetters, the ids sort by write time
+type quarantine struct {
+	mu    sync.Mutex
+	diskv *diskv.Diskv
+	seq   int64
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{
+		diskv: diskv.New(diskv.Options{
+			BasePath: QuarantinePath,
+			Transform: func(s string) []string {
+				if len(s) > 6 {
+					return []string{s[:6]}
+				}
+				return []string{}
+			},
+		}),
+	}
+}
+
+func (q *quarantine) add(key Data, point *Point, reason string) error {
+	q.mu.Lock()
+	q.seq++
+	seq := q.seq
+	q.mu.Unlock()
+	p := QuarantinedPoint{Time: time.Now().UnixNano(), Reason: reason, Key: key, Point: *point}
+	p.Id = fmt.Sprintf("%019d_%06d", p.Time, seq%1e6)
+	buf, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	// synced like a dead letter, the ingest commits its checkpoint past the point once it is written
+	return q.diskv.WriteStream(p.Id, bytes.NewReader(buf), true)
+}
+
+// Quarantined returns the points matching q sorted by write time
+func (e *Engine) Quarantined(q QuarantineQuery) ([]QuarantinedPoint, error) {
+	var ids []string
+	for id := range e.quarantine.diskv.Keys(nil) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var points []QuarantinedPoint
+	for _, id := range ids {
+		buf, err := e.quarantine.diskv.Read(id)
+		if err != nil {
+			continue
+		}
+		var p QuarantinedPoint
+		err = json.Unmarshal(buf, &p)
+		if err != nil {
+			return nil, errors.Annotatef(err, "quarantined point %s", id)
+		}
+		if !q.match(&p) {
+			continue
+		}
+		points = append(points, p)
+		if q.Limit > 0 && len(points) >= q.Limit {
+			break
+		}
+	}
+	return points, nil
+}
+
+func (e *Engine) DeleteQuarantined(id string) error {
+	if !e.quarantine.diskv.Has(id) {
+		return errors.NotFoundf("quarantined point %s", id)
+	}
+	return e.quarantine.diskv.Erase(id)
+}
+
+// ReleaseQuarantine writes the points matching q through a Backfill whatever their timestamp,
+// except negative ones, and removes them from the quarantine
+func (e *Engine) ReleaseQuarantine(q QuarantineQuery) (released int, err error) {
+	points, err := e.Quarantined(q)
+	if err != nil {
+		return 0, err
+	}
+	b := e.Backfill()
+	for _, p := range points {
+		if p.Point.Timestamp < 0 {
+			continue
+		}
+		point := p.Point
+		err := b.Write(p.Key, &point)
+		if err != nil {
+			// the points stay in the quarantine
+			b.Discard()
+			return 0, err
+		}
+		released++
+	}
+	err = b.Close()
+	if err != nil {
+		b.Discard()
+		return 0, err
+	}
+	for _, p := range points {
+		if p.Point.Timestamp < 0 {
+			continue
+		}
+		err := e.DeleteQuarantined(p.Id)
+		if err != nil {
+			return released, err
+		}
+	}
+	return released, nil
+}
@@ -0,0 +1,651 @@
+package cakedb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-mmap/mmap"
+	"github.com/juju/errors"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MaxQueryWindows bounds the rows of one series produced by GROUP BY time and FILL
+const MaxQueryWindows = 1e6
+
+// MaxQueryRows bounds the rows of one series of a query without GROUP BY time
+const MaxQueryRows = 1e6
+
+// QueryPlan is a statement resolved against the files of the engine
+type QueryPlan struct {
+	*Statement
+	ShardIds []int64    // shards overlapping the time range
+	Devices  []DeviceId // devices with data in the time range
+	Files    int        // files whose index was read
+	rollup   *rollup    // the continuous query of FROM, nil for the raw devices
+}
+
+func (p *QueryPlan) String() string {
+	return fmt.Sprintf("range [%d, %d] shards %v devices %v files %d", p.Start, p.End, p.ShardIds, p.Devices, p.Files)
+}
+
+type QuerySeries struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Units   []string          `json:"units,omitempty"` // unit of every column of a SCALED query
+	Values  [][]any           `json:"values"`
+}
+
+type QueryResult struct {
+	Series []*QuerySeries `json:"series"`
+}
+
+// readIndexes reads the index of a data file
+func readIndexes(path string) ([]Index, error) {
+	file, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	indexLengthBuf := make([]byte, 8)
+	_, err = file.ReadAt(indexLengthBuf, int64(file.Len())-8)
+	if err != nil {
+		return nil, err
+	}
+	indexLength := int64(binary.BigEndian.Uint64(indexLengthBuf))
+	indexBuf := make([]byte, indexLength)
+	_, err = file.ReadAt(indexBuf, int64(file.Len())-8-indexLength)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]Index, 0, indexLength/IndexSize)
+	reader := bytes.NewReader(indexBuf)
+	for {
+		index := Index{}
+		if index.Read(reader) != nil {
+			break
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// Query parses and runs a statement of the query language
+func (e *Engine) Query(q string) (*QueryResult, error) {
+	s, err := ParseQuery(q, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	plan, err := e.Plan(s)
+	if err != nil {
+		return nil, err
+	}
+	return e.Execute(plan)
+}
+
+// Plan selects the shards of the time range and keeps the devices whose file index
+// or memtable overlaps it
+func (e *Engine) Plan(s *Statement) (*QueryPlan, error) {
+	plan := &QueryPlan{Statement: s}
+	if e.catalog == nil {
+		if s.Scaled {
+			return nil, errors.NotSupportedf("SCALED without a register catalog")
+		}
+		for _, f := range s.Fields {
+			if f.RegisterName != "" {
+				return nil, errors.NotSupportedf("register name %q without a register catalog", f.RegisterName)
+			}
+		}
+	}
+	if s.From != "devices" {
+		return e.planRollup(plan)
+	}
+
+	candidates := map[DeviceId]bool{}
+	if len(s.Devices) > 0 {
+		for _, did := range s.Devices {
+			candidates[did] = true
+		}
+	} else {
+		for _, did := range e.Devices() {
+			// a status series is queried by its id only
+			if !did.IsStatusSeries() {
+				candidates[did] = true
+			}
+		}
+	}
+	e.filterAttributes(s, candidates)
+
+	found := map[DeviceId]bool{}
+	shards := e.listShards(s.Start/ShardSize, s.End/ShardSize)
+	for shardId, shard := range shards {
+		plan.ShardIds = append(plan.ShardIds, shardId)
+		files := append([]CompactFiles{}, shard.raw...)
+		for _, downsampled := range shard.downsample {
+			files = append(files, downsampled...)
+		}
+		for _, file := range files {
+			indexes, err := readIndexes(file.Path)
+			if err != nil {
+				continue
+			}
+			plan.Files++
+			for _, index := range indexes {
+				if candidates[index.DeviceId] && index.StartTime <= s.End && index.EndTime >= s.Start {
+					found[index.DeviceId] = true
+				}
+			}
+		}
+	}
+	sort.Slice(plan.ShardIds, func(i, j int) bool {
+		return plan.ShardIds[i] < plan.ShardIds[j]
+	})
+
+	for did := range candidates {
+		if !found[did] && e.inMemory(did, s.Start, s.End) {
+			found[did] = true
+		}
+	}
+
+	for did := range found {
+		plan.Devices = append(plan.Devices, did)
+	}
+	sort.Slice(plan.Devices, func(i, j int) bool {
+		return plan.Devices[i] < plan.Devices[j]
+	})
+	return plan, nil
+}
+
+// filterAttributes removes the devices that did not have the attributes of the statement
+// at any time of its range
+func (e *Engine) filterAttributes(s *Statement, devices map[DeviceId]bool) {
+	if len(s.Attributes) == 0 {
+		return
+	}
+	for did := range devices {
+		if !e.HadAttributes(did, s.Attributes, s.Start, s.End) {
+			delete(devices, did)
+		}
+	}
+}
+
+// planRollup keeps the devices with windows of the continuous query in the time range
+func (e *Engine) planRollup(plan *QueryPlan) (*QueryPlan, error) {
+	plan.rollup = e.rollup(plan.From)
+	if plan.rollup == nil {
+		return nil, errors.NotFoundf("source %q", plan.From)
+	}
+	for _, f := range plan.Fields {
+		if f.Func == FnFirst || counters[f.Func] {
+			return nil, errors.NotSupportedf("%s() on continuous query %q", f.Func, plan.From)
+		}
+	}
+	var devices map[DeviceId]bool
+	plan.ShardIds, devices = plan.rollup.listDevices(windowStart(plan.Start, plan.rollup.Resolution)/ShardSize, plan.End/ShardSize)
+	e.filterAttributes(plan.Statement, devices)
+	for did := range devices {
+		if len(plan.Statement.Devices) == 0 && did.IsStatusSeries() {
+			continue
+		}
+		if len(plan.Statement.Devices) > 0 {
+			found := false
+			for _, d := range plan.Statement.Devices {
+				found = found || d == did
+			}
+			if !found {
+				continue
+			}
+		}
+		plan.Devices = append(plan.Devices, did)
+	}
+	sort.Slice(plan.Devices, func(i, j int) bool {
+		return plan.Devices[i] < plan.Devices[j]
+	})
+	return plan, nil
+}
+
+// stream returns the points of did as windows, a raw point is a window of one point.
+// Once ctx is done the reading stops and out is closed without the rest of the points.
+func (e *Engine) stream(ctx context.Context, plan *QueryPlan, did DeviceId) (Data, chan *WindowPoint, error) {
+	out := make(chan *WindowPoint, 1000)
+	if plan.rollup != nil {
+		key, windows, err := e.readRollup(plan.rollup, did, plan.Start, plan.End)
+		if err != nil {
+			return nil, nil, err
+		}
+		go func() {
+			defer close(out)
+			for _, w := range windows {
+				select {
+				case out <- w:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return key, out, nil
+	}
+	key, points, err := e.ReadStreamContext(ctx, did, plan.Start, plan.End)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		defer close(out)
+		// points is drained until it is closed, ReadStreamContext stops soon after ctx is done
+		for p := range points {
+			select {
+			case out <- &WindowPoint{
+				DeviceId:  p.DeviceId,
+				Timestamp: p.Timestamp,
+				Min:       p.Data,
+				Max:       p.Data,
+				Mean:      p.Data,
+				Last:      p.Data,
+				Count:     1,
+			}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return key, out, nil
+}
+
+// aggregateState accumulates one field over one window
+type aggregateState struct {
+	count           int64
+	sum, min, max   float64
+	first, last     float64
+	firstTs, lastTs int64
+
+	// counter functions sum up the differences between points
+	deltas         int64
+	increase, diff float64
+	dt             int64
+}
+
+func (a *aggregateState) addCounter(increase, diff float64, dt int64) {
+	a.deltas++
+	a.increase += increase
+	a.diff += diff
+	a.dt += dt
+}
+
+// valueOf is the raw value or with a definition the engineering value
+func valueOf(def *RegisterDef, raw int64) float64 {
+	if def == nil {
+		return float64(raw)
+	}
+	return def.Value(raw)
+}
+
+// add takes the engineering values of a window with def, for a window of several points
+// def must be Linear, see checkScaled
+func (a *aggregateState) add(w *WindowPoint, column int, def *RegisterDef) {
+	min, max := valueOf(def, w.Min[column]), valueOf(def, w.Max[column])
+	if min > max {
+		min, max = max, min
+	}
+	if a.count == 0 || min < a.min {
+		a.min = min
+	}
+	if a.count == 0 || max > a.max {
+		a.max = max
+	}
+	// first is only asked of raw points, where the mean is the value
+	if a.count == 0 || w.Timestamp < a.firstTs {
+		a.first, a.firstTs = valueOf(def, w.Mean[column]), w.Timestamp
+	}
+	if a.count == 0 || w.Timestamp >= a.lastTs {
+		a.last, a.lastTs = valueOf(def, w.Last[column]), w.Timestamp
+	}
+	a.sum += valueOf(def, w.Mean[column]) * float64(w.Count)
+	a.count += w.Count
+}
+
+func (a *aggregateState) value(fn string) any {
+	if counters[fn] {
+		if a == nil || a.deltas == 0 {
+			return nil
+		}
+		return counterValue(fn, a.increase, a.diff, a.dt)
+	}
+	if a == nil || a.count == 0 {
+		if fn == FnCount {
+			return int64(0)
+		}
+		return nil
+	}
+	switch fn {
+	case FnMin:
+		return a.min
+	case FnMax:
+		return a.max
+	case FnSum:
+		return a.sum
+	case FnCount:
+		return a.count
+	case FnFirst:
+		return a.first
+	case FnLast:
+		return a.last
+	}
+	return a.sum / float64(a.count)
+}
+
+// expandFields resolves wildcards against the key of a device
+func expandFields(fields []QueryField, key Data) []QueryField {
+	var expanded []QueryField
+	for _, f := range fields {
+		if f.Register >= 0 || f.RegisterName != "" {
+			expanded = append(expanded, f)
+			continue
+		}
+		for _, register := range key {
+			expanded = append(expanded, QueryField{Func: f.Func, Register: register, Bits: f.Bits})
+		}
+	}
+	return expanded
+}
+
+// resolve finds the column of every field in the key of did, with SCALED defs has the
+// register definition of every field. A field without a column is -1.
+func (e *Engine) resolve(plan *QueryPlan, did DeviceId, key Data, fields []QueryField) (columnOf []int, defs []*RegisterDef) {
+	model := e.deviceModel(did)
+	columnOf = make([]int, len(fields))
+	defs = make([]*RegisterDef, len(fields))
+	for i, f := range fields {
+		columnOf[i] = -1
+		address := f.Register
+		if f.RegisterName != "" {
+			def, ok := e.catalog.RegisterByName(model, f.RegisterName)
+			if !ok {
+				continue
+			}
+			address = def.Address
+		}
+		for j, register := range key {
+			if register == address {
+				columnOf[i] = j
+			}
+		}
+		if def, ok := e.catalog.Register(model, address); ok && plan.Scaled {
+			defs[i] = &def
+		}
+	}
+	return columnOf, defs
+}
+
+// checkScaled rejects the engineering values of the windows of a continuous query for a register
+// that is not Linear, the min, max and mean of its raw values do not convert. last() is a raw value.
+func checkScaled(plan *QueryPlan, fields []QueryField, defs []*RegisterDef) error {
+	if plan.rollup == nil {
+		return nil
+	}
+	for i, def := range defs {
+		if def == nil || def.Linear() || fields[i].Func == FnLast || fields[i].Func == FnCount {
+			continue
+		}
+		return errors.NotSupportedf("SCALED %s of %s %s on continuous query %q", fields[i].Func, def.Type, def.Name, plan.From)
+	}
+	return nil
+}
+
+// scaledSeries names the columns of a SCALED series by the catalog and adds their units
+func scaledSeries(series *QuerySeries, fields []QueryField, defs []*RegisterDef) {
+	series.Units = make([]string, len(fields)+1)
+	for i, f := range fields {
+		if defs[i] == nil {
+			continue
+		}
+		series.Units[i+1] = defs[i].Unit
+		if f.Alias == "" && f.RegisterName == "" && defs[i].Name != "" {
+			f.RegisterName = defs[i].Name
+			series.Columns[i+1] = f.Name()
+		}
+	}
+}
+
+// scaleCounter converts the increase and difference of a counter into engineering units
+func scaleCounter(def *RegisterDef, increase, diff float64) (float64, float64) {
+	if def == nil {
+		return increase, diff
+	}
+	return increase * def.scale(), diff * def.scale()
+}
+
+func columns(fields []QueryField) []string {
+	c := []string{"time"}
+	for _, f := range fields {
+		c = append(c, f.Name())
+	}
+	return c
+}
+
+func deviceSeries(name string, did DeviceId, fields []QueryField) *QuerySeries {
+	return &QuerySeries{
+		Name:    name,
+		Tags:    map[string]string{"device": strconv.FormatUint(uint64(did), 10)},
+		Columns: columns(fields),
+	}
+}
+
+// Execute streams every planned device and aggregates it into windows of the statement
+func (e *Engine) Execute(plan *QueryPlan) (*QueryResult, error) {
+	if !plan.Aggregate() {
+		return e.executeRaw(plan)
+	}
+
+	type group struct {
+		series  *QuerySeries
+		fields  []QueryField
+		windows map[int64][]*aggregateState
+	}
+	var groups []*group
+	var all *group
+	for _, did := range plan.Devices {
+		ctx, cancel := context.WithCancel(context.Background())
+		key, points, err := e.stream(ctx, plan, did)
+		if os.IsNotExist(err) {
+			// a device without a key has no points
+			cancel()
+			continue
+		}
+		if err != nil {
+			cancel()
+			return nil, errors.Annotatef(err, "device %d", did)
+		}
+		fields := expandFields(plan.Fields, key)
+		g := all
+		if plan.GroupByDevice || g == nil {
+			g = &group{fields: fields, windows: map[int64][]*aggregateState{}}
+			if plan.GroupByDevice {
+				g.series = deviceSeries(plan.From, did, fields)
+			} else {
+				// without GROUP BY device the wildcards take the registers of the first device
+				g.series = &QuerySeries{Name: plan.From, Columns: columns(fields)}
+				all = g
+			}
+			groups = append(groups, g)
+		}
+		columnOf, defs := e.resolve(plan, did, key, g.fields)
+		if err := checkScaled(plan, g.fields, defs); err != nil {
+			cancel()
+			return nil, err
+		}
+		if plan.Scaled && g.series.Units == nil {
+			scaledSeries(g.series, g.fields, defs)
+		}
+		trackers := make([]counter, len(g.fields))
+		for i, f := range g.fields {
+			trackers[i].bits = f.Bits
+		}
+		for p := range points {
+			// without GROUP BY time there is one window at the start of the range
+			var window int64
+			if plan.HasStart {
+				window = plan.Start
+			}
+			if plan.Interval > 0 {
+				window = windowStart(p.Timestamp, plan.Interval)
+			}
+			states := g.windows[window]
+			if states == nil {
+				states = make([]*aggregateState, len(g.fields))
+				for i := range states {
+					states[i] = &aggregateState{}
+				}
+				g.windows[window] = states
+			}
+			for i, column := range columnOf {
+				if column < 0 || column >= len(p.Mean) {
+					continue
+				}
+				if !counters[g.fields[i].Func] {
+					states[i].add(p, column, defs[i])
+				} else if increase, diff, dt, ok := trackers[i].next(p.Timestamp, p.Mean[column]); ok {
+					increase, diff = scaleCounter(defs[i], increase, diff)
+					states[i].addCounter(increase, diff, dt)
+				}
+			}
+		}
+		cancel()
+	}
+
+	result := &QueryResult{}
+	for _, g := range groups {
+		rows, err := plan.rows(g.windows, g.fields)
+		if err != nil {
+			return nil, err
+		}
+		g.series.Values = rows
+		result.Series = append(result.Series, g.series)
+	}
+	return result, nil
+}
+
+// rows orders the windows by time and fills the empty ones
+func (s *Statement) rows(windows map[int64][]*aggregateState, fields []QueryField) ([][]any, error) {
+	var timestamps []int64
+	for ts := range windows {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	if s.Interval > 0 && s.Fill != FillNone && len(timestamps) > 0 {
+		first := timestamps[0]
+		if s.HasStart {
+			first = windowStart(s.Start, s.Interval)
+		}
+		last := windowStart(s.End, s.Interval)
+		if (last-first)/s.Interval >= MaxQueryWindows {
+			return nil, errors.NotValidf("%d windows", (last-first)/s.Interval)
+		}
+		timestamps = timestamps[:0]
+		for ts := first; ts <= last; ts += s.Interval {
+			timestamps = append(timestamps, ts)
+		}
+	}
+
+	var rows [][]any
+	for _, ts := range timestamps {
+		states, ok := windows[ts]
+		row := make([]any, len(fields)+1)
+		row[0] = ts
+		if ok {
+			for i, f := range fields {
+				row[i+1] = states[i].value(f.Func)
+			}
+		}
+		rows = append(rows, row)
+		if s.Limit > 0 && len(rows) >= s.Limit && s.Fill != FillLinear {
+			break
+		}
+	}
+	s.fill(rows, fields)
+	if s.Limit > 0 && len(rows) > s.Limit {
+		rows = rows[:s.Limit]
+	}
+	return rows, nil
+}
+
+func (e *Engine) executeRaw(plan *QueryPlan) (*QueryResult, error) {
+	result := &QueryResult{}
+	for _, did := range plan.Devices {
+		ctx, cancel := context.WithCancel(context.Background())
+		key, points, err := e.stream(ctx, plan, did)
+		if os.IsNotExist(err) {
+			// a device without a key has no points
+			cancel()
+			continue
+		}
+		if err != nil {
+			cancel()
+			return nil, errors.Annotatef(err, "device %d", did)
+		}
+		fields := expandFields(plan.Fields, key)
+		columnOf, defs := e.resolve(plan, did, key, fields)
+		if err := checkScaled(plan, fields, defs); err != nil {
+			cancel()
+			return nil, err
+		}
+		trackers := make([]counter, len(fields))
+		for i, f := range fields {
+			trackers[i].bits = f.Bits
+		}
+		series := deviceSeries(plan.From, did, fields)
+		if plan.Scaled {
+			scaledSeries(series, fields, defs)
+		}
+		if plan.Resample > 0 {
+			points = resample(ctx, points, did, plan.Start, plan.End, plan.Resample)
+		}
+		// like rows, linear fill needs the values after the LIMIT
+		linear := plan.Resample > 0 && plan.Fill == FillLinear
+		for p := range points {
+			if plan.Limit > 0 && len(series.Values) >= plan.Limit && !linear {
+				break
+			}
+			// an empty grid timestamp of RESAMPLE
+			if p.Count == 0 && plan.Fill == FillNone {
+				continue
+			}
+			if len(series.Values) >= MaxQueryRows {
+				cancel()
+				return nil, errors.NotValidf("more than %d rows of device %d, add a LIMIT or GROUP BY time", int(MaxQueryRows), did)
+			}
+			row := make([]any, len(fields)+1)
+			row[0] = p.Timestamp
+			for i, column := range columnOf {
+				if column < 0 || column >= len(p.Mean) {
+					continue
+				}
+				if !counters[fields[i].Func] {
+					row[i+1] = p.Mean[column]
+					if defs[i] != nil {
+						row[i+1] = defs[i].Value(p.Mean[column])
+					}
+				} else if increase, diff, dt, ok := trackers[i].next(p.Timestamp, p.Mean[column]); ok {
+					// the first point has no previous one and stays nil
+					increase, diff = scaleCounter(defs[i], increase, diff)
+					row[i+1] = counterValue(fields[i].Func, increase, diff, dt)
+				}
+			}
+			series.Values = append(series.Values, row)
+		}
+		// stops reading the rest of the points after a LIMIT
+		cancel()
+		if plan.Resample > 0 {
+			plan.fill(series.Values, fields)
+		}
+		if plan.Limit > 0 && len(series.Values) > plan.Limit {
+			series.Values = series.Values[:plan.Limit]
+		}
+		result.Series = append(result.Series, series)
+	}
+	return result, nil
+}
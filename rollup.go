@@ -0,0 +1,394 @@
+package cakedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/peterbourgon/diskv/v3"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RollupPath = "/data/cake-db/rollup"
+
+const DefaultRollupEvery = time.Minute
+
+// ContinuousQuery maintains windows of every register of its devices in a namespace of its own,
+// which the query language reads with FROM <Name>
+type ContinuousQuery struct {
+	Name       string
+	Resolution int64         // window size in ns
+	Devices    []DeviceId    // empty rolls up every device
+	Every      time.Duration // how often touched windows are recomputed, 0 means DefaultRollupEvery
+}
+
+// rollup tracks the windows touched by writes, they are recomputed from the engine so that
+// late data and overwrites end up in the rollup like in a query over the raw data.
+// The touched windows are kept in memory and saved in batches, a dirty_<n> key per save,
+// before the points that touched them are in the files, see save. The batches are erased
+// once their windows are recomputed, so windows touched before a restart are recomputed after it.
+type rollup struct {
+	ContinuousQuery
+	devices map[DeviceId]bool
+	diskv   *diskv.Diskv
+
+	mu      sync.Mutex
+	dirty   map[DeviceId]map[int64]struct{}
+	pending map[DeviceId]map[int64]struct{} // dirty windows that are not saved yet
+	saved   []string                        // keys of the batches holding the dirty windows
+	batch   int64
+}
+
+func WithContinuousQuery(cqs ...ContinuousQuery) Option {
+	return func(e *Engine) {
+		for _, cq := range cqs {
+			if cq.Name == "" || cq.Name == "devices" || strings.ContainsAny(cq.Name, "/_") || cq.Resolution <= 0 {
+				panic(fmt.Sprintf("invalid continuous query %+v", cq))
+			}
+			r := &rollup{
+				ContinuousQuery: cq,
+				devices:         map[DeviceId]bool{},
+				dirty:           map[DeviceId]map[int64]struct{}{},
+				pending:         map[DeviceId]map[int64]struct{}{},
+			}
+			for _, did := range cq.Devices {
+				r.devices[did] = true
+			}
+			path := RollupPath + "/" + cq.Name
+			os.MkdirAll(path, 0777)
+			r.diskv = diskv.New(diskv.Options{
+				BasePath: path,
+				Transform: func(s string) []string {
+					return strings.Split(s, "_")[:1]
+				},
+			})
+			r.loadDirty()
+			e.rollups = append(e.rollups, r)
+		}
+	}
+}
+
+func (e *Engine) rollup(name string) *rollup {
+	for _, r := range e.rollups {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// touch marks the window of a written point in memory, save stores the mark
+func (r *rollup) touch(p *Point) {
+	if len(r.devices) > 0 && !r.devices[p.DeviceId] {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mark(p.DeviceId, windowStart(p.Timestamp, r.Resolution))
+}
+
+func (r *rollup) mark(did DeviceId, ts int64) {
+	if _, ok := r.dirty[did][ts]; ok {
+		return
+	}
+	addWindow(r.dirty, did, ts)
+	addWindow(r.pending, did, ts)
+}
+
+func addWindow(windows map[DeviceId]map[int64]struct{}, did DeviceId, ts int64) {
+	if windows[did] == nil {
+		windows[did] = map[int64]struct{}{}
+	}
+	windows[did][ts] = struct{}{}
+}
+
+// save stores the windows marked since the last save as one batch of [device][window]... pairs.
+// A memtable dump saves before it writes its files and a backfill after, so a stop loses
+// no mark of a point that is in the files. If the write fails the windows stay pending.
+func (r *rollup) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) == 0 {
+		return nil
+	}
+	buffer := bytes.NewBuffer([]byte{})
+	for did, windows := range r.pending {
+		for ts := range windows {
+			binary.Write(buffer, binary.BigEndian, [2]int64{int64(did), ts})
+		}
+	}
+	r.batch++
+	if now := time.Now().UnixNano(); now > r.batch {
+		r.batch = now
+	}
+	key := fmt.Sprintf("dirty_%d", r.batch)
+	err := r.diskv.WriteStream(key, buffer, true)
+	if err != nil {
+		return errors.Annotatef(err, "rollup %s", r.Name)
+	}
+	r.saved = append(r.saved, key)
+	r.pending = map[DeviceId]map[int64]struct{}{}
+	return nil
+}
+
+// loadDirty marks the windows that were not recomputed before the last stop
+func (r *rollup) loadDirty() {
+	for key := range r.diskv.KeysPrefix("dirty_", nil) {
+		buf, err := r.diskv.Read(key)
+		if err != nil {
+			continue
+		}
+		r.saved = append(r.saved, key)
+		pairs := make([][2]int64, len(buf)/16)
+		binary.Read(bytes.NewReader(buf), binary.BigEndian, pairs)
+		for _, pair := range pairs {
+			addWindow(r.dirty, DeviceId(pair[0]), pair[1])
+		}
+	}
+}
+
+func rollupKey(did DeviceId, shardId int64) string {
+	return fmt.Sprintf("%d_%d", did, shardId)
+}
+
+// the rollup of a device in a shard is [valueCount][window]... with every window
+// encoded like a downsampled point: [timestamp][min]...[max]...[mean]...[last]...[count]
+
+func (r *rollup) readFile(did DeviceId, shardId int64) (map[int64]*WindowPoint, error) {
+	windows := map[int64]*WindowPoint{}
+	buf, err := r.diskv.Read(rollupKey(did, shardId))
+	if os.IsNotExist(err) {
+		return windows, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(buf)
+	var valueCount int64
+	err = binary.Read(reader, binary.BigEndian, &valueCount)
+	if err != nil {
+		return nil, err
+	}
+	data := make(Data, 1+windowValueCount(int(valueCount)))
+	for binary.Read(reader, binary.BigEndian, data) == nil {
+		w := decodeWindowPoint(&Point{Data: append(Data{}, data[1:]...), DeviceId: did, Timestamp: data[0]})
+		windows[w.Timestamp] = w
+	}
+	return windows, nil
+}
+
+func (r *rollup) writeFile(did DeviceId, shardId int64, valueCount int, windows map[int64]*WindowPoint) error {
+	if len(windows) == 0 {
+		err := r.diskv.Erase(rollupKey(did, shardId))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	timestamps := make([]int64, 0, len(windows))
+	for ts := range windows {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, int64(valueCount))
+	for _, ts := range timestamps {
+		binary.Write(buffer, binary.BigEndian, ts)
+		binary.Write(buffer, binary.BigEndian, windows[ts].encode().Data)
+	}
+	return r.diskv.Write(rollupKey(did, shardId), buffer.Bytes())
+}
+
+// recompute rebuilds the windows of did with a read per shard, from its first dirty window to
+// the end of its last one, so that windows touched in different weeks do not read everything in
+// between. The reads see the memtables that are still being dumped like any ReadStream.
+func (e *Engine) recompute(r *rollup, did DeviceId, dirty []int64) error {
+	key, err := e.ReadKey(did)
+	if os.IsNotExist(err) {
+		// a device without a key has no points
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	shards := map[int64][]int64{}
+	for _, ts := range dirty {
+		shards[ts/ShardSize] = append(shards[ts/ShardSize], ts)
+	}
+	for shardId, timestamps := range shards {
+		sort.Slice(timestamps, func(i, j int) bool {
+			return timestamps[i] < timestamps[j]
+		})
+		windows := map[int64]*WindowPoint{}
+		for _, ts := range timestamps {
+			windows[ts] = nil
+		}
+		_, points, err := e.ReadStream(did, timestamps[0], timestamps[len(timestamps)-1]+r.Resolution-1)
+		if err != nil {
+			return err
+		}
+		for p := range points {
+			ts := windowStart(p.Timestamp, r.Resolution)
+			w, ok := windows[ts]
+			if !ok {
+				// a window in between that is not dirty
+				continue
+			}
+			if w == nil {
+				windows[ts] = newWindowPoint(p, r.Resolution)
+			} else {
+				w.add(newWindowPoint(p, r.Resolution))
+			}
+		}
+
+		stored, err := r.readFile(did, shardId)
+		if err != nil {
+			return err
+		}
+		for ts, w := range windows {
+			if w == nil {
+				delete(stored, ts)
+			} else {
+				stored[ts] = w
+			}
+		}
+		err = r.writeFile(did, shardId, len(key), stored)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush recomputes every window touched since the last flush and erases the batches that
+// marked them, the windows that fail are marked again
+func (e *Engine) flushRollup(r *rollup) {
+	// a stop during the recompute finds the windows in the batches
+	err := r.save()
+	if err != nil {
+		fmt.Println(time.Now(), "rollup", r.Name, err)
+		return
+	}
+	r.mu.Lock()
+	dirty, saved := r.dirty, r.saved
+	r.dirty, r.saved = map[DeviceId]map[int64]struct{}{}, nil
+	r.mu.Unlock()
+
+	for did, windows := range dirty {
+		timestamps := make([]int64, 0, len(windows))
+		for ts := range windows {
+			timestamps = append(timestamps, ts)
+		}
+		err := e.recompute(r, did, timestamps)
+		if err != nil {
+			// the windows are recomputed on the next flush
+			fmt.Println(time.Now(), "rollup", r.Name, did, err)
+			r.mu.Lock()
+			for _, ts := range timestamps {
+				r.mark(did, ts)
+			}
+			r.mu.Unlock()
+		}
+	}
+
+	// the failed windows are in a new batch before the old ones are erased
+	err = r.save()
+	if err != nil {
+		fmt.Println(time.Now(), "rollup", r.Name, err)
+		r.mu.Lock()
+		r.saved = append(r.saved, saved...)
+		r.mu.Unlock()
+		return
+	}
+	for _, key := range saved {
+		err := r.diskv.Erase(key)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println(time.Now(), "rollup", r.Name, err)
+		}
+	}
+}
+
+func (e *Engine) maintainRollup(r *rollup) {
+	every := r.Every
+	if every <= 0 {
+		every = DefaultRollupEvery
+	}
+	for range time.Tick(every) {
+		e.flushRollup(r)
+	}
+}
+
+// devices returns the devices of the rollup with windows in the shards
+func (r *rollup) listDevices(startId, endId int64) (shardIds []int64, devices map[DeviceId]bool) {
+	devices = map[DeviceId]bool{}
+	shards := map[int64]bool{}
+	for key := range r.diskv.Keys(nil) {
+		split := strings.Split(key, "_")
+		did, err := strconv.ParseUint(split[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		shardId, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil || shardId < startId || shardId > endId {
+			continue
+		}
+		devices[DeviceId(did)] = true
+		shards[shardId] = true
+	}
+	for shardId := range shards {
+		shardIds = append(shardIds, shardId)
+	}
+	sort.Slice(shardIds, func(i, j int) bool {
+		return shardIds[i] < shardIds[j]
+	})
+	return shardIds, devices
+}
+
+// read returns the windows of did starting in [start, end] sorted by time
+func (e *Engine) readRollup(r *rollup, did DeviceId, start, end int64) (Data, []*WindowPoint, error) {
+	key, err := e.ReadKey(did)
+	if err != nil {
+		return nil, nil, err
+	}
+	var windows []*WindowPoint
+	shardIds, _ := r.listDevices(windowStart(start, r.Resolution)/ShardSize, end/ShardSize)
+	for _, shardId := range shardIds {
+		stored, err := r.readFile(did, shardId)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "rollup %s", r.Name)
+		}
+		for _, w := range stored {
+			if w.Timestamp >= windowStart(start, r.Resolution) && w.Timestamp <= end {
+				windows = append(windows, w)
+			}
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Timestamp < windows[j].Timestamp
+	})
+	return key, windows, nil
+}
+
+// ReadRollup returns the windows of a continuous query for did in [start, end]
+func (e *Engine) ReadRollup(name string, did DeviceId, start, end int64) (Data, []WindowPoint, error) {
+	r := e.rollup(name)
+	if r == nil {
+		return nil, nil, errors.NotFoundf("continuous query %q", name)
+	}
+	key, windows, err := e.readRollup(r, did, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	value := make([]WindowPoint, len(windows))
+	for i, w := range windows {
+		value[i] = *w
+	}
+	return key, value, nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"github.com/juju/errors"
+	"math"
+)
+
+const (
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateMean  = "mean"
+	AggregateSum   = "sum"
+	AggregateCount = "count"
+	AggregateFirst = "first"
+	AggregateLast  = "last"
+)
+
+// Window is the aggregate of the points in [Timestamp, Timestamp+step)
+type Window struct {
+	Timestamp int64   `json:"timestamp"`
+	Count     int64   `json:"count"`
+	Values    []int64 `json:"values"`
+}
+
+func windowStart(timestamp, step int64) int64 {
+	start := timestamp - timestamp%step
+	if timestamp%step < 0 {
+		start -= step
+	}
+	return start
+}
+
+// Aggregate groups the output of ReadValue into windows of step and applies fn to every register
+func Aggregate(values []int64, valueCount int, step int64, fn string) ([]Window, error) {
+	if step <= 0 {
+		return nil, errors.NotValidf("step %d", step)
+	}
+	switch fn {
+	case AggregateMin, AggregateMax, AggregateMean, AggregateSum, AggregateCount, AggregateFirst, AggregateLast:
+	default:
+		return nil, errors.NotSupportedf("aggregate %q", fn)
+	}
+
+	pointSize := valueCount + 1
+	var windows []Window
+	var sums []float64
+	finish := func() {
+		if len(windows) == 0 || fn != AggregateMean {
+			return
+		}
+		w := windows[len(windows)-1]
+		for i := range w.Values {
+			w.Values[i] = int64(math.Round(sums[i] / float64(w.Count)))
+		}
+	}
+	for i := 0; i+pointSize <= len(values); i += pointSize {
+		timestamp := windowStart(values[i], step)
+		point := values[i+1 : i+pointSize]
+		if len(windows) == 0 || windows[len(windows)-1].Timestamp != timestamp {
+			finish()
+			windows = append(windows, Window{
+				Timestamp: timestamp,
+				Values:    append([]int64{}, point...),
+			})
+			sums = make([]float64, valueCount)
+		}
+		w := &windows[len(windows)-1]
+		w.Count++
+		for j, v := range point {
+			switch fn {
+			case AggregateMin:
+				if v < w.Values[j] {
+					w.Values[j] = v
+				}
+			case AggregateMax:
+				if v > w.Values[j] {
+					w.Values[j] = v
+				}
+			case AggregateMean:
+				sums[j] += float64(v)
+			case AggregateSum:
+				if w.Count > 1 {
+					w.Values[j] += v
+				}
+			case AggregateCount:
+				w.Values[j] = w.Count
+			case AggregateLast:
+				w.Values[j] = v
+			}
+		}
+	}
+	finish()
+	return windows, nil
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/juju/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	CodecNone = "none"
+	CodecLz4  = "lz4"
+
+	ConfigFile = "config.json"
+)
+
+// Config is persisted as config.json in the directory of every database
+type Config struct {
+	ShardSize int64  `json:"shard_size"` // nanoseconds
+	Retention int64  `json:"retention"`  // nanoseconds, 0 keeps data forever
+	Codec     string `json:"codec"`      // none or lz4
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ShardSize: ShardSize,
+		Codec:     CodecNone,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.ShardSize <= 0 {
+		return errors.NotValidf("shard size %d", c.ShardSize)
+	}
+	if c.Retention < 0 {
+		return errors.NotValidf("retention %d", c.Retention)
+	}
+	if c.Codec != CodecNone && c.Codec != CodecLz4 {
+		return errors.NotValidf("codec %q", c.Codec)
+	}
+	return nil
+}
+
+// CakeServer manages the databases under root, every database lives in root/name
+type CakeServer struct {
+	root string
+	mu   sync.RWMutex
+	dbs  map[string]*Cake
+}
+
+// NewServer opens every database found under root
+func NewServer(root string) (*CakeServer, error) {
+	err := os.MkdirAll(root, 0777)
+	if err != nil {
+		return nil, err
+	}
+	s := &CakeServer{
+		root: root,
+		dbs:  map[string]*Cake{},
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		config, err := readConfig(filepath.Join(root, entry.Name()))
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Annotatef(err, "open db %s", entry.Name())
+		}
+		s.dbs[entry.Name()] = NewCakeWithConfig(filepath.Join(root, entry.Name()), config)
+	}
+	return s, nil
+}
+
+func readConfig(path string) (Config, error) {
+	buf, err := os.ReadFile(filepath.Join(path, ConfigFile))
+	if err != nil {
+		return Config{}, err
+	}
+	config := DefaultConfig()
+	err = json.Unmarshal(buf, &config)
+	if err != nil {
+		return Config{}, err
+	}
+	return config, config.Validate()
+}
+
+func writeConfig(path string, config Config) error {
+	buf, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(path, ConfigFile+".tmp")
+	err = os.WriteFile(tmp, buf, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(path, ConfigFile))
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return errors.NotValidf("db name %q", name)
+	}
+	return nil
+}
+
+func (s *CakeServer) CreateDB(name string) error {
+	return s.CreateDBWithConfig(name, DefaultConfig())
+}
+
+func (s *CakeServer) CreateDBWithConfig(name string, config Config) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dbs[name]; ok {
+		return errors.AlreadyExistsf("db %s", name)
+	}
+	path := filepath.Join(s.root, name)
+	err := os.MkdirAll(path, 0777)
+	if err != nil {
+		return err
+	}
+	err = writeConfig(path, config)
+	if err != nil {
+		return err
+	}
+	s.dbs[name] = NewCakeWithConfig(path, config)
+	return nil
+}
+
+func (s *CakeServer) OpenDB(name string) (DB, error) {
+	return s.Cake(name)
+}
+
+// Cake returns the database name
+func (s *CakeServer) Cake(name string) (*Cake, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db, ok := s.dbs[name]
+	if !ok {
+		return nil, errors.NotFoundf("db %s", name)
+	}
+	return db, nil
+}
+
+func (s *CakeServer) Config(name string) (Config, error) {
+	db, err := s.Cake(name)
+	if err != nil {
+		return Config{}, err
+	}
+	return db.config, nil
+}
+
+func (s *CakeServer) ListDB() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.dbs))
+	for name := range s.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropDB stops the database and removes all of its files once its merges and dumps are done
+func (s *CakeServer) DropDB(name string) error {
+	s.mu.Lock()
+	db, ok := s.dbs[name]
+	if !ok {
+		s.mu.Unlock()
+		return errors.NotFoundf("db %s", name)
+	}
+	delete(s.dbs, name)
+	s.mu.Unlock()
+
+	db.drop()
+	return os.RemoveAll(db.basePath)
+}
+
+// Close flushes and closes every database
+func (s *CakeServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, db := range s.dbs {
+		err := db.Close()
+		if err != nil {
+			return errors.Annotatef(err, "close db %s", name)
+		}
+	}
+	s.dbs = map[string]*Cake{}
+	return nil
+}
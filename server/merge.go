@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MaxCompactFileSize = 500 * 1e6
+	MinCompactFiles    = 5
+)
+
+type valueFile struct {
+	key     string
+	shardId int64
+	created int64
+}
+
+// listFiles returns the value files of the shards in [startId, endId] sorted by created
+func (db *Cake) listFiles(startId, endId int64) []valueFile {
+	var files []valueFile
+	for key := range db.value.Keys(nil) {
+		split := strings.Split(key, "_")
+		if len(split) != 3 {
+			continue
+		}
+		shardId, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil || shardId < startId || shardId > endId {
+			continue
+		}
+		created, err := strconv.ParseInt(split[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, valueFile{
+			key:     key,
+			shardId: shardId,
+			created: created,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].created < files[j].created
+	})
+	return files
+}
+
+func (db *Cake) compact() {
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-time.After(time.Minute):
+		}
+
+		db.expire()
+
+		shards := map[int64][]valueFile{}
+		for _, f := range db.listFiles(math.MinInt64, math.MaxInt64) {
+			if db.fileSize(f.key) < MaxCompactFileSize {
+				shards[f.shardId] = append(shards[f.shardId], f)
+			}
+		}
+
+		for shardId, files := range shards {
+			if len(files) <= MinCompactFiles {
+				continue
+			}
+			select {
+			case <-db.done:
+				return
+			default:
+			}
+			fmt.Println(time.Now(), "start compact", shardId, len(files))
+			err := db.merge(shardId, files)
+			if err != nil {
+				fmt.Println(time.Now(), "compact failed", shardId, err)
+				continue
+			}
+			fmt.Println(time.Now(), "end compact", shardId, len(files))
+		}
+	}
+}
+
+// merge rewrites files into one file, the newest point of a timestamp wins.
+//
+// The new file takes over the key of the newest input, so files created in the meantime still win.
+// A file with a device without key cannot be decoded, it is left alone together with the files
+// older than it so that the merged file does not win over it.
+func (db *Cake) merge(shardId int64, files []valueFile) error {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].created < files[j].created
+	})
+	list := NewSkipListMap[*Data, struct{}](&DataCompare{})
+	size := int64(0)
+	for i, f := range files {
+		values, err := db.readAll(f.key)
+		if errors.Is(err, errors.NotFound) {
+			fmt.Println(time.Now(), "skip compact of", f.key, "and older files:", err)
+			if len(files)-i-1 <= 1 {
+				return nil
+			}
+			return db.merge(shardId, files[i+1:])
+		}
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			list.Delete(v)
+			list.Insert(v, struct{}{})
+		}
+		size += db.fileSize(f.key)
+	}
+
+	iterator, err := list.Iterator()
+	if err != nil {
+		return err
+	}
+	points := make(chan *Data, 1024)
+	go func() {
+		for {
+			k, _, err := iterator.Next()
+			if err != nil {
+				break
+			}
+			points <- k
+		}
+		close(points)
+	}()
+	newest := files[len(files)-1]
+	err = db.dump(db.shardSize, shardId, newest.created, points, db.config.Codec == CodecLz4 || size > 100*1e6)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files[:len(files)-1] {
+		err := db.value.Erase(f.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Cake) fileSize(key string) int64 {
+	stat, err := os.Stat(getValuePath(db.value.BasePath, key))
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// expire erases the files of shards that ended before the retention
+func (db *Cake) expire() {
+	if db.config.Retention <= 0 {
+		return
+	}
+	endId := (time.Now().UnixNano()-db.config.Retention)/db.shardSize - 1
+	for _, f := range db.listFiles(math.MinInt64, endId) {
+		fmt.Println(time.Now(), "expire", f.key)
+		db.value.Erase(f.key)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"github.com/go-mmap/mmap"
 	"github.com/pierrec/lz4"
+	"io"
 )
 
 func readIndexLength(file *mmap.File) (int64, error) {
@@ -41,6 +42,7 @@ func readAllIndex(file *mmap.File, indexLength int64) ([]*Index, error) {
 	return v, nil
 }
 
+// readDataByIndex reads the points of index, size is the length of the data on disk
 func readDataByIndex(file *mmap.File, index Index, valueCount int, size int) ([]int64, [][]int64, error) {
 	pointSize := int64(8 + valueCount*8)
 	buf := make([]byte, size)
@@ -51,34 +53,30 @@ func readDataByIndex(file *mmap.File, index Index, valueCount int, size int) ([]
 
 	if index.Flag&1 > 0 {
 		target := make([]byte, index.Length)
-		_, err := lz4.NewReader(bytes.NewReader(buf)).Read(target)
+		_, err := io.ReadFull(lz4.NewReader(bytes.NewReader(buf)), target)
 		if err != nil {
-			panic(err)
+			return nil, nil, err
 		}
 		buf = target
-	} else {
-		file.ReadAt(buf, index.Offset)
 	}
 
-	for i := 0; i < int(index.Length/pointSize); i++ {
+	n := int(index.Length / pointSize)
+	timestamps := make([]int64, 0, n)
+	values := make([][]int64, 0, n)
+	for i := 0; i < n; i++ {
 		r := bytes.NewReader(buf[i*int(pointSize) : (i+1)*int(pointSize)])
-		var timestamp, value int64
-		var values Data
-		binary.Read(r, binary.BigEndian, &timestamp)
-		for i := 0; i < valueCount; i++ {
-			binary.Read(r, binary.BigEndian, &value)
-			values = append(values, value)
+		var timestamp int64
+		value := make([]int64, valueCount)
+		err = binary.Read(r, binary.BigEndian, &timestamp)
+		if err != nil {
+			return nil, nil, err
 		}
-		v := &MergePoint{
-			Point: &Point{
-				Data:      values,
-				DeviceId:  index.DeviceId,
-				Timestamp: timestamp,
-			},
-			Created: int64(created),
+		err = binary.Read(r, binary.BigEndian, value)
+		if err != nil {
+			return nil, nil, err
 		}
-		//fmt.Println(v.DeviceId, v.Timestamp, v.Data)
-		indexChan <- v
+		timestamps = append(timestamps, timestamp)
+		values = append(values, value)
 	}
-
+	return timestamps, values, nil
 }
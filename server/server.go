@@ -12,12 +12,19 @@ import (
 	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Server interface {
 	CreateDB(name string) error
+	CreateDBWithConfig(name string, config Config) error
+	OpenDB(name string) (DB, error)
+	ListDB() []string
+	DropDB(name string) error
 }
 
 type DB interface {
@@ -35,19 +42,47 @@ type Data struct {
 	Id        uint64
 }
 
+const (
+	ShardSize   = int64(time.Hour * 7 * 24)
+	MaxShardMem = 1e6 * 100
+)
+
 type Cake struct {
-	key      *diskv.Diskv
-	value    *diskv.Diskv
-	maxId    uint64
-	commitId uint64
-	idMu     sync.RWMutex
-	shardMu  sync.RWMutex
-	shard    Skiplist[*Data, struct{}]
-	size     int
+	basePath  string
+	shardSize int64
+	config    Config
+	key       *diskv.Diskv
+	value     *diskv.Diskv
+	maxId     uint64 // the highest id written
+	commitId  uint64 // the highest id persisted
+	idMu      sync.RWMutex
+	shardMu   sync.RWMutex
+	shard     Skiplist[*Data, struct{}]
+	shardId   uint64       // the highest id in shard
+	flushing  []*flushTask // dumping to disk, still visible to reads
+	size      int
+	created   int64
+	createdMu sync.Mutex
+	dumpWg    sync.WaitGroup
+	flushErr  error // of the last commit, returned by Flush
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+	compactWg sync.WaitGroup
+	widths    sync.Map // device id to the number of registers of its key
 }
 
 func NewCake(basePath string) *Cake {
-	return &Cake{
+	return NewCakeWithConfig(basePath, DefaultConfig())
+}
+
+func NewCakeWithConfig(basePath string, config Config) *Cake {
+	os.MkdirAll(basePath+"/tmp", 0777)
+	db := &Cake{
+		basePath:  basePath,
+		shardSize: config.ShardSize,
+		config:    config,
+		done:      make(chan struct{}),
 		key: diskv.New(diskv.Options{
 			BasePath: basePath + "/key",
 			Transform: func(s string) []string {
@@ -70,40 +105,340 @@ func NewCake(basePath string) *Cake {
 		}),
 		shard: NewSkipListMap[*Data, struct{}](&DataCompare{}),
 	}
+	commitId, err := db.readCommitId()
+	if err != nil {
+		panic(err)
+	}
+	// writes after the commit were lost, accept them again
+	db.commitId = commitId
+	db.maxId = commitId
+	db.compactWg.Add(1)
+	go func() {
+		defer db.compactWg.Done()
+		db.compact()
+	}()
+	return db
+}
+
+type flushTask struct {
+	list    Skiplist[*Data, struct{}]
+	maxId   uint64
+	created int64
+	done    bool
+	err     error // of the last dump, the task is dumped again by the next Flush
+}
+
+func (db *Cake) commitPath() string {
+	return db.basePath + "/commit"
+}
+
+func (db *Cake) readCommitId() (uint64, error) {
+	buf, err := os.ReadFile(db.commitPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) != 8 {
+		return 0, errors.NotValidf("commit file %s", db.commitPath())
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// commit persists id as the highest id on disk, db.idMu must be held.
+// The dumps below id have synced their files and directories before.
+func (db *Cake) commitWithLock(id uint64) error {
+	if id <= db.commitId {
+		return nil
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id)
+	tmp, err := os.CreateTemp(db.basePath+"/tmp", "commit-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), db.commitPath())
+	if err != nil {
+		return err
+	}
+	err = syncDir(db.basePath)
+	if err != nil {
+		return err
+	}
+	db.commitId = id
+	return nil
+}
+
+// syncDir persists the entries of a directory, e.g. a file renamed into it
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err1 := dir.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// checkKey returns an error unless deviceId has a key with one register per value
+func (db *Cake) checkKey(deviceId int64, values []int64) error {
+	width, ok := db.widths.Load(deviceId)
+	if !ok {
+		key, err := db.ReadKey(deviceId)
+		if os.IsNotExist(errors.Cause(err)) {
+			return errors.NotFoundf("key of device %d", deviceId)
+		}
+		if err != nil {
+			return err
+		}
+		width, _ = db.widths.LoadOrStore(deviceId, len(key))
+	}
+	if len(values) != width.(int) {
+		return errors.NotValidf("%d values for the %d registers of device %d", len(values), width, deviceId)
+	}
+	return nil
 }
 
 func (db *Cake) WriteValue(deviceId, timestamp int64, values []int64, id uint64) error {
+	// the files hold len(key) values per point of a device
+	err := db.checkKey(deviceId, values)
+	if err != nil {
+		return err
+	}
 
-	// check id
-	db.idMu.RUnlock()
-	if id <= db.maxId {
-		return errors.New("out of order")
+	// ids enter the shard in order, so a flushed shard covers every id below its max id
+	db.shardMu.Lock()
+	defer db.shardMu.Unlock()
+	if db.closed {
+		return errors.New("db is closed")
 	}
-	db.idMu.RUnlock()
 
-	// modify max id
+	// check id and modify max id
 	db.idMu.Lock()
+	if id <= db.maxId {
+		db.idMu.Unlock()
+		return errors.New("out of order")
+	}
 	db.maxId = id
 	db.idMu.Unlock()
 
-	// insert
+	db.insertWithLock(deviceId, timestamp, values, id)
+	return nil
+}
+
+// Append writes a value with the next id and returns the id
+func (db *Cake) Append(deviceId, timestamp int64, values []int64) (uint64, error) {
+	err := db.checkKey(deviceId, values)
+	if err != nil {
+		return 0, err
+	}
+
 	db.shardMu.Lock()
 	defer db.shardMu.Unlock()
+	if db.closed {
+		return 0, errors.New("db is closed")
+	}
+
+	db.idMu.Lock()
+	db.maxId++
+	id := db.maxId
+	db.idMu.Unlock()
 
-	db.shard.Insert(&Data{
+	db.insertWithLock(deviceId, timestamp, values, id)
+	return id, nil
+}
+
+// insertWithLock inserts a value into the memory shard, db.shardMu must be held
+func (db *Cake) insertWithLock(deviceId, timestamp int64, values []int64, id uint64) {
+	data := &Data{
 		DeviceId:  deviceId,
 		Timestamp: timestamp,
 		Value:     values,
 		Id:        id,
-	}, struct{}{})
+	}
+	// the newest value of a timestamp wins
+	db.shard.Delete(data)
+	db.shard.Insert(data, struct{}{})
+	db.shardId = id
 	db.size += 8 * (len(values) + 1)
 
-	if db.size > 1e6*100 {
-		db.size = 0
-		// dump
+	if db.size > MaxShardMem {
+		db.flushWithLock()
 	}
+}
 
-	return nil
+// flushWithLock swaps the memory shard and dumps it in the background, db.shardMu must be held
+func (db *Cake) flushWithLock() {
+	if db.shard.Size() == 0 || db.closed {
+		return
+	}
+	task := &flushTask{
+		list:    db.shard,
+		maxId:   db.shardId,
+		created: db.nextCreated(),
+	}
+	db.shard = NewSkipListMap[*Data, struct{}](&DataCompare{})
+	db.size = 0
+	db.flushing = append(db.flushing, task)
+	db.dumpTaskWithLock(task)
+}
+
+// dumpTaskWithLock dumps a task in the background, db.shardMu must be held.
+// A failed task stays readable in db.flushing and holds back the commit id.
+func (db *Cake) dumpTaskWithLock(task *flushTask) {
+	task.err = nil
+	db.dumpWg.Add(1)
+	go func() {
+		defer db.dumpWg.Done()
+		err := db.dumpList(task.list, task.created)
+
+		// commit the tasks that are done and have no pending task before them
+		db.shardMu.Lock()
+		if err != nil {
+			task.err = err
+			db.shardMu.Unlock()
+			fmt.Println(time.Now(), "dump failed", err)
+			return
+		}
+		task.done = true
+		commitId := uint64(0)
+		for len(db.flushing) > 0 && db.flushing[0].done {
+			commitId = db.flushing[0].maxId
+			db.flushing = db.flushing[1:]
+		}
+		db.shardMu.Unlock()
+
+		db.idMu.Lock()
+		err = db.commitWithLock(commitId)
+		db.idMu.Unlock()
+		if err != nil {
+			db.shardMu.Lock()
+			db.flushErr = err
+			db.shardMu.Unlock()
+			fmt.Println(time.Now(), "commit failed", err)
+		}
+	}()
+}
+
+// Flush dumps the memory shard and the failed dumps and waits until every dump is imported,
+// it returns the error of a dump or commit that failed
+func (db *Cake) Flush() error {
+	db.shardMu.Lock()
+	for _, task := range db.flushing {
+		if task.err != nil && !db.closed {
+			db.dumpTaskWithLock(task)
+		}
+	}
+	db.flushWithLock()
+	db.shardMu.Unlock()
+	db.dumpWg.Wait()
+
+	db.shardMu.Lock()
+	defer db.shardMu.Unlock()
+	err := db.flushErr
+	db.flushErr = nil
+	for _, task := range db.flushing {
+		if task.err != nil {
+			err = task.err
+		}
+	}
+	return err
+}
+
+// stopCompaction ends the compaction and waits for a merge in progress
+func (db *Cake) stopCompaction() {
+	db.closeOnce.Do(func() {
+		close(db.done)
+	})
+	db.compactWg.Wait()
+}
+
+// Close stops the compaction and flushes the memory shard, later writes fail
+func (db *Cake) Close() error {
+	db.stopCompaction()
+	err := db.Flush()
+	db.shardMu.Lock()
+	db.closed = true
+	db.shardMu.Unlock()
+	return err
+}
+
+// drop stops the database without flushing it, its files can be removed once drop returns
+func (db *Cake) drop() {
+	db.stopCompaction()
+	db.shardMu.Lock()
+	db.closed = true
+	db.shardMu.Unlock()
+	db.dumpWg.Wait()
+}
+
+// nextCreated returns a unique, increasing creation time for file names
+func (db *Cake) nextCreated() int64 {
+	db.createdMu.Lock()
+	defer db.createdMu.Unlock()
+	created := time.Now().UnixMilli()
+	if created <= db.created {
+		created = db.created + 1
+	}
+	db.created = created
+	return created
+}
+
+// dumpList writes a sorted list into one file per shard named with created
+func (db *Cake) dumpList(list Skiplist[*Data, struct{}], created int64) error {
+	iterator, err := list.Iterator()
+	if err != nil {
+		return err
+	}
+	c := map[int64]chan *Data{}
+	errs := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	for {
+		k, _, err := iterator.Next()
+		if err != nil {
+			break
+		}
+		shardId := k.Timestamp / db.shardSize
+		if _, ok := c[shardId]; !ok {
+			c[shardId] = make(chan *Data, 1024)
+			wg.Add(1)
+			go func(shardId int64, points chan *Data) {
+				defer wg.Done()
+				err := db.dump(db.shardSize, shardId, created, points, db.config.Codec == CodecLz4)
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}(shardId, c[shardId])
+		}
+		c[shardId] <- k
+	}
+	for _, i := range c {
+		close(i)
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
 }
 
 func getWriter(zip bool) (io.Writer, *bytes.Buffer) {
@@ -117,12 +452,24 @@ func getWriter(zip bool) (io.Writer, *bytes.Buffer) {
 	return writer, buffer
 }
 
-func (e *Cake) dump(shardSize, shardId int64, created int64, points chan *Data, zip bool) {
+// dump writes points into a file and imports it, on an error the rest of points is drained
+// and no file is imported
+func (e *Cake) dump(shardSize, shardId int64, created int64, points chan *Data, zip bool) (err error) {
+	defer func() {
+		for range points {
+		}
+	}()
 	// create a tmp file
-	file, err := os.CreateTemp("/tmp/", fmt.Sprintf("%d-%d-", shardId, created))
+	file, err := os.CreateTemp(e.basePath+"/tmp", fmt.Sprintf("%d-%d-", shardId, created))
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
 	lastDid := -1
 	start := int64(math.MaxInt64)
 	end := int64(math.MinInt64)
@@ -133,18 +480,21 @@ func (e *Cake) dump(shardSize, shardId int64, created int64, points chan *Data,
 	writer, reader = getWriter(zip)
 	var flag byte
 	if zip {
-		flag &= 1
+		flag |= 1
 	}
 	realSize := 0
 
-	writeIndex := func() {
+	writeIndex := func() error {
 		closer, ok := writer.(io.Closer)
 		if ok {
-			_ = closer.Close()
+			err := closer.Close()
+			if err != nil {
+				return err
+			}
 		}
 		n, err := io.Copy(file, reader)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		var index = Index{
 			DeviceId:  uint32(lastDid),
@@ -160,23 +510,24 @@ func (e *Cake) dump(shardSize, shardId int64, created int64, points chan *Data,
 		offset += uint64(n)
 		realSize = 0
 		writer, reader = getWriter(zip)
+		return nil
 	}
 
-	writeData := func(k *Data) {
+	writeData := func(k *Data) error {
 		p := bytes.NewBuffer([]byte{})
-		err = binary.Write(p, binary.BigEndian, k.Timestamp)
+		err := binary.Write(p, binary.BigEndian, k.Timestamp)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		err = binary.Write(p, binary.BigEndian, k.Value)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		realSize += p.Len()
-		_, err := writer.Write(p.Bytes())
+		_, err = writer.Write(p.Bytes())
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		if start > k.Timestamp {
@@ -185,42 +536,65 @@ func (e *Cake) dump(shardSize, shardId int64, created int64, points chan *Data,
 		if end < k.Timestamp {
 			end = k.Timestamp
 		}
+		return nil
 	}
 
 	for k := range points {
-		if int(k.DeviceId) != lastDid {
-			if lastDid != -1 {
-				writeIndex()
+		if int(k.DeviceId) != lastDid && lastDid != -1 {
+			err = writeIndex()
+			if err != nil {
+				return err
 			}
-			writeData(k)
+		}
+		err = writeData(k)
+		if err != nil {
+			return err
 		}
 		lastDid = int(k.DeviceId)
 	}
-	writeIndex()
+	if lastDid != -1 {
+		err = writeIndex()
+		if err != nil {
+			return err
+		}
+	}
 
 	// write index
 	_, err = file.Write(indexBuf.Bytes())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// write index length
 	err = binary.Write(file, binary.BigEndian, int64(len(indexBuf.Bytes())))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// close and import file
+	// the data has to be on disk before a commit id covers it
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
 	err = file.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	name := fmt.Sprintf("%d_%d_%d", shardSize, shardId, created)
 	err = e.value.Import(file.Name(), name, true)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	// the directories of the shard may have been created by the import
+	shardDir := filepath.Dir(getValuePath(e.value.BasePath, name))
+	for _, dir := range []string{shardDir, filepath.Dir(shardDir), e.value.BasePath} {
+		err := syncDir(dir)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func getValuePath(prefix, s string) string {
@@ -232,35 +606,178 @@ func getValuePath(prefix, s string) string {
 	str += s
 	return str
 }
-func (db *Cake) readAll(key string) error {
+
+// readAll reads every point of a file
+func (db *Cake) readAll(key string) ([]*Data, error) {
+	return db.readFile(key, func(index *Index) bool {
+		return true
+	})
+}
+
+// readRange reads the points of deviceId in [start, end] from a file
+func (db *Cake) readRange(key string, deviceId, start, end int64) ([]*Data, error) {
+	values, err := db.readFile(key, func(index *Index) bool {
+		return int64(index.DeviceId) == deviceId && index.EndTime >= start && index.StartTime <= end
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Data
+	for _, v := range values {
+		if v.Timestamp >= start && v.Timestamp <= end {
+			ret = append(ret, v)
+		}
+	}
+	return ret, nil
+}
+
+func (db *Cake) readFile(key string, match func(index *Index) bool) ([]*Data, error) {
 	path := getValuePath(db.value.BasePath, key)
 	file, err := mmap.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer file.Close()
 
 	indexLength, err := readIndexLength(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	allIndex, err := readAllIndex(file, indexLength)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	dataSize := int64(file.Len()) - 8 - indexLength
+	var ret []*Data
+	for i, index := range allIndex {
+		if !match(index) {
+			continue
+		}
+		key, err := db.ReadKey(int64(index.DeviceId))
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, errors.NotFoundf("key of device %d in %s", index.DeviceId, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r := dataSize
+		if i != len(allIndex)-1 {
+			r = allIndex[i+1].Offset
+		}
+		timestamps, values, err := readDataByIndex(file, *index, len(key), int(r-index.Offset))
+		if err != nil {
+			return nil, err
+		}
+		for j, timestamp := range timestamps {
+			ret = append(ret, &Data{
+				DeviceId:  int64(index.DeviceId),
+				Timestamp: timestamp,
+				Value:     values[j],
+			})
+		}
+	}
+	return ret, nil
 }
 
+// WriteKey sets the registers of a device, the number of registers of a device with a key
+// cannot change because its points in the files have one value per register
 func (db *Cake) WriteKey(deviceId int64, key []int64) error {
+	old, err := db.ReadKey(deviceId)
+	if err == nil && len(old) != len(key) {
+		return errors.NotValidf("%d registers for device %d with %d", len(key), deviceId, len(old))
+	}
 	encodeByte, err := convertor.EncodeByte(key)
 	if err != nil {
 		return err
 	}
-	return db.key.Write(convertor.ToString(deviceId), encodeByte)
+	err = db.key.Write(convertor.ToString(deviceId), encodeByte)
+	if err != nil {
+		return err
+	}
+	db.widths.Store(deviceId, len(key))
+	return nil
 }
 
+// ReadValue returns the points of deviceId in [start, end] sorted by timestamp,
+// flattened as [timestamp][value]... with len(ReadKey(deviceId)) values per point.
 func (db *Cake) ReadValue(deviceId, start, end int64) ([]int64, error) {
-	return nil, nil
+	key, err := db.ReadKey(deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	type version struct {
+		value   []int64
+		created int64
+	}
+	v := map[int64]version{}
+	set := func(timestamp int64, value []int64, created int64) {
+		if old, ok := v[timestamp]; !ok || old.created <= created {
+			v[timestamp] = version{value: value, created: created}
+		}
+	}
+
+	// read memory first: a dump that is imported while the files are read is still in memory
+	// here, reading memory after the files could miss the points it moved
+	var memory []*Data
+	db.shardMu.RLock()
+	lists := make([]Skiplist[*Data, struct{}], 0, len(db.flushing)+1)
+	for _, task := range db.flushing {
+		lists = append(lists, task.list)
+	}
+	lists = append(lists, db.shard)
+	for _, list := range lists {
+		iterator, err := list.IteratorBetween(&Data{DeviceId: deviceId, Timestamp: start}, &Data{DeviceId: deviceId, Timestamp: end})
+		if err != nil {
+			continue
+		}
+		for {
+			k, _, err := iterator.Next()
+			if err != nil {
+				break
+			}
+			if k.DeviceId == deviceId && k.Timestamp >= start && k.Timestamp <= end {
+				memory = append(memory, k)
+			}
+		}
+	}
+	db.shardMu.RUnlock()
+
+	// read files, oldest first. A file erased by a merge in the meantime is in the merged
+	// file, which takes over the key of the newest input and is read after it.
+	for _, f := range db.listFiles(start/db.shardSize, end/db.shardSize) {
+		values, err := db.readRange(f.key, deviceId, start, end)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range values {
+			set(i.Timestamp, i.Value, f.created)
+		}
+	}
+
+	// memory is newer than every file
+	for _, k := range memory {
+		set(k.Timestamp, k.Value, math.MaxInt64)
+	}
+
+	timestamps := make([]int64, 0, len(v))
+	for timestamp := range v {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	ret := make([]int64, 0, len(timestamps)*(len(key)+1))
+	for _, timestamp := range timestamps {
+		ret = append(ret, timestamp)
+		ret = append(ret, v[timestamp].value...)
+	}
+	return ret, nil
 }
 
 func (db *Cake) ReadKey(deviceId int64) ([]int64, error) {
@@ -276,6 +793,9 @@ func (db *Cake) ReadKey(deviceId int64) ([]int64, error) {
 	return v, nil
 }
 
+// Id returns the highest id that is persisted, consumers resume from Id()+1 after a restart
 func (db *Cake) Id() uint64 {
+	db.idMu.RLock()
+	defer db.idMu.RUnlock()
 	return db.commitId
 }
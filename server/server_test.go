@@ -3,6 +3,9 @@ package server
 import (
 	cakedb "cake-db"
 	"fmt"
+	"github.com/juju/errors"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -26,6 +29,10 @@ func TestCake_ReadKey(t *testing.T) {
 
 func TestCake_WriteValue(t *testing.T) {
 	db := NewCake("/home/wyatt/cake-db/deltaSolar")
+	err := db.WriteKey(1, nil)
+	if err != nil {
+		panic(err)
+	}
 	for i := 0; i < 1e6; i++ {
 		err := db.WriteValue(1, 1, nil, uint64(i+1))
 		if err != nil {
@@ -77,3 +84,324 @@ func TestCake_read1(t *testing.T) {
 		fmt.Println(i.DeviceId, i.Timestamp, i.Data, i.Created)
 	}
 }
+
+func TestCake_ReadValue(t *testing.T) {
+	db := NewCake(t.TempDir())
+	defer db.Close()
+	err := db.WriteKey(1, []int64{30775, 30813})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uint64(0)
+	write := func(timestamp, value int64) {
+		id++
+		err := db.WriteValue(1, timestamp, []int64{value, -value}, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 10; i++ {
+		write(i, i)
+	}
+	db.Flush()
+	write(3, 30)
+	write(ShardSize+1, 1)
+	db.Flush()
+	write(4, 40)
+
+	if err := db.WriteValue(1, 5, []int64{5, 5}, id); err == nil {
+		t.Fatal("out of order id accepted")
+	}
+
+	values, err := db.ReadValue(1, 2, ShardSize+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{2, 2, -2, 3, 30, -30, 4, 40, -40, 5, 5, -5, 6, 6, -6, 7, 7, -7, 8, 8, -8, 9, 9, -9, ShardSize + 1, 1, -1}
+	if fmt.Sprint(values) != fmt.Sprint(want) {
+		t.Fatalf("values: %v", values)
+	}
+
+	files := db.listFiles(0, 0)
+	if len(files) != 2 {
+		t.Fatalf("files: %v", files)
+	}
+	err = db.merge(0, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := db.listFiles(0, 0); len(files) != 1 {
+		t.Fatalf("compacted files: %v", files)
+	}
+	compacted, err := db.ReadValue(1, 2, ShardSize+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(compacted) != fmt.Sprint(want) {
+		t.Fatalf("compacted values: %v", compacted)
+	}
+}
+
+func TestCake_WriteValueKey(t *testing.T) {
+	db := NewCake(t.TempDir())
+	defer db.Close()
+	if err := db.WriteValue(1, 1, []int64{1}, 1); !errors.Is(err, errors.NotFound) {
+		t.Fatalf("write without key: %v", err)
+	}
+	err := db.WriteKey(1, []int64{30775, 30813})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteValue(1, 1, []int64{1}, 1); !errors.Is(err, errors.NotValid) {
+		t.Fatalf("write with a wrong width: %v", err)
+	}
+	if err := db.WriteValue(1, 1, []int64{1, 2}, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCake_MergeMissingKey(t *testing.T) {
+	db := NewCake(t.TempDir())
+	defer db.Close()
+	id := uint64(0)
+	write := func(did, timestamp int64) {
+		id++
+		err := db.WriteValue(did, timestamp, []int64{timestamp}, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Flush()
+	}
+	for _, did := range []int64{1, 2} {
+		err := db.WriteKey(did, []int64{30775})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(1, 1)
+	write(2, 2)
+	write(1, 3)
+	write(1, 4)
+	err := db.key.Erase("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.merge(0, db.listFiles(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := db.listFiles(0, 0); len(files) != 3 {
+		t.Fatalf("files: %v", files)
+	}
+	values, err := db.ReadValue(1, 0, 10)
+	if err != nil || fmt.Sprint(values) != "[1 1 3 3 4 4]" {
+		t.Fatalf("values: %v %v", values, err)
+	}
+}
+
+func TestCake_FlushError(t *testing.T) {
+	path := t.TempDir()
+	db := NewCake(path)
+	defer db.Close()
+	err := db.WriteKey(1, []int64{30775})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteValue(1, 1, []int64{1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(path, "tmp"))
+	if err := db.Flush(); err == nil || db.Id() != 0 {
+		t.Fatalf("flush without tmp: %v %d", err, db.Id())
+	}
+	values, err := db.ReadValue(1, 0, 10)
+	if err != nil || fmt.Sprint(values) != "[1 1]" {
+		t.Fatalf("values after failed flush: %v %v", values, err)
+	}
+
+	os.MkdirAll(filepath.Join(path, "tmp"), 0777)
+	if err := db.Flush(); err != nil || db.Id() != 1 {
+		t.Fatalf("flush: %v %d", err, db.Id())
+	}
+	if files := db.listFiles(0, 0); len(files) != 1 {
+		t.Fatalf("files: %v", files)
+	}
+}
+
+func TestCakeServer_DropDBDuringFlush(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.CreateDB("solar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := s.Cake("solar")
+	err = db.WriteKey(1, []int64{30775})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10000; i++ {
+		err := db.WriteValue(1, int64(i), []int64{int64(i)}, uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	go db.Flush()
+	err = s.DropDB("solar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "solar")); !os.IsNotExist(err) {
+		t.Fatalf("dropped db still on disk: %v", err)
+	}
+	if err := db.WriteValue(1, 1, []int64{1}, 10001); err == nil {
+		t.Fatal("write to a dropped db accepted")
+	}
+}
+
+func TestCakeServer(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CreateDBWithConfig("solar", Config{ShardSize: int64(time.Hour), Retention: int64(time.Hour * 24), Codec: CodecLz4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateDB("solar"); err == nil {
+		t.Fatal("duplicate db created")
+	}
+	if err := s.CreateDB("../solar"); err == nil {
+		t.Fatal("invalid name accepted")
+	}
+	err = s.CreateDB("wind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := s.OpenDB("solar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteKey(1, []int64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteValue(1, 1, []int64{1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewServer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if names := s.ListDB(); fmt.Sprint(names) != "[solar wind]" {
+		t.Fatalf("dbs: %v", names)
+	}
+	config, err := s.Config("solar")
+	if err != nil || config.ShardSize != int64(time.Hour) || config.Codec != CodecLz4 {
+		t.Fatalf("config: %v %v", config, err)
+	}
+	db, err = s.OpenDB("solar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := db.ReadValue(1, 0, 10)
+	if err != nil || fmt.Sprint(values) != "[1 1]" {
+		t.Fatalf("values: %v %v", values, err)
+	}
+
+	err = s.DropDB("wind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.OpenDB("wind"); err == nil {
+		t.Fatal("dropped db opened")
+	}
+	if _, err := os.Stat(filepath.Join(root, "wind")); !os.IsNotExist(err) {
+		t.Fatalf("dropped db still on disk: %v", err)
+	}
+}
+
+func TestCake_Id(t *testing.T) {
+	path := t.TempDir()
+	db := NewCake(path)
+	err := db.WriteKey(1, []int64{30775})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		err := db.WriteValue(1, int64(i), []int64{int64(i)}, uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.Id() != 0 {
+		t.Fatalf("id before flush: %d", db.Id())
+	}
+	db.Flush()
+	if db.Id() != 10 {
+		t.Fatalf("id after flush: %d", db.Id())
+	}
+	err = db.WriteValue(1, 11, []int64{11}, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// crash without flush
+	close(db.done)
+
+	db = NewCake(path)
+	defer db.Close()
+	if db.Id() != 10 {
+		t.Fatalf("id after restart: %d", db.Id())
+	}
+	if err := db.WriteValue(1, 10, []int64{10}, 10); err == nil {
+		t.Fatal("committed id accepted")
+	}
+	err = db.WriteValue(1, 11, []int64{11}, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Flush()
+	if db.Id() != 11 {
+		t.Fatalf("id after second flush: %d", db.Id())
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	// [timestamp][value][value]...
+	values := []int64{0, 1, 10, 1, 2, 20, 2, 3, 30, 5, 4, 40}
+	want := map[string]string{
+		AggregateMin:   "[{0 3 [1 10]} {3 1 [4 40]}]",
+		AggregateMax:   "[{0 3 [3 30]} {3 1 [4 40]}]",
+		AggregateMean:  "[{0 3 [2 20]} {3 1 [4 40]}]",
+		AggregateSum:   "[{0 3 [6 60]} {3 1 [4 40]}]",
+		AggregateCount: "[{0 3 [3 3]} {3 1 [1 1]}]",
+		AggregateFirst: "[{0 3 [1 10]} {3 1 [4 40]}]",
+		AggregateLast:  "[{0 3 [3 30]} {3 1 [4 40]}]",
+	}
+	for fn, w := range want {
+		windows, err := Aggregate(values, 2, 3, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(windows) != w {
+			t.Fatalf("%s: %v", fn, windows)
+		}
+	}
+	if _, err := Aggregate(values, 2, 3, "median"); err == nil {
+		t.Fatal("unknown aggregate accepted")
+	}
+}
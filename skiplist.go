@@ -164,12 +164,16 @@ func (list *Map[K, V]) Delete(key K) {
 
 }
 
+// Insert adds key or replaces the key and the value of an equal one. The memtable keeps the
+// whole point in the key and compares only the device and the timestamp, so a point written
+// twice has the data of the second write like a newer file wins over an older one.
 func (list *Map[K, V]) Insert(key K, value V) {
 	prevTable := make([]*Node[K, V], list.maxHeight)
 	x := findGreaterOrEqual(list, key, prevTable)
 
 	// we don't allow dupes in this data structure
 	if x != nil && list.comp.Compare(key, x.key) == 0 {
+		x.key = key
 		x.value = value
 		return
 	}